@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"dss-api/internal/data"
+	"dss-api/internal/jwt"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token modes. In opaque mode access tokens are random strings looked up in
+// the tokens table on every request. In jwt mode they are short-lived signed
+// tokens verified without a database round trip.
+const (
+	tokenModeOpaque = "opaque"
+	tokenModeJWT    = "jwt"
+)
+
+// denylist is the in-memory copy of the revocations table that signed access
+// tokens are checked against.
+type denylist struct {
+	mu      sync.RWMutex
+	entries map[string]time.Time
+}
+
+// revoked reports whether a token issued at issuedAt for the subject has been
+// revoked since.
+func (d *denylist) revoked(subject string, issuedAt time.Time) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	revokedAt, ok := d.entries[subject]
+
+	return ok && !issuedAt.After(revokedAt)
+}
+
+// add puts a revocation made by this instance on the denylist right away.
+func (d *denylist) add(subject string, revokedAt time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.entries == nil {
+		d.entries = map[string]time.Time{}
+	}
+	if revokedAt.After(d.entries[subject]) {
+		d.entries[subject] = revokedAt
+	}
+}
+
+// replace swaps in the revocations read from the database. Entries added
+// since the read started are kept, as the read may have missed them.
+func (d *denylist) replace(revocations []*data.Revocation, readAt time.Time) {
+	entries := make(map[string]time.Time, len(revocations))
+	for _, revocation := range revocations {
+		entries[revocation.Subject] = revocation.RevokedAt
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for subject, revokedAt := range d.entries {
+		if !revokedAt.Before(readAt) && revokedAt.After(entries[subject]) {
+			entries[subject] = revokedAt
+		}
+	}
+	d.entries = entries
+}
+
+// syncDenylist reloads the denylist from the database every interval, so
+// that revocations made by any instance reach this one.
+func (app *application) syncDenylist(interval time.Duration) {
+	for {
+		readAt := time.Now()
+		revocations, err := app.models.Revocation.GetActive()
+		if err != nil {
+			app.errorLog.Println(err)
+		} else {
+			app.denylist.replace(revocations, readAt)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// listenTokenInvalidations keeps the token cache in step with changes made
+// by any instance, reconnecting whenever the connection is lost.
+func (app *application) listenTokenInvalidations() {
+	backoff := time.Second
+
+	for {
+		start := time.Now()
+		err := data.ListenTokenInvalidations(context.Background())
+		app.errorLog.Println(err)
+
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		} else if backoff < time.Minute {
+			backoff *= 2
+		}
+		time.Sleep(backoff)
+	}
+}
+
+// rotateSigningKeys replaces the JWT signing key once it is older than
+// interval. Every minute the key directory is reread, under a lock shared by
+// all instances: the first to find the key due replaces it, and the others
+// pick up the new key.
+func (app *application) rotateSigningKeys(interval time.Duration) {
+	for range time.Tick(min(interval, time.Minute)) {
+		var rotated bool
+		err := data.WithSigningKeyLock(func() error {
+			var err error
+			rotated, err = app.keys.RotateIfDue(interval)
+			return err
+		})
+		if err != nil {
+			app.errorLog.Println(err)
+			continue
+		}
+		if rotated {
+			app.infoLog.Println("JWT signing key rotated")
+		}
+	}
+}
+
+// signAccessToken issues a signed access token for a session of user. It
+// never outlives the session.
+func (app *application) signAccessToken(user *data.User, sessionID string, sessionExpiry time.Time) (*data.Token, error) {
+	jti, err := app.models.Token.NewFamily()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	token := &data.Token{
+		UserID:    user.ID,
+		UserName:  user.UserName,
+		Email:     user.Email,
+		Scope:     data.ScopeAuthentication,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Expiry:    now.Add(app.config.jwt.ttl),
+	}
+	token.CapExpiry(sessionExpiry)
+
+	token.Token, err = app.keys.Sign(jwt.Claims{
+		Subject:   fmt.Sprint(user.ID),
+		ID:        jti,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: token.Expiry.Unix(),
+		UserID:    user.ID,
+		Level:     user.Level,
+		SessionID: sessionID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// isJWT tells signed access tokens apart from opaque ones.
+func (app *application) isJWT(token string) bool {
+	return app.config.jwt.mode == tokenModeJWT && strings.Count(token, ".") == 2
+}
+
+// verifyJWT checks a signed access token and the denylist.
+func (app *application) verifyJWT(token string) (*jwt.Claims, error) {
+	claims, err := app.keys.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	issuedAt := time.Unix(claims.IssuedAt, 0)
+	if app.denylist.revoked(data.SessionSubject(claims.SessionID), issuedAt) ||
+		app.denylist.revoked(data.UserSubject(claims.UserID), issuedAt) {
+		return nil, errors.New("token has been revoked")
+	}
+
+	return claims, nil
+}
+
+// principal is who a request is made by. SessionID is empty for requests
+// made with an API key or an impersonation token, and APIKey is nil for all
+// others. Impersonator is the admin acting as User, if any. Cookie is set
+// when the access token came from the session cookie rather than the
+// Authorization header.
+type principal struct {
+	User         *data.User
+	SessionID    string
+	APIKey       *data.APIKey
+	Impersonator *data.User
+	Cookie       bool
+}
+
+// authenticate returns the principal a request is made by, taking the
+// access token from the Authorization header or else the session cookie.
+// Signed access tokens carry the user's id and level only; handlers needing
+// more load the user.
+func (app *application) authenticate(r *http.Request) (*principal, error) {
+	if token, ok := bearerToken(r); ok {
+		return app.principalFor(token)
+	}
+
+	token := cookieValue(r, accessCookie)
+	if token == "" {
+		return nil, errors.New("No valid authorization header received")
+	}
+
+	p, err := app.principalFor(token)
+	if err != nil {
+		return nil, err
+	}
+	p.Cookie = true
+
+	return p, nil
+}
+
+// principalFor returns the principal an access token or API key belongs to.
+func (app *application) principalFor(token string) (*principal, error) {
+
+	switch {
+	case strings.HasPrefix(token, data.APIKeyPrefix):
+		key, user, err := app.models.APIKey.Authenticate(token)
+		if err != nil {
+			return nil, err
+		}
+
+		return &principal{User: user, APIKey: key}, nil
+	case app.isJWT(token):
+		claims, err := app.verifyJWT(token)
+		if err != nil {
+			return nil, err
+		}
+
+		user := &data.User{ID: claims.UserID, Level: claims.Level, Active: 1}
+
+		return &principal{User: user, SessionID: claims.SessionID}, nil
+	}
+
+	user, tkn, err := app.models.Token.Authenticate(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if tkn.ImpersonatorID != nil {
+		impersonator, err := app.impersonator(*tkn.ImpersonatorID)
+		if err != nil {
+			return nil, err
+		}
+
+		return &principal{User: user, Impersonator: impersonator}, nil
+	}
+
+	return &principal{User: user, SessionID: tkn.Family}, nil
+}
+
+// impersonator loads the admin an impersonation token was issued to. The
+// token stops working as soon as they are deactivated or lose the right to
+// impersonate.
+func (app *application) impersonator(id int) (*data.User, error) {
+	user, err := app.models.User.GetOne(id)
+	if err != nil {
+		return nil, errors.New("No matching impersonator found")
+	}
+
+	if user.Active == 0 || !user.Can(data.PermImpersonate) {
+		return nil, errors.New("Impersonator may no longer impersonate")
+	}
+
+	return user, nil
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	headerParts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		return "", false
+	}
+
+	return headerParts[1], true
+}
+
+// JWKS publishes the public keys signed access tokens can be verified with.
+func (app *application) JWKS(w http.ResponseWriter, r *http.Request) {
+	keys := []jwt.JWK{}
+	if app.keys != nil {
+		keys = app.keys.JWKS()
+	}
+
+	headers := http.Header{}
+	headers.Set("Cache-Control", "public, max-age=300")
+
+	_ = app.writeJSON(w, http.StatusOK, envelope{"keys": keys}, headers)
+}
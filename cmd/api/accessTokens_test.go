@@ -0,0 +1,86 @@
+package main
+
+import (
+	"dss-api/internal/data"
+	"dss-api/internal/jwt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestDenylist(t *testing.T) {
+	var d denylist
+	now := time.Now()
+
+	d.add("uid:7", now)
+	if !d.revoked("uid:7", now.Add(-time.Minute)) {
+		t.Error("token issued before the revocation is accepted")
+	}
+	if d.revoked("uid:7", now.Add(time.Second)) {
+		t.Error("token issued after the revocation is refused")
+	}
+
+	// a sync that read the table before the revocation keeps it
+	d.replace([]*data.Revocation{{Subject: "uid:8", RevokedAt: now.Add(-time.Hour)}}, now.Add(-time.Second))
+	if !d.revoked("uid:7", now.Add(-time.Minute)) {
+		t.Error("a sync started before the revocation dropped it")
+	}
+	if !d.revoked("uid:8", now.Add(-2*time.Hour)) {
+		t.Error("the synced revocation is missing")
+	}
+
+	// a later sync is authoritative
+	d.replace(nil, now.Add(time.Second))
+	if d.revoked("uid:7", now.Add(-time.Minute)) || d.revoked("uid:8", now.Add(-2*time.Hour)) {
+		t.Error("expired revocations outlived the sync")
+	}
+}
+
+func TestVerifyJWTRefusesDemotedUserAtOnce(t *testing.T) {
+	app, mock := newTestApp(t)
+	app.config.jwt.mode = tokenModeJWT
+
+	var err error
+	app.keys, err = jwt.NewKeySet(jwt.EdDSA, "dss-api", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuedAt := time.Now().Add(-time.Second)
+	token, err := app.keys.Sign(jwt.Claims{
+		IssuedAt:  issuedAt.Unix(),
+		ExpiresAt: issuedAt.Add(5 * time.Minute).Unix(),
+		UserID:    7,
+		Level:     data.LevelAdmin,
+		SessionID: "s-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.verifyJWT(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data.SetRevocationHook(app.denylist.add)
+	t.Cleanup(func() { data.SetRevocationHook(func(string, time.Time) {}) })
+
+	mock.ExpectQuery(`update users set .* returning prev.level`).
+		WillReturnRows(sqlmock.NewRows([]string{"level"}).AddRow(data.LevelAdmin))
+	mock.ExpectExec(`insert into revocations`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`select pg_notify`).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// demoted, with no denylist sync in between
+	user := &data.User{ID: 7, UserName: "jane", Email: "jane@example.com", Active: 1, Level: data.LevelUser}
+	err = user.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.verifyJWT(token)
+	if err == nil {
+		t.Error("token of a revoked user is accepted")
+	}
+}
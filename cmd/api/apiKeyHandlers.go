@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"dss-api/internal/data"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+func (app *application) MyAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	keys, err := app.models.APIKey.GetAllForUser(user.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"api_keys": keys, "available_scopes": data.APIScopes},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *application) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var requestPayload struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+
+	requestPayload.Name = strings.TrimSpace(requestPayload.Name)
+	if requestPayload.Name == "" {
+		app.errorJSON(w, errors.New("name is required"))
+		return
+	}
+
+	if len(requestPayload.Scopes) == 0 {
+		app.errorJSON(w, errors.New("at least one scope is required"))
+		return
+	}
+
+	for _, scope := range requestPayload.Scopes {
+		if !knownAPIScope(scope) {
+			app.errorJSON(w, errors.New("unknown scope "+scope))
+			return
+		}
+	}
+
+	ttl := time.Duration(requestPayload.ExpiresInDays) * 24 * time.Hour
+
+	key, err := app.models.APIKey.Generate(user.ID, requestPayload.Name, requestPayload.Scopes, ttl)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.models.APIKey.Insert(key)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	app.audit(r, user.ID, auditAPIKeyCreate, user.ID, "api_key:"+key.Prefix, map[string]any{"name": key.Name, "scopes": key.Scopes})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "API key created. Copy it now, it won't be shown again",
+		Data:    envelope{"api_key": key},
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, payload)
+}
+
+func (app *application) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	keyID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.models.APIKey.Delete(user.ID, keyID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("api key not found"), http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+	app.audit(r, user.ID, auditAPIKeyRevoke, user.ID, "api_key:"+strconv.Itoa(keyID), nil)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "API key revoked",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+func knownAPIScope(scope string) bool {
+	for _, s := range data.APIScopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
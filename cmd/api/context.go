@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"dss-api/internal/data"
+	"net/http"
+)
+
+type contextKey string
+
+const principalContextKey = contextKey("principal")
+
+// contextSetPrincipal returns a copy of the request carrying who it is made
+// by: the user, their session and the API key used, if any.
+func (app *application) contextSetPrincipal(r *http.Request, p *principal) *http.Request {
+	ctx := context.WithValue(r.Context(), principalContextKey, p)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextGetPrincipal(r *http.Request) *principal {
+	p, ok := r.Context().Value(principalContextKey).(*principal)
+	if !ok {
+		panic("missing principal value in request context")
+	}
+
+	return p
+}
+
+// contextGetUser returns the user put in the request by AuthTokenMiddleware.
+// It must only be called from handlers behind that middleware.
+func (app *application) contextGetUser(r *http.Request) *data.User {
+	return app.contextGetPrincipal(r).User
+}
+
+// contextGetSessionID returns the id of the session the request was made in,
+// or an empty string for requests made with an API key.
+func (app *application) contextGetSessionID(r *http.Request) string {
+	return app.contextGetPrincipal(r).SessionID
+}
+
+// contextGetImpersonator returns the admin impersonating the user, or nil
+// when the request isn't made under impersonation.
+func (app *application) contextGetImpersonator(r *http.Request) *data.User {
+	p, ok := r.Context().Value(principalContextKey).(*principal)
+	if !ok {
+		return nil
+	}
+
+	return p.Impersonator
+}
+
+// contextGetAPIKey returns the API key the request was authenticated with, or
+// nil when it was authenticated otherwise.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	p, ok := r.Context().Value(principalContextKey).(*principal)
+	if !ok {
+		return nil
+	}
+
+	return p.APIKey
+}
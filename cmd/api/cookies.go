@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"dss-api/internal/data"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Browser sessions keep their tokens in cookies instead of handing them to
+// the page. The access and refresh tokens are HttpOnly; the CSRF token is
+// readable by the page, which sends it back in the X-CSRF-Token header with
+// every state-changing request (double submit).
+const (
+	accessCookie  = "dss_access"
+	refreshCookie = "dss_refresh"
+	csrfCookie    = "dss_csrf"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+var errInvalidCSRF = errors.New("missing or invalid CSRF token")
+
+// refreshCookiePath limits the refresh token to the routes that use it,
+// /users/refresh and /users/logout.
+const refreshCookiePath = "/users"
+
+// randomToken returns a random URL safe token, such as a CSRF token.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (app *application) cookie(name, value, path string, expires time.Time, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   app.config.cookies.domain,
+		Expires:  expires,
+		Secure:   app.config.cookies.secure,
+		HttpOnly: httpOnly,
+		SameSite: app.config.cookies.sameSite,
+	}
+}
+
+// setSessionCookies puts a session's tokens in cookies that last as long as
+// the session. The server still enforces the access token's own expiry. A
+// new CSRF token is made unless csrf is given, and returned.
+func (app *application) setSessionCookies(w http.ResponseWriter, token, refreshToken *data.Token, csrf string) (string, error) {
+	if csrf == "" {
+		var err error
+		csrf, err = randomToken()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	expires := refreshToken.Expiry
+	http.SetCookie(w, app.cookie(accessCookie, token.Token, "/", expires, true))
+	http.SetCookie(w, app.cookie(refreshCookie, refreshToken.Token, refreshCookiePath, expires, true))
+	http.SetCookie(w, app.cookie(csrfCookie, csrf, "/", expires, false))
+
+	return csrf, nil
+}
+
+// clearSessionCookies removes the session cookies from the browser.
+func (app *application) clearSessionCookies(w http.ResponseWriter) {
+	for _, c := range []*http.Cookie{
+		app.cookie(accessCookie, "", "/", time.Unix(0, 0), true),
+		app.cookie(refreshCookie, "", refreshCookiePath, time.Unix(0, 0), true),
+		app.cookie(csrfCookie, "", "/", time.Unix(0, 0), false),
+	} {
+		c.MaxAge = -1
+		http.SetCookie(w, c)
+	}
+}
+
+// cookieValue returns the value of the named cookie, or an empty string.
+func cookieValue(r *http.Request, name string) string {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+
+	return c.Value
+}
+
+// validCSRF reports whether a request authenticated by cookie may go ahead:
+// safe methods always may, others must echo the CSRF cookie in the header.
+func validCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	cookie := cookieValue(r, csrfCookie)
+	header := strings.TrimSpace(r.Header.Get(csrfHeader))
+
+	return cookie != "" && subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) == 1
+}
+
+// parseSameSite reads a SameSite mode: "strict", "lax" or "none".
+func parseSameSite(value string) http.SameSite {
+	switch strings.ToLower(value) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
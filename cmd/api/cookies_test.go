@@ -0,0 +1,176 @@
+package main
+
+import (
+	"dss-api/internal/data"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSessionCookieAttributes(t *testing.T) {
+	app, _ := newTestApp(t)
+	app.config.cookies.secure = true
+	app.config.cookies.sameSite = parseSameSite("strict")
+
+	expires := time.Now().Add(time.Hour)
+	rec := httptest.NewRecorder()
+	csrf, err := app.setSessionCookies(rec, &data.Token{Token: "access"}, &data.Token{Token: "refresh", Expiry: expires}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, value, path string
+		httpOnly          bool
+	}{
+		{accessCookie, "access", "/", true},
+		{refreshCookie, "refresh", refreshCookiePath, true},
+		// the page has to read the CSRF token to send it back
+		{csrfCookie, csrf, "/", false},
+	}
+
+	cookies := map[string]*http.Cookie{}
+	for _, c := range rec.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	for _, tt := range tests {
+		c, ok := cookies[tt.name]
+		if !ok {
+			t.Errorf("%s is not set", tt.name)
+			continue
+		}
+		if c.Value != tt.value || c.Path != tt.path {
+			t.Errorf("%s = %q on %s, want %q on %s", tt.name, c.Value, c.Path, tt.value, tt.path)
+		}
+		if c.HttpOnly != tt.httpOnly {
+			t.Errorf("%s HttpOnly = %v, want %v", tt.name, c.HttpOnly, tt.httpOnly)
+		}
+		if !c.Secure {
+			t.Errorf("%s is not Secure", tt.name)
+		}
+		if c.SameSite != http.SameSiteStrictMode {
+			t.Errorf("%s SameSite = %v, want strict", tt.name, c.SameSite)
+		}
+		if !c.Expires.Equal(expires.Truncate(time.Second)) {
+			t.Errorf("%s expires %s, want %s", tt.name, c.Expires, expires)
+		}
+	}
+	if csrf == "" {
+		t.Error("no CSRF token")
+	}
+}
+
+func TestParseSameSite(t *testing.T) {
+	for value, want := range map[string]http.SameSite{
+		"strict": http.SameSiteStrictMode,
+		"Lax":    http.SameSiteLaxMode,
+		"none":   http.SameSiteNoneMode,
+		"":       http.SameSiteLaxMode,
+	} {
+		if got := parseSameSite(value); got != want {
+			t.Errorf("parseSameSite(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
+
+// TestCookieSessionsRequireCSRF checks that every route taking its
+// credentials from cookies refuses a state-changing request that doesn't
+// echo the CSRF cookie.
+func TestCookieSessionsRequireCSRF(t *testing.T) {
+	app, mock := newTestApp(t)
+	access := strings.TrimPrefix(signIn(t, app, 7, data.LevelUser).Get("Authorization"), "Bearer ")
+
+	routes := []struct {
+		name, path string
+		cookies    string
+		body       any
+	}{
+		{"middleware", "/me/password", accessCookie + "=" + access, map[string]string{}},
+		{"refresh", "/users/refresh", refreshCookie + "=refresh", map[string]string{}},
+		{"logout", "/users/logout", refreshCookie + "=refresh", map[string]string{}},
+	}
+	headers := []struct {
+		name  string
+		value []string
+	}{
+		{"missing", nil},
+		{"mismatched", []string{"other"}},
+		{"empty", []string{""}},
+	}
+
+	for _, route := range routes {
+		for _, h := range headers {
+			t.Run(route.name+" "+h.name, func(t *testing.T) {
+				header := http.Header{"Cookie": {route.cookies + "; " + csrfCookie + "=csrf"}}
+				if h.value != nil {
+					header[csrfHeader] = h.value
+				}
+
+				rec, payload := do(t, app, http.MethodPost, route.path, route.body, header)
+				if rec.Code != http.StatusForbidden || payload.Message != errInvalidCSRF.Error() {
+					t.Errorf("status = %d, payload = %+v", rec.Code, payload)
+				}
+				// a refused logout leaves the session alone
+				if cookies := rec.Result().Cookies(); len(cookies) != 0 {
+					t.Errorf("cookies set: %v", cookies)
+				}
+			})
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCookieSessionsSafeMethodsSkipCSRF(t *testing.T) {
+	app, mock := newTestApp(t)
+	access := strings.TrimPrefix(signIn(t, app, 7, data.LevelUser).Get("Authorization"), "Bearer ")
+
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", Active: 1, Level: data.LevelUser}
+	mock.ExpectQuery(`from users where id = \$1`).WithArgs(7).WillReturnRows(userRows(user))
+
+	rec, payload := do(t, app, http.MethodGet, "/me/", nil, http.Header{"Cookie": {accessCookie + "=" + access}})
+	if rec.Code != http.StatusOK || payload.Error {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+}
+
+func TestLogoutClearsCookies(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	mock.ExpectQuery(`from tokens where token_hash = \$1`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select family from tokens where token_hash = \$1`).WillReturnRows(sqlmock.NewRows([]string{"family"}))
+	mock.ExpectRollback()
+
+	header := http.Header{
+		"Cookie":   {refreshCookie + "=refresh; " + accessCookie + "=access; " + csrfCookie + "=csrf"},
+		csrfHeader: {"csrf"},
+	}
+	rec, payload := do(t, app, http.MethodPost, "/users/logout", map[string]string{}, header)
+	if rec.Code != http.StatusOK || payload.Message != "Logged out" {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+
+	cleared := map[string]bool{}
+	for _, c := range rec.Result().Cookies() {
+		if c.Value != "" || c.MaxAge >= 0 {
+			t.Errorf("%s is not cleared: %v", c.Name, c)
+		}
+		cleared[c.Name] = true
+	}
+	for _, name := range []string{accessCookie, refreshCookie, csrfCookie} {
+		if !cleared[name] {
+			t.Errorf("%s is not cleared", name)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
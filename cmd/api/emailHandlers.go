@@ -0,0 +1,113 @@
+package main
+
+import (
+	"dss-api/internal/data"
+	"dss-api/internal/mailer"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/go-chi/chi"
+)
+
+// sendVerificationEmail mails user a link confirming that they own email,
+// which is either their current or their pending address.
+func (app *application) sendVerificationEmail(user data.User, email string) {
+	app.background(func() {
+		token, err := app.models.Token.GenerateToken(user.ID, app.config.verifyTokenTTL)
+		if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+		token.Scope = data.ScopeEmailVerify
+		token.Email = email
+
+		err = app.models.Token.Insert(*token, user)
+		if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+
+		link := fmt.Sprintf("%s/verify-email?token=%s", app.config.frontendURL, url.QueryEscape(token.Token))
+
+		err = app.mailer.Send(mailer.Message{
+			To:      email,
+			Subject: "Confirm your email address",
+			Body: fmt.Sprintf("Hello %s,\n\nPlease confirm that this is your email address by following this link within %s:\n\n%s\n\n"+
+				"If you did not expect this email, you can ignore it.\n",
+				user.FirstName, app.config.verifyTokenTTL, link),
+		})
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	})
+}
+
+func (app *application) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Token string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+
+	token, user, err := app.models.Token.Consume(requestPayload.Token, data.ScopeEmailVerify)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid or expired verification link"))
+		return
+	}
+
+	err = user.VerifyEmail(token.Email)
+	if err != nil {
+		if errors.Is(err, data.ErrInvalidToken) {
+			app.errorJSON(w, errors.New("invalid or expired verification link"))
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+	app.audit(r, user.ID, auditEmailVerify, user.ID, "", map[string]any{"email": token.Email})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Email address verified",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *application) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.models.User.GetOne(userID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	switch {
+	case user.PendingEmail != "":
+		app.sendVerificationEmail(*user, user.PendingEmail)
+	case user.VerifiedAt == nil:
+		app.sendVerificationEmail(*user, user.Email)
+	default:
+		app.errorJSON(w, errors.New("email address is already verified"))
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Verification email sent",
+	}
+
+	_ = app.writeJSON(w, http.StatusAccepted, payload)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"dss-api/internal/data"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginHashPoolSaturated(t *testing.T) {
+	data.SetHashPool(1, 20*time.Millisecond)
+	t.Cleanup(func() { data.SetHashPool(runtime.NumCPU(), 2*time.Second) })
+
+	// a slow hash keeps the only slot busy
+	slow, err := bcrypt.GenerateFromPassword([]byte("password"), 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy := &data.User{ID: 8, Password: string(slow)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = busy.PasswordMatches("password")
+	}()
+	defer func() { <-done }()
+
+	for data.GetHashPoolStats().Running == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	app, mock := newTestApp(t)
+	mock.MatchExpectationsInOrder(false)
+
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", Password: string(slow), Active: 1, Level: data.LevelUser}
+	none := func() *sqlmock.Rows { return sqlmock.NewRows([]string{"locked_until"}) }
+	mock.ExpectQuery(`from login_throttles`).WithArgs(data.ThrottleAccount, "jane").WillReturnRows(none())
+	mock.ExpectQuery(`from login_throttles`).WithArgs(data.ThrottleIP, sqlmock.AnyArg()).WillReturnRows(none())
+	mock.ExpectQuery(`from users where email = \$1 or lower\(username\) = \$1`).WillReturnRows(userRows(user))
+	mock.ExpectQuery(`from login_throttles`).WithArgs(data.ThrottleAccount, "user:7").WillReturnRows(none())
+	mock.ExpectQuery(`from login_throttles`).WithArgs(data.ThrottleIP, sqlmock.AnyArg()).WillReturnRows(none())
+
+	rec, payload := do(t, app, http.MethodPost, "/users/login", map[string]string{"username": "jane", "password": "password"}, nil)
+	if rec.Code != http.StatusServiceUnavailable || !payload.Error {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+}
@@ -1,17 +1,25 @@
 package main
 
 import (
+	"dss-api/internal/data"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type jsonResponse struct {
-	Error   bool        `json:"error"`
-	Message string      `json:"message"`
-	Data    interface{} `json:"data, omitempty"`
+	Error   bool   `json:"error"`
+	Message string `json:"message"`
+	// Data is always sent, so that clients can rely on e.g. "data": false
+	Data interface{} `json:"data"`
 }
 
 type envelope map[string]interface{}
@@ -78,6 +86,32 @@ func (app *application) errorJSON(w http.ResponseWriter, err error, status ...in
 		statusCode = status[0]
 	}
 
+	// password policy violations are reported rule by rule
+	var policyErr *data.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		payload := jsonResponse{
+			Error:   true,
+			Message: "password does not meet the password policy",
+			Data:    envelope{"violations": policyErr.Violations},
+		}
+		app.writeJSON(w, http.StatusUnprocessableEntity, payload)
+		return
+	}
+
+	// the password hashing pool is full; the client may try again shortly
+	if errors.Is(err, data.ErrHashPoolBusy) {
+		retryAfter := int(math.Ceil(data.HashPoolQueueTimeout().Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		payload := jsonResponse{
+			Error:   true,
+			Message: err.Error(),
+		}
+		app.writeJSON(w, http.StatusServiceUnavailable, payload, http.Header{"Retry-After": {strconv.Itoa(retryAfter)}})
+		return
+	}
+
 	var customErr error
 
 	switch {
@@ -100,3 +134,147 @@ func (app *application) errorJSON(w http.ResponseWriter, err error, status ...in
 
 	app.writeJSON(w, statusCode, payload)
 }
+
+// clientIP returns the address of the client that sent the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// envString reads a string from the environment, falling back to def when
+// the variable is unset.
+func envString(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+
+	return def
+}
+
+// envInt reads an integer from the environment, falling back to def when the
+// variable is unset or malformed.
+func envInt(key string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+
+	return value
+}
+
+// envDuration reads a duration such as "30m" from the environment, falling
+// back to def when the variable is unset or malformed.
+func envDuration(key string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+
+	return value
+}
+
+// envList reads a comma separated list from the environment, in lower case
+// and without blank entries.
+func envList(key string) []string {
+	var list []string
+	for _, entry := range strings.Split(os.Getenv(key), ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+			list = append(list, entry)
+		}
+	}
+
+	return list
+}
+
+// parseLevels parses a comma separated list of user levels into a set.
+func parseLevels(value string) (map[int]bool, error) {
+	levels := map[int]bool{}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		level, err := strconv.Atoi(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid level %q", entry)
+		}
+		levels[level] = true
+	}
+
+	return levels, nil
+}
+
+// parseDomains parses a comma separated list of email domains, trimmed, in
+// lower case and without a leading "@", so that they compare equal to the
+// domain part of a normalised address.
+func parseDomains(value string) []string {
+	var domains []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(entry)), "@")
+		if entry != "" {
+			domains = append(domains, entry)
+		}
+	}
+
+	return domains
+}
+
+// parseSessionPolicies parses per level session policies written as
+// "level=idle/absolute" pairs separated by commas, e.g. "1=15m/8h,2=30m/24h".
+func parseSessionPolicies(value string) (map[int]data.SessionPolicy, error) {
+	policies := map[int]data.SessionPolicy{}
+	if value == "" {
+		return policies, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		level, durations, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid session policy %q", entry)
+		}
+
+		idle, absolute, ok := strings.Cut(durations, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid session policy %q", entry)
+		}
+
+		lvl, err := strconv.Atoi(level)
+		if err != nil {
+			return nil, fmt.Errorf("invalid session policy level %q", level)
+		}
+
+		var policy data.SessionPolicy
+		policy.IdleTimeout, err = time.ParseDuration(idle)
+		if err != nil {
+			return nil, err
+		}
+		policy.AbsoluteLifetime, err = time.ParseDuration(absolute)
+		if err != nil {
+			return nil, err
+		}
+
+		policies[lvl] = policy
+	}
+
+	return policies, nil
+}
+
+// background runs fn in its own goroutine, logging instead of crashing the
+// server if it panics.
+func (app *application) background(fn func()) {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				app.errorLog.Println(err)
+			}
+		}()
+
+		fn()
+	}()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+)
+
+var errImpersonating = errors.New("this can't be done while impersonating a user")
+
+// Impersonate issues a short-lived access token that lets an admin use the
+// API as another user. The token is tied to both of them: responses to it
+// carry the X-Impersonated-By header, and audit entries written under it
+// name the admin as well as the user. It belongs to no session and can't be
+// refreshed.
+func (app *application) Impersonate(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	admin := app.contextGetUser(r)
+	if admin.ID == userID {
+		app.errorJSON(w, errors.New("you can't impersonate yourself"), http.StatusForbidden)
+		return
+	}
+
+	user, err := app.models.User.GetOne(userID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// an admin of the same level could act with rights nobody granted them
+	if user.Level >= admin.Level {
+		app.errorJSON(w, errors.New("you can only impersonate users below your own level"), http.StatusForbidden)
+		return
+	}
+
+	if user.Active == 0 {
+		app.errorJSON(w, errors.New("User is not active"))
+		return
+	}
+
+	token, err := app.models.Token.GenerateImpersonationToken(user.ID, admin.ID, app.config.impersonationTTL)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.models.Token.Insert(*token, *user)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.audit(r, admin.ID, auditImpersonate, user.ID, "", map[string]any{"expiry": token.Expiry})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "impersonating " + user.UserName,
+		Data:    envelope{"token": token, "user": user},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
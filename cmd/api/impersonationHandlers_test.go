@@ -0,0 +1,76 @@
+package main
+
+import (
+	"dss-api/internal/data"
+	"net/http"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestImpersonate(t *testing.T) {
+	app, mock := newTestApp(t)
+	header := signIn(t, app, 1, data.LevelAdmin)
+
+	target := data.User{ID: 42, UserName: "jane", Email: "jane@example.com", Active: 1, Level: data.LevelUser}
+	impersonator := &capture{}
+
+	// the id comes from the route pattern
+	mock.ExpectQuery(`from users where id = \$1`).WithArgs(42).WillReturnRows(userRows(target))
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into tokens`).
+		WithArgs(42, "jane", "jane@example.com", sqlmock.AnyArg(), data.ScopeAuthentication, sqlmock.AnyArg(),
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), impersonator, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	rec, payload := do(t, app, http.MethodPost, "/admin/users/impersonate/42", nil, header)
+	if rec.Code != http.StatusOK || payload.Error {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+	if payload.Message != "impersonating jane" {
+		t.Errorf("message = %q", payload.Message)
+	}
+	if id, ok := impersonator.value.(int64); !ok || id != 1 {
+		t.Errorf("impersonator_id = %v, want 1", impersonator.value)
+	}
+
+	err := mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestImpersonateRefuses(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		target *data.User
+		status int
+	}{
+		{"yourself", "/admin/users/impersonate/1", nil, http.StatusForbidden},
+		{"same level", "/admin/users/impersonate/43", &data.User{ID: 43, Active: 1, Level: data.LevelAdmin}, http.StatusForbidden},
+		{"inactive", "/admin/users/impersonate/44", &data.User{ID: 44, Active: 0, Level: data.LevelUser}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newTestApp(t)
+			header := signIn(t, app, 1, data.LevelAdmin)
+
+			if tt.target != nil {
+				mock.ExpectQuery(`from users where id = \$1`).WithArgs(tt.target.ID).WillReturnRows(userRows(*tt.target))
+			}
+
+			rec, payload := do(t, app, http.MethodPost, tt.path, nil, header)
+			if rec.Code != tt.status || !payload.Error {
+				t.Errorf("status = %d, payload = %+v", rec.Code, payload)
+			}
+
+			err := mock.ExpectationsWereMet()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"dss-api/internal/data"
+	"dss-api/internal/mailer"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+var errInvitationNotFound = errors.New("invitation not found")
+
+// sendInvitation mails user a link to set their password and activate their
+// account. A new link replaces any sent before.
+func (app *application) sendInvitation(user data.User, inviter *data.User) {
+	app.background(func() {
+		token, err := app.models.Token.GenerateToken(user.ID, app.config.inviteTokenTTL)
+		if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+		token.Scope = data.ScopeInvitation
+
+		err = app.models.Token.Insert(*token, user)
+		if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+
+		link := fmt.Sprintf("%s/accept-invite?token=%s", app.config.frontendURL, url.QueryEscape(token.Token))
+
+		err = app.mailer.Send(mailer.Message{
+			To:      user.Email,
+			Subject: "You have been invited",
+			Body: fmt.Sprintf("Hello %s,\n\n%s %s has created an account for you. "+
+				"To choose your password and start using it, follow this link within %s:\n\n%s\n\n"+
+				"If you did not expect this email, you can ignore it.\n",
+				user.FirstName, inviter.FirstName, inviter.LastName, app.config.inviteTokenTTL, link),
+		})
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	})
+}
+
+// inviteUser creates a pending user and emails them an invitation. Their
+// password is never set by the admin.
+func (app *application) inviteUser(w http.ResponseWriter, r *http.Request, user data.User) {
+	if user.Password != "" {
+		app.errorJSON(w, errors.New("new users choose their own password when they accept the invitation"))
+		return
+	}
+
+	if user.Email == "" {
+		app.errorJSON(w, errors.New("email is required"))
+		return
+	}
+
+	actor := app.contextGetUser(r)
+	if user.Level > actor.Level {
+		app.errorJSON(w, errHigherLevel, http.StatusForbidden)
+		return
+	}
+
+	// signed access tokens carry the level only
+	inviter, err := app.models.User.GetOne(actor.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	newID, err := app.models.Invitation.Insert(user, inviter.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	invitee, err := app.models.User.GetOne(newID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.audit(r, inviter.ID, auditUserCreate, newID, "", map[string]any{"after": auditUser(invitee), "invited": true})
+	app.sendInvitation(*invitee, inviter)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Invitation sent",
+		Data:    envelope{"id": newID},
+	}
+
+	_ = app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *application) InviteUser(w http.ResponseWriter, r *http.Request) {
+	var requestPayload userPayload
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+	user := requestPayload.User
+	user.Password = requestPayload.Password
+
+	app.inviteUser(w, r, user)
+}
+
+// Invitations lists the invitations that haven't been accepted.
+func (app *application) Invitations(w http.ResponseWriter, r *http.Request) {
+	invitations, err := app.models.Invitation.GetAllPending()
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"invitations": invitations},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// ResendInvitation mails a pending invitee a new link, with a new expiry.
+// Links sent before stop working.
+func (app *application) ResendInvitation(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.models.Invitation.GetPendingUser(userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errInvitationNotFound, http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+
+	inviter, err := app.models.User.GetOne(app.contextGetUser(r).ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.audit(r, inviter.ID, auditInviteResend, user.ID, "", nil)
+	app.sendInvitation(*user, inviter)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Invitation sent",
+	}
+
+	_ = app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// RevokeInvitation withdraws a pending invitation. The invited user, who has
+// never been able to log in, is deleted.
+func (app *application) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.models.Invitation.GetPendingUser(userID)
+	if err == nil {
+		err = app.models.Invitation.Delete(userID)
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errInvitationNotFound, http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+	app.audit(r, app.contextGetUser(r).ID, auditInviteRevoke, 0, "user:"+strconv.Itoa(userID), map[string]any{"before": auditUser(user)})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Invitation revoked",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// AcceptInvitation sets the password of an invited user and activates them.
+func (app *application) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+
+	if requestPayload.Password == "" {
+		app.errorJSON(w, errors.New("password is required"))
+		return
+	}
+
+	// check the password first so that a rejected one does not use up the link
+	token, err := app.models.Token.GetByToken(requestPayload.Token)
+	if err != nil || token.Scope != data.ScopeInvitation || token.Expiry.Before(time.Now()) {
+		app.errorJSON(w, errors.New("invalid or expired invitation link"))
+		return
+	}
+
+	user, err := app.models.Token.GetUserForToken(*token)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid or expired invitation link"))
+		return
+	}
+
+	err = data.CheckPassword(requestPayload.Password, *user)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	token, user, err = app.models.Token.Consume(requestPayload.Token, data.ScopeInvitation)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid or expired invitation link"))
+		return
+	}
+
+	err = app.models.Invitation.Accept(*user, requestPayload.Password, token.Email == user.Email)
+	if err != nil {
+		if errors.Is(err, data.ErrInvalidToken) {
+			app.errorJSON(w, errors.New("invalid or expired invitation link"))
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+	app.audit(r, user.ID, auditInviteAccept, user.ID, "", nil)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Invitation accepted, you can now log in",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"dss-api/internal/data"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// invitee is a user waiting for an invitation to be accepted.
+var invitee = data.User{ID: 12, UserName: "newbie", Email: "newbie@example.com", Level: data.LevelUser}
+
+func invitationToken(expiry time.Time) data.Token {
+	return data.Token{ID: 3, UserID: invitee.ID, UserName: invitee.UserName, Email: invitee.Email,
+		Scope: data.ScopeInvitation, CreatedAt: time.Now(), UpdatedAt: time.Now(), Expiry: expiry}
+}
+
+func TestAcceptInvitationRefusesExpiredLink(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	expectGetToken(mock, invitationToken(time.Now().Add(-time.Minute)))
+
+	rr, payload := do(t, app, http.MethodPost, "/users/accept-invite",
+		map[string]string{"token": "invite-token", "password": "Correct-Horse-9"}, nil)
+	if rr.Code != http.StatusBadRequest || payload.Message != "invalid or expired invitation link" {
+		t.Fatalf("got %d %q", rr.Code, payload.Message)
+	}
+
+	// the link is looked up but never spent
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAcceptInvitationKeepsLinkForRejectedPassword(t *testing.T) {
+	app, mock := newTestApp(t)
+	passwordHash(t, "unused")
+
+	expectGetToken(mock, invitationToken(time.Now().Add(time.Hour)))
+	mock.ExpectQuery(`from users where id = \$1`).WithArgs(invitee.ID).WillReturnRows(userRows(invitee))
+
+	rr, payload := do(t, app, http.MethodPost, "/users/accept-invite",
+		map[string]string{"token": "invite-token", "password": "short"}, nil)
+	if rr.Code != http.StatusUnprocessableEntity || !payload.Error {
+		t.Fatalf("got %d %q", rr.Code, payload.Message)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("the link was spent: %v", err)
+	}
+
+	// the same link still works with a password that meets the policy
+	expectGetToken(mock, invitationToken(time.Now().Add(time.Hour)))
+	mock.ExpectQuery(`from users where id = \$1`).WithArgs(invitee.ID).WillReturnRows(userRows(invitee))
+	expectConsumeToken(mock, data.ScopeInvitation, invitee)
+	mock.ExpectExec(`update users set password = \$1, active = 1, verified_at = \$2, invitation_accepted_at = \$3`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), invitee.ID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectAudit(mock, auditInviteAccept)
+
+	rr, payload = do(t, app, http.MethodPost, "/users/accept-invite",
+		map[string]string{"token": "invite-token", "password": "Correct-Horse-9"}, nil)
+	if rr.Code != http.StatusOK || payload.Message != "Invitation accepted, you can now log in" {
+		t.Fatalf("got %d %q", rr.Code, payload.Message)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"database/sql"
+	"dss-api/internal/data"
 	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -13,6 +16,11 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 	type credentials struct {
 		UserName string `json:"username"`
 		Password string `json:"password"`
+		// Cookie asks for a browser session kept in cookies
+		Cookie bool `json:"cookie"`
+		// MagicToken logs in with an emailed link instead of a password
+		MagicToken string `json:"magic_token"`
+		Binding    string `json:"binding"`
 	}
 
 	var creds credentials
@@ -24,50 +32,318 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 		payload.Error = true
 		payload.Message = "invalid json supplied, or json missing entirely"
 		_ = app.writeJSON(w, http.StatusBadRequest, payload)
+		return
+	}
+
+	if creds.MagicToken != "" {
+		app.loginWithMagicLink(w, r, creds.MagicToken, creds.Binding, creds.Cookie)
+		return
 	}
 
-	// TODO authenticate
-	app.infoLog.Println(creds.UserName, creds.Password)
+	// refuse locked accounts and addresses before spending time on password hashing
+	account := loginKey(creds.UserName)
+	ip := clientIP(r)
+	if until := app.loginLockedUntil(account, ip); !until.IsZero() {
+		app.lockedOut(w, until)
+		return
+	}
 
-	// Look up the user by email
-	user, err := app.models.User.GetByEmail(creds.UserName)
+	// Look up the user by username or email
+	user, err := app.models.User.GetByLogin(creds.UserName)
 	if err != nil {
+		if errors.Is(err, data.ErrAmbiguousLogin) {
+			app.errorLog.Printf("login identifier %q matches more than one user", account)
+		}
+		if err := data.SimulatePasswordCheck(creds.Password); err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+		app.recordLoginFailure(account, ip)
+		app.audit(r, 0, auditLoginFailed, 0, account, nil)
 		app.errorJSON(w, errors.New("invalid username/password"))
 		return
 	}
 
+	// once the account is known, failures count against it whichever
+	// identifier was typed, so alternating them gains nothing
+	account = accountKey(user.ID)
+	if until := app.loginLockedUntil(account, ip); !until.IsZero() {
+		app.lockedOut(w, until)
+		return
+	}
+
 	// validate the user's password
 	validPassword, err := user.PasswordMatches(creds.Password)
+	if errors.Is(err, data.ErrHashPoolBusy) {
+		app.errorJSON(w, err)
+		return
+	}
 	if err != nil || !validPassword {
-		app.errorJSON(w, errors.New("invalid /password"))
+		app.recordLoginFailure(account, ip)
+		app.audit(r, 0, auditLoginFailed, user.ID, account, nil)
+		app.recordLoginEvent(r, user.ID, false, data.LoginReasonInvalidPassword)
+		app.errorJSON(w, errors.New("invalid username/password"))
 		return
 	}
 
+	err = app.models.LoginThrottle.Reset(data.ThrottleAccount, account)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
 	// make sure user is active
 	if user.Active == 0 {
+		app.recordLoginEvent(r, user.ID, false, data.LoginReasonInactive)
 		app.errorJSON(w, errors.New("User is not active"))
 		return
 	}
 
-	// we have a valid user, so generate a token
-	token, err := app.models.Token.GenerateToken(user.ID, 30*time.Minute)
+	if app.config.requireVerifiedEmail && user.VerifiedAt == nil {
+		app.recordLoginEvent(r, user.ID, false, data.LoginReasonEmailNotVerified)
+		app.errorJSON(w, errors.New("Email address is not verified"), http.StatusForbidden)
+		return
+	}
+
+	// users with two-factor authentication get a short-lived token that
+	// LoginTOTP exchanges, together with a code, for a real session
+	if app.needsSecondFactor(user) {
+		app.requireSecondFactor(w, user)
+		return
+	}
+
+	app.startSession(w, r, user, data.LoginReasonPassword, creds.Cookie)
+}
+
+// loginKey normalises the identifier a login was attempted with. Failures
+// for identifiers that match no account are counted per identifier, so that
+// lockouts don't reveal which accounts exist.
+func loginKey(identifier string) string {
+	return strings.ToLower(strings.TrimSpace(identifier))
+}
+
+// accountKey is the key failures of an existing account are counted under,
+// the same for every way of logging in to it.
+func accountKey(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
+// loginLockedUntil returns until when logins for the account identifier or
+// from the IP are locked, or the zero time when neither is.
+func (app *application) loginLockedUntil(account, ip string) time.Time {
+	var until time.Time
+
+	for kind, key := range map[string]string{data.ThrottleAccount: account, data.ThrottleIP: ip} {
+		lockedUntil, err := app.models.LoginThrottle.LockedUntil(kind, key)
+		if err != nil {
+			app.errorLog.Println(err)
+			continue
+		}
+
+		if lockedUntil.After(until) {
+			until = lockedUntil
+		}
+	}
+
+	return until
+}
+
+// recordLoginFailure counts a failed login against the account identifier
+// and the IP it came from.
+func (app *application) recordLoginFailure(account, ip string) {
+	until, err := app.models.LoginThrottle.RecordFailure(data.ThrottleAccount, account, app.config.accountLockout)
+	if err != nil {
+		app.errorLog.Println(err)
+	} else if !until.IsZero() {
+		app.infoLog.Printf("login for %q locked until %s", account, until.Format(time.RFC3339))
+	}
+
+	until, err = app.models.LoginThrottle.RecordFailure(data.ThrottleIP, ip, app.config.ipLockout)
+	if err != nil {
+		app.errorLog.Println(err)
+	} else if !until.IsZero() {
+		app.infoLog.Printf("logins from %s locked until %s", ip, until.Format(time.RFC3339))
+	}
+}
+
+// recordLoginEvent adds a login attempt to the user's login history.
+func (app *application) recordLoginEvent(r *http.Request, userID int, success bool, reason string) {
+	err := app.models.LoginEvent.Insert(data.LoginEvent{
+		UserID:    userID,
+		Success:   success,
+		Reason:    reason,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+	})
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+func (app *application) lockedOut(w http.ResponseWriter, until time.Time) {
+	retryAfter := int(time.Until(until).Seconds()) + 1
+
+	headers := http.Header{}
+	headers.Set("Retry-After", strconv.Itoa(retryAfter))
+
+	payload := jsonResponse{
+		Error:   true,
+		Message: "Too many failed login attempts, please try again later",
+	}
+
+	_ = app.writeJSON(w, http.StatusTooManyRequests, payload, headers)
+}
+
+func (app *application) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.models.User.GetOne(userID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	admin := app.contextGetUser(r)
+	// identifier keys may still hold failures counted before the account key
+	for _, key := range []string{accountKey(user.ID), loginKey(user.Email), loginKey(user.UserName)} {
+		err = app.models.LoginThrottle.Unlock(data.ThrottleAccount, key, admin.ID)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+	}
+	app.audit(r, admin.ID, auditUnlock, user.ID, "", nil)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "User unlocked",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *application) UnlockIP(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		IP string `json:"ip"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+
+	admin := app.contextGetUser(r)
+	err = app.models.LoginThrottle.Unlock(data.ThrottleIP, requestPayload.IP, admin.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	app.audit(r, admin.ID, auditUnlock, 0, "ip:"+requestPayload.IP, nil)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "IP address unlocked",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *application) LockoutEvents(w http.ResponseWriter, r *http.Request) {
+	events, err := app.models.LoginThrottle.GetLockoutEvents(100)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"events": events},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// startSession starts a session for the device of a fully authenticated user
+// and responds with its access and refresh tokens, or sets them as cookies
+// when cookie is true. method is recorded in the user's login history as the
+// way they logged in.
+func (app *application) startSession(w http.ResponseWriter, r *http.Request, user *data.User, method string, cookie bool) {
+	// we have a valid user, so start a session for this device
+	family, err := app.models.Token.NewFamily()
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
-	// save it to the data base
-	err = app.models.Token.Insert(*token, *user)
+	policy := data.SessionPolicyFor(user.Level)
+
+	session := data.Session{
+		ID:        family,
+		UserID:    user.ID,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+		ExpiresAt: time.Now().Add(policy.AbsoluteLifetime),
+	}
+
+	// and generate a token and its refresh token for the session
+	refreshToken, err := app.models.Token.GenerateRefreshToken(user.ID, family, app.config.refreshTokenTTL)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
+	refreshToken.CapExpiry(session.ExpiresAt)
+
+	var token *data.Token
+	stored := []data.Token{*refreshToken}
+	if app.config.jwt.mode == tokenModeJWT {
+		// signed access tokens are not stored, only the refresh token is
+		token, err = app.signAccessToken(user, family, session.ExpiresAt)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+	} else {
+		token, err = app.models.Token.GenerateToken(user.ID, policy.IdleTimeout)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+		token.Family = family
+		token.CapExpiry(session.ExpiresAt)
+
+		stored = append(stored, *token)
+	}
+
+	// save them to the data base, together with the session, so that a
+	// failed write leaves no session behind
+	err = app.models.Session.Insert(session, app.config.maxSessions, *user, stored...)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.audit(r, user.ID, auditLogin, user.ID, "session:"+family, nil)
+	app.recordLoginEvent(r, user.ID, true, method)
 
 	// send back a response
-	payload = jsonResponse{
+	payload := jsonResponse{
 		Error:   false,
 		Message: "Logged in",
-		Data:    envelope{"token": token, "user": user},
+		Data:    envelope{"token": token, "refresh_token": refreshToken, "user": user},
+	}
+
+	if cookie {
+		csrf, err := app.setSessionCookies(w, token, refreshToken, "")
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+		payload.Data = envelope{"expiry": refreshToken.Expiry, "csrf_token": csrf, "user": user}
 	}
 
 	err = app.writeJSON(w, http.StatusOK, payload)
@@ -76,9 +352,11 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
+// Refresh exchanges a refresh token for new tokens. Browser sessions send
+// theirs in the refresh cookie and get the new ones as cookies.
+func (app *application) Refresh(w http.ResponseWriter, r *http.Request) {
 	var requestPayload struct {
-		Token string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
 	err := app.readJSON(w, r, &requestPayload)
@@ -87,12 +365,109 @@ func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.models.Token.DeleteByToken(requestPayload.Token)
+	cookie := requestPayload.RefreshToken == "" && cookieValue(r, refreshCookie) != ""
+	if cookie {
+		if !validCSRF(r) {
+			app.errorJSON(w, errInvalidCSRF, http.StatusForbidden)
+			return
+		}
+		requestPayload.RefreshToken = cookieValue(r, refreshCookie)
+	}
+
+	opaqueAccess := app.config.jwt.mode != tokenModeJWT
+
+	token, refreshToken, user, err := app.models.Token.Rotate(requestPayload.RefreshToken, app.config.refreshTokenTTL, opaqueAccess)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRefreshTokenReused):
+			app.errorLog.Println("refresh token reuse detected, token family revoked")
+			app.errorJSON(w, err, http.StatusUnauthorized)
+		case errors.Is(err, data.ErrInvalidRefreshToken):
+			app.errorJSON(w, err, http.StatusUnauthorized)
+		default:
+			app.errorJSON(w, err)
+		}
+		return
+	}
+
+	if !opaqueAccess {
+		// the refresh token never outlives the session, so neither does this
+		token, err = app.signAccessToken(user, refreshToken.Family, refreshToken.Expiry)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Token refreshed",
+		Data:    envelope{"token": token, "refresh_token": refreshToken, "user": user},
+	}
+
+	if cookie {
+		// keep the CSRF token, which requests in flight still carry
+		csrf, err := app.setSessionCookies(w, token, refreshToken, cookieValue(r, csrfCookie))
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+		payload.Data = envelope{"expiry": refreshToken.Expiry, "csrf_token": csrf, "user": user}
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Token string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
 	if err != nil {
 		app.errorJSON(w, errors.New("Invalid JSON"))
 		return
 	}
 
+	// browser sessions log out with their refresh cookie, which names the
+	// session even once the access token has expired; the cookies go either way
+	if requestPayload.Token == "" && cookieValue(r, refreshCookie) != "" {
+		if !validCSRF(r) {
+			app.errorJSON(w, errInvalidCSRF, http.StatusForbidden)
+			return
+		}
+		requestPayload.Token = cookieValue(r, refreshCookie)
+	}
+	app.clearSessionCookies(w)
+
+	var userID int
+	if app.isJWT(requestPayload.Token) {
+		// a signed access token ends its session through the session id
+		claims, err := app.verifyJWT(requestPayload.Token)
+		if err == nil {
+			userID = claims.UserID
+			err = app.models.Session.Delete(claims.UserID, claims.SessionID)
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("Invalid JSON"))
+			return
+		}
+	} else {
+		if token, err := app.models.Token.GetByToken(requestPayload.Token); err == nil {
+			userID = token.UserID
+		}
+
+		err = app.models.Token.DeleteByToken(requestPayload.Token)
+		if err != nil {
+			app.errorJSON(w, errors.New("Invalid JSON"))
+			return
+		}
+	}
+
+	if userID != 0 {
+		app.audit(r, userID, auditLogout, userID, "", nil)
+	}
+
 	payload := jsonResponse{
 		Error:   false,
 		Message: "Logged out",
@@ -113,7 +488,12 @@ func (app *application) ValidateToken(w http.ResponseWriter, r *http.Request) {
 	}
 
 	valid := false
-	valid, _ = app.models.Token.ValidToken(requestPayload.Token)
+	if app.isJWT(requestPayload.Token) {
+		_, err = app.verifyJWT(requestPayload.Token)
+		valid = err == nil
+	} else {
+		valid, _ = app.models.Token.ValidToken(requestPayload.Token)
+	}
 
 	payload := jsonResponse{
 		Error: false,
@@ -136,6 +516,14 @@ func (app *application) LogUserOutAndSetInactive(w http.ResponseWriter, r *http.
 		return
 	}
 
+	actor := app.contextGetUser(r)
+	err = app.checkUserChange(actor, user, user.Level, 0)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+	before := auditUser(user)
+
 	user.Active = 0
 	err = user.Update()
 	if err != nil {
@@ -149,6 +537,7 @@ func (app *application) LogUserOutAndSetInactive(w http.ResponseWriter, r *http.
 		app.errorJSON(w, err)
 		return
 	}
+	app.audit(r, actor.ID, auditUserForceLogout, userID, "", auditDiff(before, auditUser(user)))
 
 	payload := jsonResponse{
 		Error:   false,
@@ -157,3 +546,111 @@ func (app *application) LogUserOutAndSetInactive(w http.ResponseWriter, r *http.
 
 	_ = app.writeJSON(w, http.StatusAccepted, payload)
 }
+
+// LoginHistory returns the recent login attempts of a user.
+func (app *application) LoginHistory(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.writeLoginHistory(w, userID)
+}
+
+// MyLoginHistory returns the recent login attempts of the calling user.
+func (app *application) MyLoginHistory(w http.ResponseWriter, r *http.Request) {
+	app.writeLoginHistory(w, app.contextGetUser(r).ID)
+}
+
+func (app *application) writeLoginHistory(w http.ResponseWriter, userID int) {
+	events, err := app.models.LoginEvent.GetAllForUser(userID, 100)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"logins": events},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *application) MySessions(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	sessions, err := app.models.Session.GetAllForUser(user.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"sessions": sessions, "current": app.contextGetSessionID(r)},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *application) RevokeMySession(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	app.revokeSession(w, r, user.ID, chi.URLParam(r, "sessionID"))
+}
+
+func (app *application) UserSessions(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	sessions, err := app.models.Session.GetAllForUser(userID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"sessions": sessions},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *application) RevokeUserSession(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.revokeSession(w, r, userID, chi.URLParam(r, "sessionID"))
+}
+
+func (app *application) revokeSession(w http.ResponseWriter, r *http.Request, userID int, sessionID string) {
+	err := app.models.Session.Delete(userID, sessionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("session not found"), http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+	app.audit(r, app.contextGetUser(r).ID, auditSessionRevoke, userID, "session:"+sessionID, nil)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Session revoked",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
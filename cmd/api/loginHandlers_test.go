@@ -0,0 +1,107 @@
+package main
+
+import (
+	"dss-api/internal/data"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// TestLoginLockoutPerAccount checks that a locked account stays locked
+// whether it is logged in to by username or by email.
+func TestLoginLockoutPerAccount(t *testing.T) {
+	user := data.User{ID: 7, UserName: "Jane", Email: "jane@example.com", Password: "x", Active: 1, Level: data.LevelUser}
+
+	for _, identifier := range []string{"jane", "JANE@example.com"} {
+		t.Run(identifier, func(t *testing.T) {
+			app, mock := newTestApp(t)
+			mock.MatchExpectationsInOrder(false)
+
+			none := sqlmock.NewRows([]string{"locked_until"})
+			mock.ExpectQuery(`from login_throttles`).WithArgs(data.ThrottleAccount, loginKey(identifier)).WillReturnRows(none)
+			mock.ExpectQuery(`from login_throttles`).WithArgs(data.ThrottleIP, sqlmock.AnyArg()).WillReturnRows(none)
+			mock.ExpectQuery(`from login_throttles`).WithArgs(data.ThrottleIP, sqlmock.AnyArg()).WillReturnRows(none)
+			mock.ExpectQuery(`from users where email = \$1 or lower\(username\) = \$1`).WillReturnRows(userRows(user))
+			mock.ExpectQuery(`from login_throttles`).WithArgs(data.ThrottleAccount, "user:7").
+				WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(time.Now().Add(time.Minute)))
+
+			rec, _ := do(t, app, http.MethodPost, "/users/login", map[string]string{"username": identifier, "password": "guess"}, nil)
+			if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+				t.Fatalf("status = %d, Retry-After = %q", rec.Code, rec.Header().Get("Retry-After"))
+			}
+
+			err := mock.ExpectationsWereMet()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestLoginLockoutUnknownIdentifier(t *testing.T) {
+	app, mock := newTestApp(t)
+	mock.MatchExpectationsInOrder(false)
+
+	none := sqlmock.NewRows([]string{"locked_until"})
+	mock.ExpectQuery(`from login_throttles`).WithArgs(data.ThrottleIP, sqlmock.AnyArg()).WillReturnRows(none)
+	mock.ExpectQuery(`from login_throttles`).WithArgs(data.ThrottleAccount, "nobody").
+		WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(time.Now().Add(time.Minute)))
+
+	rec, _ := do(t, app, http.MethodPost, "/users/login", map[string]string{"username": " Nobody ", "password": "guess"}, nil)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d", rec.Code)
+	}
+}
+
+// expectRecordFailure expects a failed login to be counted against the
+// throttle key, staying below the lockout threshold.
+func expectRecordFailure(mock sqlmock.Sqlmock, kind string, key any) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`insert into login_throttles`).WithArgs(kind, key, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failures", "lockouts"}).AddRow(1, 0))
+	mock.ExpectCommit()
+}
+
+// expectLoginEvent expects a login attempt of the user to be recorded.
+func expectLoginEvent(mock sqlmock.Sqlmock, userID int, success bool, reason string) {
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into login_events`).
+		WithArgs(userID, success, reason, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if success {
+		mock.ExpectExec(`update users set last_login_at`).WillReturnResult(sqlmock.NewResult(0, 1))
+	} else {
+		mock.ExpectExec(`update users set failed_logins = failed_logins \+ 1 where id = \$1`).WithArgs(userID).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+}
+
+func TestLoginFailureRecordsLoginEvent(t *testing.T) {
+	app, mock := newTestApp(t)
+	// the throttles are looked up in no particular order
+	mock.MatchExpectationsInOrder(false)
+
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", Password: passwordHash(t, "password"),
+		Active: 1, Level: data.LevelUser}
+
+	expectThrottleLookups(mock, "jane")
+	mock.ExpectQuery(`from users where email = \$1 or lower\(username\) = \$1`).WillReturnRows(userRows(user))
+	expectThrottleLookups(mock, "user:7")
+	expectRecordFailure(mock, data.ThrottleAccount, "user:7")
+	expectRecordFailure(mock, data.ThrottleIP, sqlmock.AnyArg())
+	expectAudit(mock, auditLoginFailed)
+	expectLoginEvent(mock, 7, false, data.LoginReasonInvalidPassword)
+
+	rec, payload := do(t, app, http.MethodPost, "/users/login", map[string]string{"username": "jane", "password": "guess"}, nil)
+	if !payload.Error || payload.Message != "invalid username/password" {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+
+	err := mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
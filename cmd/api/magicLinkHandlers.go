@@ -0,0 +1,168 @@
+package main
+
+import (
+	"dss-api/internal/data"
+	"dss-api/internal/mailer"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// magicCookie holds the nonce a magic link is bound to. Only the login route
+// gets to see it.
+const (
+	magicCookie     = "dss_magic"
+	magicCookiePath = "/users/login"
+)
+
+var errInvalidMagicLink = errors.New("invalid or expired login link")
+
+// magicLinkAllowed reports whether users of level may log in by email link.
+func (app *application) magicLinkAllowed(level int) bool {
+	return app.config.magicLinkLevels[level]
+}
+
+// MagicLink emails a single-use login link, bound to the browser asking for
+// it: the link only works together with a nonce put in a cookie and returned
+// here. As with password resets, the response is the same whether or not the
+// address belongs to a user who may log in this way.
+func (app *application) MagicLink(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+
+	binding, err := randomToken()
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	ttl := app.config.magicLinkTTL
+	http.SetCookie(w, app.cookie(magicCookie, binding, magicCookiePath, time.Now().Add(ttl), true))
+
+	app.background(func() {
+		user, err := app.models.User.GetByEmail(requestPayload.Email)
+		if err != nil || user.Active == 0 || !app.magicLinkAllowed(user.Level) {
+			return
+		}
+
+		token, err := app.models.Token.GenerateMagicLinkToken(user.ID, binding, ttl)
+		if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+
+		err = app.models.Token.Insert(*token, *user)
+		if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+
+		link := fmt.Sprintf("%s/magic-link?token=%s", app.config.frontendURL, url.QueryEscape(token.Token))
+
+		err = app.mailer.Send(mailer.Message{
+			To:      user.Email,
+			Subject: "Your login link",
+			Body: fmt.Sprintf("Hello %s,\n\nFollow this link within %s to log in:\n\n%s\n\n"+
+				"The link can only be used once, in the browser you asked for it from. "+
+				"If you did not ask for it, you can ignore this email.\n",
+				user.FirstName, ttl, link),
+		})
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "If the address belongs to an account that may log in by email, a login link has been sent to it",
+		Data:    envelope{"binding": binding},
+	}
+
+	_ = app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// loginWithMagicLink exchanges a magic link token for a session, like a
+// password would be. The browser proves it asked for the link with the
+// nonce from the magic link cookie, or else from binding. A link used from
+// another browser is not spent.
+func (app *application) loginWithMagicLink(w http.ResponseWriter, r *http.Request, plainText, binding string, cookie bool) {
+	if value := cookieValue(r, magicCookie); value != "" {
+		binding = value
+	}
+
+	token, err := app.models.Token.GetByToken(plainText)
+	if err != nil || token.Scope != data.ScopeMagicLink || token.Expiry.Before(time.Now()) {
+		app.errorJSON(w, errInvalidMagicLink, http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.models.Token.GetUserForToken(*token)
+	if err != nil {
+		app.errorJSON(w, errInvalidMagicLink, http.StatusUnauthorized)
+		return
+	}
+
+	account := accountKey(user.ID)
+	ip := clientIP(r)
+	if until := app.loginLockedUntil(account, ip); !until.IsZero() {
+		app.lockedOut(w, until)
+		return
+	}
+
+	if !token.BoundTo(binding) {
+		app.recordLoginFailure(account, ip)
+		app.audit(r, 0, auditLoginFailed, user.ID, "magic_link", nil)
+		app.recordLoginEvent(r, user.ID, false, data.LoginReasonInvalidMagicLink)
+		app.errorJSON(w, errInvalidMagicLink, http.StatusUnauthorized)
+		return
+	}
+
+	_, user, err = app.models.Token.Consume(plainText, data.ScopeMagicLink)
+	if err != nil {
+		app.errorJSON(w, errInvalidMagicLink, http.StatusUnauthorized)
+		return
+	}
+
+	expired := app.cookie(magicCookie, "", magicCookiePath, time.Unix(0, 0), true)
+	expired.MaxAge = -1
+	http.SetCookie(w, expired)
+
+	// the level may have changed since the link was sent
+	if !app.magicLinkAllowed(user.Level) {
+		app.errorJSON(w, errors.New("login links are not available for your account"), http.StatusForbidden)
+		return
+	}
+
+	if user.Active == 0 {
+		app.recordLoginEvent(r, user.ID, false, data.LoginReasonInactive)
+		app.errorJSON(w, errors.New("User is not active"))
+		return
+	}
+
+	// the link reached the user's inbox, which confirms the address
+	if user.VerifiedAt == nil {
+		err = user.VerifyEmail(user.Email)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+		now := time.Now()
+		user.VerifiedAt = &now
+	}
+
+	if app.needsSecondFactor(user) {
+		app.requireSecondFactor(w, user)
+		return
+	}
+
+	app.startSession(w, r, user, data.LoginReasonMagicLink, cookie)
+}
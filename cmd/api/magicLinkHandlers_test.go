@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"dss-api/internal/data"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// magicLinkToken returns a login link of user bound to binding.
+func magicLinkToken(user data.User, binding string) data.Token {
+	hash := sha256.Sum256([]byte(binding))
+
+	return data.Token{ID: 4, UserID: user.ID, UserName: user.UserName, Email: user.Email, Scope: data.ScopeMagicLink,
+		CreatedAt: time.Now(), UpdatedAt: time.Now(), Expiry: time.Now().Add(time.Minute), BindingHash: hash[:]}
+}
+
+func TestMagicLinkRefusesMissingBinding(t *testing.T) {
+	app, mock := newTestApp(t)
+	app.config.magicLinkLevels = map[int]bool{data.LevelUser: true}
+	// the throttles are looked up in no particular order
+	mock.MatchExpectationsInOrder(false)
+
+	now := time.Now()
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", Active: 1, Level: data.LevelUser, VerifiedAt: &now}
+
+	expectGetToken(mock, magicLinkToken(user, "nonce"))
+	mock.ExpectQuery(`from users where id = \$1`).WithArgs(user.ID).WillReturnRows(userRows(user))
+	expectThrottleLookups(mock, "user:7")
+	expectRecordFailure(mock, data.ThrottleAccount, "user:7")
+	expectRecordFailure(mock, data.ThrottleIP, sqlmock.AnyArg())
+	expectAudit(mock, auditLoginFailed)
+	expectLoginEvent(mock, user.ID, false, data.LoginReasonInvalidMagicLink)
+
+	// a link opened in another browser comes without the nonce
+	rr, payload := do(t, app, http.MethodPost, "/users/login", map[string]string{"magic_token": "link"}, nil)
+	if rr.Code != http.StatusUnauthorized || payload.Message != errInvalidMagicLink.Error() {
+		t.Fatalf("got %d %q", rr.Code, payload.Message)
+	}
+
+	// the link is not spent, so the browser that asked for it can still use it
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMagicLinkWorksOnce(t *testing.T) {
+	app, mock := newTestApp(t)
+	app.config.magicLinkLevels = map[int]bool{data.LevelUser: true}
+	mock.MatchExpectationsInOrder(false)
+
+	now := time.Now()
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", Active: 1, Level: data.LevelUser, VerifiedAt: &now}
+	body := map[string]string{"magic_token": "link", "binding": "nonce"}
+
+	expectGetToken(mock, magicLinkToken(user, "nonce"))
+	mock.ExpectQuery(`from users where id = \$1`).WithArgs(user.ID).WillReturnRows(userRows(user))
+	expectThrottleLookups(mock, "user:7")
+	expectConsumeToken(mock, data.ScopeMagicLink, user)
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into sessions`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into tokens`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into tokens`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	expectAudit(mock, auditLogin)
+	expectLoginEvent(mock, user.ID, true, data.LoginReasonMagicLink)
+
+	rr, payload := do(t, app, http.MethodPost, "/users/login", body, nil)
+	if rr.Code != http.StatusOK || payload.Message != "Logged in" {
+		t.Fatalf("got %d %q", rr.Code, payload.Message)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// and the nonce is of no further use either
+	cleared := false
+	for _, c := range rr.Result().Cookies() {
+		cleared = cleared || c.Name == magicCookie && c.MaxAge < 0
+	}
+	if !cleared {
+		t.Errorf("%s is not cleared: %q", magicCookie, rr.Header().Values("Set-Cookie"))
+	}
+
+	// the token is gone once it has been used
+	mock.ExpectQuery(`select id, user_id, username, email, token_hash, .* from tokens where token_hash = \$1`).
+		WillReturnError(sql.ErrNoRows)
+
+	rr, payload = do(t, app, http.MethodPost, "/users/login", body, nil)
+	if rr.Code != http.StatusUnauthorized || payload.Message != errInvalidMagicLink.Error() {
+		t.Fatalf("got %d %q", rr.Code, payload.Message)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestMagicLinkRefusesConcurrentUse covers a link spent by another request
+// between looking it up and consuming it.
+func TestMagicLinkRefusesConcurrentUse(t *testing.T) {
+	app, mock := newTestApp(t)
+	app.config.magicLinkLevels = map[int]bool{data.LevelUser: true}
+	mock.MatchExpectationsInOrder(false)
+
+	now := time.Now()
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", Active: 1, Level: data.LevelUser, VerifiedAt: &now}
+
+	expectGetToken(mock, magicLinkToken(user, "nonce"))
+	mock.ExpectQuery(`from users where id = \$1`).WithArgs(user.ID).WillReturnRows(userRows(user))
+	expectThrottleLookups(mock, "user:7")
+	mock.ExpectQuery(`delete from tokens where token_hash = \$1 and scope = \$2 returning`).
+		WithArgs(sqlmock.AnyArg(), data.ScopeMagicLink).WillReturnError(sql.ErrNoRows)
+
+	rr, payload := do(t, app, http.MethodPost, "/users/login", map[string]string{"magic_token": "link", "binding": "nonce"}, nil)
+	if rr.Code != http.StatusUnauthorized || payload.Message != errInvalidMagicLink.Error() {
+		t.Fatalf("got %d %q", rr.Code, payload.Message)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -3,15 +3,85 @@ package main
 import (
 	"dss-api/internal/data"
 	"dss-api/internal/driver"
+	"dss-api/internal/jwt"
+	"dss-api/internal/mailer"
+	"dss-api/internal/webauthn"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // config is the type for all aplication configuration
 type config struct {
-	port int
+	port            int
+	refreshTokenTTL time.Duration
+	maxSessions     int
+	sessionPolicy   data.SessionPolicy
+	levelPolicies   map[int]data.SessionPolicy
+	frontendURL     string
+	resetTokenTTL   time.Duration
+	verifyTokenTTL  time.Duration
+	inviteTokenTTL  time.Duration
+	// requireVerifiedEmail refuses logins until the email is confirmed
+	requireVerifiedEmail bool
+	mfaTokenTTL          time.Duration
+	totpIssuer           string
+	// totpLevels are the user levels that have to use two-factor
+	// authentication, and enrol at their next login if they haven't
+	totpLevels       map[int]bool
+	accountLockout   data.LockoutPolicy
+	ipLockout        data.LockoutPolicy
+	passwordPolicy   data.PasswordPolicy
+	passwordHasher   data.PasswordHasher
+	hashWorkers      int
+	hashQueueTimeout time.Duration
+	tokenCacheSize   int
+	tokenCacheTTL    time.Duration
+	impersonationTTL time.Duration
+	magicLinkTTL     time.Duration
+	// magicLinkLevels are the user levels that may log in by email link
+	magicLinkLevels map[int]bool
+	// passkeyLevels are the user levels that may register and log in with
+	// passkeys
+	passkeyLevels map[int]bool
+	webauthn      webauthn.Config
+	// breachedPasswords is a file of SHA-1 hashes of breached passwords
+	breachedPasswords string
+	jwt               struct {
+		mode        string
+		alg         string
+		keysDir     string
+		ttl         time.Duration
+		rotateEvery time.Duration
+	}
+	// registration lets people sign up, for admins to approve; domains
+	// limits it to addresses of those email domains when not empty
+	registration struct {
+		enabled bool
+		domains []string
+	}
+	// corsOrigins are the origins browsers may call the API from with
+	// credentials, which cookie sessions need
+	corsOrigins []string
+	// cookies configures the cookies of browser sessions
+	cookies struct {
+		secure   bool
+		sameSite http.SameSite
+		domain   string
+	}
+	smtp struct {
+		host     string
+		port     int
+		username string
+		password string
+		from     string
+	}
 }
 
 // application is the type for all data
@@ -22,12 +92,154 @@ type application struct {
 	// db       *driver.DB
 	models      data.Models
 	environment string
+	mailer      mailer.Mailer
+	keys        *jwt.KeySet
+	webauthn    *webauthn.RelyingParty
+	denylist    denylist
 }
 
 // main is the main entry point of our application
 func main() {
 	var cfg config
 	cfg.port = 8081
+	cfg.refreshTokenTTL = 7 * 24 * time.Hour
+	cfg.maxSessions = envInt("MAX_SESSIONS", 5)
+	cfg.sessionPolicy = data.SessionPolicy{
+		IdleTimeout:      envDuration("SESSION_IDLE_TIMEOUT", 30*time.Minute),
+		AbsoluteLifetime: envDuration("SESSION_MAX_LIFETIME", 12*time.Hour),
+	}
+
+	// per level overrides, e.g. SESSION_POLICIES="1=15m/8h,2=30m/24h"
+	levelPolicies, err := parseSessionPolicies(os.Getenv("SESSION_POLICIES"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.levelPolicies = levelPolicies
+	data.SetSessionPolicies(cfg.sessionPolicy, cfg.levelPolicies)
+
+	// new hashes use the configured hasher; older ones are upgraded at login
+	switch envString("PASSWORD_HASHER", "argon2id") {
+	case "argon2id":
+		argon := data.DefaultArgon2id
+		argon.Memory = uint32(envInt("ARGON2_MEMORY", int(argon.Memory)))
+		argon.Iterations = uint32(envInt("ARGON2_ITERATIONS", int(argon.Iterations)))
+		argon.Parallelism = uint8(envInt("ARGON2_PARALLELISM", int(argon.Parallelism)))
+		cfg.passwordHasher = argon
+	case "bcrypt":
+		cfg.passwordHasher = data.BcryptHasher{Cost: envInt("BCRYPT_COST", 12)}
+	default:
+		log.Fatal("PASSWORD_HASHER must be argon2id or bcrypt")
+	}
+	data.SetPasswordHasher(cfg.passwordHasher)
+
+	// at most hashWorkers hashes run at once; the rest queue, then get a 503
+	cfg.hashWorkers = envInt("HASH_WORKERS", runtime.NumCPU())
+	cfg.hashQueueTimeout = envDuration("HASH_QUEUE_TIMEOUT", 2*time.Second)
+	data.SetHashPool(cfg.hashWorkers, cfg.hashQueueTimeout)
+
+	cfg.passwordPolicy = data.PasswordPolicy{
+		MinLength:        envInt("PASSWORD_MIN_LENGTH", 10),
+		MaxLength:        envInt("PASSWORD_MAX_LENGTH", 72),
+		MinClasses:       envInt("PASSWORD_MIN_CLASSES", 2),
+		DisallowIdentity: os.Getenv("PASSWORD_ALLOW_IDENTITY") != "true",
+	}
+	cfg.breachedPasswords = os.Getenv("BREACHED_PASSWORDS_FILE")
+
+	var breached *data.BreachedList
+	if cfg.breachedPasswords != "" {
+		breached, err = data.OpenBreachedList(cfg.breachedPasswords)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer breached.Close()
+	}
+	data.SetPasswordPolicy(cfg.passwordPolicy, breached)
+
+	// links in emails point at the front end; mail goes to MailHog by default
+	cfg.frontendURL = envString("FRONTEND_URL", "http://localhost:8080")
+	cfg.resetTokenTTL = envDuration("RESET_TOKEN_TTL", time.Hour)
+	cfg.verifyTokenTTL = envDuration("VERIFY_TOKEN_TTL", 24*time.Hour)
+	cfg.inviteTokenTTL = envDuration("INVITE_TOKEN_TTL", 72*time.Hour)
+	cfg.registration.enabled = os.Getenv("REGISTRATION_ENABLED") == "true"
+	cfg.registration.domains = parseDomains(os.Getenv("REGISTRATION_DOMAINS"))
+
+	// login links by email are off unless MAGIC_LINK_LEVELS lists levels, e.g. "1,5"
+	cfg.magicLinkTTL = envDuration("MAGIC_LINK_TTL", 10*time.Minute)
+	cfg.magicLinkLevels, err = parseLevels(os.Getenv("MAGIC_LINK_LEVELS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// passkeys are for admins unless PASSKEY_LEVELS says otherwise; the
+	// relying party id has to be the front end's domain or a parent of it
+	cfg.passkeyLevels, err = parseLevels(envString("PASSKEY_LEVELS", strconv.Itoa(data.LevelAdmin)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.webauthn = webauthn.Config{
+		RPID:             envString("WEBAUTHN_RP_ID", "localhost"),
+		RPName:           envString("WEBAUTHN_RP_NAME", "DSS"),
+		Origins:          envList("WEBAUTHN_ORIGINS"),
+		UserVerification: envString("WEBAUTHN_USER_VERIFICATION", webauthn.VerificationPreferred),
+		Timeout:          envDuration("WEBAUTHN_TIMEOUT", 5*time.Minute),
+	}
+	if len(cfg.webauthn.Origins) == 0 {
+		cfg.webauthn.Origins = []string{strings.TrimSuffix(cfg.frontendURL, "/")}
+	}
+
+	cfg.requireVerifiedEmail = os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true"
+	cfg.mfaTokenTTL = 5 * time.Minute
+	cfg.totpIssuer = envString("TOTP_ISSUER", "DSS")
+	cfg.totpLevels, err = parseLevels(envString("TOTP_REQUIRED_LEVELS", strconv.Itoa(data.LevelAdmin)))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// TOTP secrets are stored encrypted with a 32 byte key, base64 encoded
+	totpKey, err := base64.StdEncoding.DecodeString(os.Getenv("TOTP_ENCRYPTION_KEY"))
+	if err == nil {
+		err = data.SetTOTPKey(totpKey)
+	}
+	if err != nil {
+		log.Fatal("TOTP_ENCRYPTION_KEY must be 32 base64 encoded bytes")
+	}
+	cfg.accountLockout = data.LockoutPolicy{
+		Threshold:   envInt("LOCKOUT_ACCOUNT_THRESHOLD", 5),
+		Window:      15 * time.Minute,
+		BaseLockout: envDuration("LOCKOUT_BASE", time.Minute),
+		MaxLockout:  envDuration("LOCKOUT_MAX", time.Hour),
+	}
+	cfg.ipLockout = cfg.accountLockout
+	cfg.ipLockout.Threshold = envInt("LOCKOUT_IP_THRESHOLD", 20)
+
+	// access tokens are opaque unless TOKEN_MODE=jwt
+	cfg.jwt.mode = envString("TOKEN_MODE", tokenModeOpaque)
+	cfg.jwt.alg = envString("JWT_ALG", jwt.EdDSA)
+	cfg.jwt.keysDir = os.Getenv("JWT_KEYS_DIR")
+	cfg.jwt.ttl = envDuration("JWT_TTL", 5*time.Minute)
+	cfg.jwt.rotateEvery = envDuration("JWT_ROTATE_EVERY", 24*time.Hour)
+	data.RevocationRetention = cfg.jwt.ttl + time.Minute
+
+	// opaque token lookups are cached; TOKEN_CACHE_SIZE=0 turns that off
+	cfg.tokenCacheSize = envInt("TOKEN_CACHE_SIZE", 10000)
+	cfg.tokenCacheTTL = envDuration("TOKEN_CACHE_TTL", 30*time.Second)
+	data.SetTokenCache(cfg.tokenCacheSize, cfg.tokenCacheTTL)
+	cfg.impersonationTTL = envDuration("IMPERSONATION_TTL", 15*time.Minute)
+
+	// browser sessions keep their tokens in cookies; plain http needs COOKIE_SECURE=false
+	cfg.cookies.secure = os.Getenv("COOKIE_SECURE") != "false"
+	cfg.cookies.sameSite = parseSameSite(envString("COOKIE_SAMESITE", "strict"))
+	cfg.cookies.domain = os.Getenv("COOKIE_DOMAIN")
+	cfg.corsOrigins = envList("CORS_ORIGINS")
+	if len(cfg.corsOrigins) == 0 {
+		cfg.corsOrigins = []string{strings.TrimSuffix(cfg.frontendURL, "/")}
+	}
+
+	cfg.smtp.host = envString("SMTP_HOST", "localhost")
+	cfg.smtp.port = envInt("SMTP_PORT", 1025)
+	cfg.smtp.username = os.Getenv("SMTP_USERNAME")
+	cfg.smtp.password = os.Getenv("SMTP_PASSWORD")
+	cfg.smtp.from = envString("SMTP_FROM", "DSS <no-reply@dss-api.local>")
 
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
@@ -48,6 +260,46 @@ func main() {
 		// db:       db,
 		models:      data.New(db.SQL),
 		environment: environment,
+		mailer: mailer.Mailer{
+			Host:     cfg.smtp.host,
+			Port:     cfg.smtp.port,
+			Username: cfg.smtp.username,
+			Password: cfg.smtp.password,
+			From:     cfg.smtp.from,
+		},
+		webauthn: webauthn.New(cfg.webauthn),
+	}
+
+	// secrets stored before they were encrypted are encrypted now
+	encrypted, err := app.models.User.EncryptTOTPSecrets()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if encrypted > 0 {
+		infoLog.Println("encrypted", encrypted, "TOTP secrets")
+	}
+
+	if cfg.jwt.mode == tokenModeJWT {
+		// instances starting together make one first key between them
+		err = data.WithSigningKeyLock(func() error {
+			var err error
+			app.keys, err = jwt.NewKeySet(cfg.jwt.alg, "dss-api", cfg.jwt.keysDir, cfg.jwt.rotateEvery)
+			return err
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// revocations made here apply at once, those of other instances
+		// with the next sync
+		data.SetRevocationHook(app.denylist.add)
+
+		go app.rotateSigningKeys(cfg.jwt.rotateEvery)
+		go app.syncDenylist(10 * time.Second)
+	}
+
+	if cfg.tokenCacheSize > 0 {
+		go app.listenTokenInvalidations()
 	}
 
 	err = app.serve()
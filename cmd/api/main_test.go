@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"dss-api/internal/data"
+	"dss-api/internal/jwt"
+	"dss-api/internal/webauthn"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestApp returns an application backed by a mock database. Queries are
+// matched as regular expressions against the statements the models run.
+func newTestApp(t *testing.T) (*application, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	var cfg config
+	cfg.frontendURL = "http://localhost:8080"
+	cfg.corsOrigins = []string{cfg.frontendURL}
+	cfg.refreshTokenTTL = time.Hour
+	cfg.resetTokenTTL = time.Hour
+	cfg.verifyTokenTTL = time.Hour
+	cfg.inviteTokenTTL = time.Hour
+	cfg.mfaTokenTTL = 5 * time.Minute
+	cfg.impersonationTTL = 15 * time.Minute
+	cfg.magicLinkTTL = 10 * time.Minute
+	cfg.magicLinkLevels = map[int]bool{}
+	cfg.passkeyLevels = map[int]bool{data.LevelAdmin: true}
+	cfg.totpLevels = map[int]bool{}
+	cfg.jwt.mode = tokenModeOpaque
+	cfg.accountLockout = data.LockoutPolicy{Threshold: 5, Window: 15 * time.Minute, BaseLockout: time.Minute, MaxLockout: time.Hour}
+	cfg.ipLockout = cfg.accountLockout
+	cfg.ipLockout.Threshold = 20
+	cfg.webauthn = webauthn.Config{RPID: "localhost", RPName: "DSS", Origins: []string{cfg.frontendURL}}
+
+	err = data.SetTOTPKey(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		config:      cfg,
+		infoLog:     log.New(io.Discard, "", 0),
+		errorLog:    log.New(io.Discard, "", 0),
+		models:      data.New(db),
+		environment: "test",
+		webauthn:    webauthn.New(cfg.webauthn),
+	}
+
+	return app, mock
+}
+
+// signIn switches app to signed access tokens and returns one for the user,
+// so that requests authenticate without a database lookup.
+func signIn(t *testing.T, app *application, userID, level int) http.Header {
+	t.Helper()
+
+	if app.keys == nil {
+		keys, err := jwt.NewKeySet(jwt.EdDSA, "dss-api", "", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.keys = keys
+		app.config.jwt.mode = tokenModeJWT
+	}
+
+	now := time.Now()
+	token, err := app.keys.Sign(jwt.Claims{
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(5 * time.Minute).Unix(),
+		UserID:    userID,
+		Level:     level,
+		SessionID: "s-" + strconv.Itoa(userID),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+// userColumnNames are the columns of data.User rows, in scan order.
+var userColumnNames = []string{"id", "username", "email", "first_name", "last_name", "password", "active", "level",
+	"created_at", "updated_at", "verified_at", "pending_email", "totp_secret", "totp_enabled_at", "last_login_at",
+	"last_login_ip", "failed_logins"}
+
+// userRows returns users as rows of a users query.
+func userRows(users ...data.User) *sqlmock.Rows {
+	rows := sqlmock.NewRows(userColumnNames)
+	for _, u := range users {
+		rows.AddRow(u.ID, u.UserName, u.Email, u.FirstName, u.LastName, u.Password, u.Active, u.Level,
+			u.CreatedAt, u.UpdatedAt, u.VerifiedAt, u.PendingEmail, u.TOTPSecret, u.TOTPEnabledAt, u.LastLoginAt,
+			u.LastLoginIP, u.FailedLogins)
+	}
+
+	return rows
+}
+
+// expectGetToken expects a one-off token to be looked up, without being
+// spent. token.TokenHash is left as it is.
+func expectGetToken(mock sqlmock.Sqlmock, token data.Token) {
+	rows := sqlmock.NewRows([]string{"id", "user_id", "username", "email", "token_hash", "scope", "family", "used_at",
+		"created_at", "updated_at", "expiry", "impersonator_id", "binding_hash"}).
+		AddRow(token.ID, token.UserID, token.UserName, token.Email, token.TokenHash, token.Scope, token.Family, token.UsedAt,
+			token.CreatedAt, token.UpdatedAt, token.Expiry, token.ImpersonatorID, token.BindingHash)
+
+	mock.ExpectQuery(`select id, user_id, username, email, token_hash, .* from tokens where token_hash = \$1`).WillReturnRows(rows)
+}
+
+// expectConsumeToken expects a one-off token of user to be spent, followed by
+// the lookup of the user.
+func expectConsumeToken(mock sqlmock.Sqlmock, scope string, user data.User) {
+	mock.ExpectQuery(`delete from tokens where token_hash = \$1 and scope = \$2 returning`).
+		WithArgs(sqlmock.AnyArg(), scope).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "email", "expiry"}).AddRow(user.ID, user.Email, time.Now().Add(time.Minute)))
+	mock.ExpectQuery(`from users where id = \$1`).WithArgs(user.ID).WillReturnRows(userRows(user))
+}
+
+// passwordHash returns a hash of password made with a cheap bcrypt cost,
+// which is also the configured hasher for the rest of the test, so that the
+// hash isn't replaced at login.
+func passwordHash(t *testing.T, password string) string {
+	t.Helper()
+
+	hasher := data.BcryptHasher{Cost: bcrypt.MinCost}
+	data.SetPasswordHasher(hasher)
+	t.Cleanup(func() {
+		data.SetPasswordHasher(data.DefaultArgon2id)
+	})
+
+	hash, err := hasher.Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hash
+}
+
+// expectAudit expects an audit entry for action to be appended.
+func expectAudit(mock sqlmock.Sqlmock, action string) {
+	arg := sqlmock.AnyArg()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`select pg_advisory_xact_lock`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`select hash from audit_log`).WillReturnRows(sqlmock.NewRows([]string{"hash"}))
+	mock.ExpectExec(`insert into audit_log`).WithArgs(arg, arg, action, arg, arg, arg, arg, arg, arg, arg, arg, arg).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+// capture is a sqlmock argument that matches anything and keeps the value.
+type capture struct {
+	value driver.Value
+}
+
+func (c *capture) Match(v driver.Value) bool {
+	c.value = v
+	return true
+}
+
+// do sends a JSON request through the application's routes.
+func do(t *testing.T, app *application, method, path string, body any, header http.Header) (*httptest.ResponseRecorder, jsonResponse) {
+	t.Helper()
+
+	var reader io.Reader = http.NoBody
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, req)
+
+	var payload jsonResponse
+	if strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		err := json.Unmarshal(rec.Body.Bytes(), &payload)
+		if err != nil {
+			t.Fatalf("%s %s: %v in %s", method, path, err, rec.Body)
+		}
+	}
+
+	return rec, payload
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"dss-api/internal/data"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func (app *application) GetMe(w http.ResponseWriter, r *http.Request) {
+	user, err := app.models.User.GetOne(app.contextGetUser(r).ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"user": user, "role": user.Role(), "session_id": app.contextGetSessionID(r)},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// UpdateMe lets users edit their own profile. Only profile fields can be
+// changed here; username, email, level and active state stay with admins.
+func (app *application) UpdateMe(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+
+	user, err := app.models.User.GetOne(app.contextGetUser(r).ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	before := auditUser(user)
+	user.FirstName = strings.TrimSpace(requestPayload.FirstName)
+	user.LastName = strings.TrimSpace(requestPayload.LastName)
+	user.UpdatedAt = time.Now()
+
+	err = user.Update()
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	app.audit(r, user.ID, auditUserUpdate, user.ID, "", auditDiff(before, auditUser(user)))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Changes saved.",
+		Data:    envelope{"user": user},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// ChangeMyPassword changes the password of the calling user after checking
+// the current one, ends every other session of the user and revokes their
+// API keys.
+func (app *application) ChangeMyPassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+
+	user, err := app.models.User.GetOne(app.contextGetUser(r).ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// guesses of the current password count as failed logins
+	account := accountKey(user.ID)
+	ip := clientIP(r)
+	if until := app.loginLockedUntil(account, ip); !until.IsZero() {
+		app.lockedOut(w, until)
+		return
+	}
+
+	valid, err := user.PasswordMatches(requestPayload.CurrentPassword)
+	if errors.Is(err, data.ErrHashPoolBusy) {
+		app.errorJSON(w, err)
+		return
+	}
+	if err != nil || !valid {
+		app.recordLoginFailure(account, ip)
+		app.audit(r, user.ID, auditLoginFailed, user.ID, "password.change", nil)
+		app.errorJSON(w, errors.New("current password is incorrect"), http.StatusForbidden)
+		return
+	}
+
+	if requestPayload.NewPassword == "" {
+		app.errorJSON(w, errors.New("new password is required"))
+		return
+	}
+
+	err = user.ResetPassword(requestPayload.NewPassword)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.models.Session.DeleteOthers(user.ID, app.contextGetSessionID(r))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.models.APIKey.DeleteAll(user.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	app.audit(r, user.ID, auditPasswordChange, user.ID, "", nil)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Password changed, other sessions have been logged out and API keys revoked",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"dss-api/internal/data"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGetMeLeavesOutPasswordHash(t *testing.T) {
+	app, mock := newTestApp(t)
+	header := signIn(t, app, 7, data.LevelUser)
+
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", Password: passwordHash(t, "password"),
+		Active: 1, Level: data.LevelUser}
+	mock.ExpectQuery(`from users where id = \$1`).WithArgs(7).WillReturnRows(userRows(user))
+
+	rec, payload := do(t, app, http.MethodGet, "/me/", nil, header)
+	if rec.Code != http.StatusOK || payload.Error {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+
+	body := rec.Body.String()
+	if strings.Contains(body, `"password"`) || strings.Contains(body, user.Password) {
+		t.Errorf("password hash in %s", body)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"dss-api/internal/data"
+	"net/http"
+)
+
+// Metrics reports the state of internals that limit throughput: the password
+// hashing pool and the token cache.
+func (app *application) Metrics(w http.ResponseWriter, r *http.Request) {
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data: envelope{
+			"password_hashing": data.GetHashPoolStats(),
+			"token_cache":      data.GetTokenCacheStats(),
+		},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"dss-api/internal/data"
+	"dss-api/internal/totp"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const recoveryCodeCount = 10
+
+// needsSecondFactor reports whether a login of user has to be completed with
+// LoginTOTP: the user has two-factor authentication, or their level requires
+// it and they have to enrol first.
+func (app *application) needsSecondFactor(user *data.User) bool {
+	return user.TOTPEnabledAt != nil || app.config.totpLevels[user.Level]
+}
+
+// requireSecondFactor answers a correct password of a user with two-factor
+// authentication by issuing an mfa pending token instead of a session. A user
+// who has yet to enrol is told so, and exchanges the token at
+// EnrollTOTPAtLogin.
+func (app *application) requireSecondFactor(w http.ResponseWriter, user *data.User) {
+	token, err := app.issueMFAToken(user)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	response := envelope{"mfa_required": true, "mfa_token": token.Token, "expiry": token.Expiry}
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Two-factor authentication code required",
+		Data:    response,
+	}
+	if user.TOTPEnabledAt == nil {
+		payload.Message = "Two-factor authentication has to be set up"
+		response["mfa_enrollment_required"] = true
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// issueMFAToken stores a new mfa pending token for the user.
+func (app *application) issueMFAToken(user *data.User) (*data.Token, error) {
+	token, err := app.models.Token.GenerateToken(user.ID, app.config.mfaTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	token.Scope = data.ScopeMFAPending
+
+	err = app.models.Token.Insert(*token, *user)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// LoginTOTP is the second login step. It exchanges an mfa pending token and a
+// TOTP or recovery code for a session. For a user enrolling at login, the
+// first code also switches two-factor authentication on.
+func (app *application) LoginTOTP(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+		Cookie       bool   `json:"cookie"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+
+	// the pending token is single use, so every guess needs the password again
+	_, user, err := app.models.Token.Consume(requestPayload.MFAToken, data.ScopeMFAPending)
+	if err != nil || user.Active == 0 {
+		app.errorJSON(w, errors.New("invalid or expired login attempt, please log in again"), http.StatusUnauthorized)
+		return
+	}
+
+	enrolling := user.TOTPEnabledAt == nil
+	if enrolling && (user.TOTPSecret == "" || !app.config.totpLevels[user.Level]) {
+		app.errorJSON(w, errors.New("invalid or expired login attempt, please log in again"), http.StatusUnauthorized)
+		return
+	}
+
+	valid := false
+	switch {
+	case enrolling:
+		// recovery codes only count once the enrolment is confirmed
+		if step, ok := totp.Validate(user.TOTPSecret, requestPayload.Code, time.Now()); ok {
+			err = user.EnableTOTP(step)
+			valid = err == nil
+		}
+	case requestPayload.RecoveryCode != "":
+		valid, err = user.UseRecoveryCode(requestPayload.RecoveryCode)
+	default:
+		if step, ok := totp.Validate(user.TOTPSecret, requestPayload.Code, time.Now()); ok {
+			valid, err = user.UseTOTPStep(step)
+		}
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if !valid {
+		app.recordLoginFailure(accountKey(user.ID), clientIP(r))
+		app.audit(r, 0, auditLoginFailed, user.ID, "2fa", nil)
+		app.recordLoginEvent(r, user.ID, false, data.LoginReasonInvalidTOTP)
+		app.errorJSON(w, errors.New("invalid two-factor authentication code"), http.StatusUnauthorized)
+		return
+	}
+	if enrolling {
+		app.audit(r, user.ID, auditTOTPEnable, user.ID, "", nil)
+	}
+
+	app.startSession(w, r, user, data.LoginReasonTOTP, requestPayload.Cookie)
+}
+
+// EnrollTOTPAtLogin sets up two-factor authentication for a user whose level
+// requires it, in exchange for the mfa pending token of their login. The
+// answer carries the secret, the recovery codes and a new pending token,
+// which LoginTOTP takes together with a first code.
+func (app *application) EnrollTOTPAtLogin(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		MFAToken string `json:"mfa_token"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+
+	_, user, err := app.models.Token.Consume(requestPayload.MFAToken, data.ScopeMFAPending)
+	if err != nil || user.Active == 0 || user.TOTPEnabledAt != nil || !app.config.totpLevels[user.Level] {
+		app.errorJSON(w, errors.New("invalid or expired login attempt, please log in again"), http.StatusUnauthorized)
+		return
+	}
+
+	enrolment, err := app.newTOTPSecret(user)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	token, err := app.issueMFAToken(user)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	enrolment["mfa_token"] = token.Token
+	enrolment["expiry"] = token.Expiry
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Scan the QR code and log in with a first code",
+		Data:    enrolment,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// EnrollTOTP creates a new TOTP secret and recovery codes for the
+// authenticated user. Two-factor authentication is only switched on once
+// ConfirmTOTP receives a first valid code.
+func (app *application) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	// the token may only carry the user's id, and the secret must be current
+	user, err := app.models.User.GetOne(app.contextGetUser(r).ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if user.TOTPEnabledAt != nil {
+		app.errorJSON(w, errors.New("two-factor authentication is already enabled"))
+		return
+	}
+
+	enrolment, err := app.newTOTPSecret(user)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Scan the QR code and confirm with a first code",
+		Data:    enrolment,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// newTOTPSecret stores a new TOTP secret and recovery codes for the user and
+// returns what they need to set up their authenticator app.
+func (app *application) newTOTPSecret(user *data.User) (envelope, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryCodes, err := data.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+
+	err = user.SetTOTPSecret(secret, recoveryCodes)
+	if err != nil {
+		return nil, err
+	}
+
+	return envelope{
+		"secret":         secret,
+		"otpauth_uri":    totp.URI(app.config.totpIssuer, user.Email, secret),
+		"recovery_codes": recoveryCodes,
+	}, nil
+}
+
+func (app *application) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	// the token may only carry the user's id, and the secret must be current
+	user, err := app.models.User.GetOne(app.contextGetUser(r).ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var requestPayload struct {
+		Code string `json:"code"`
+	}
+
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+
+	if user.TOTPSecret == "" || user.TOTPEnabledAt != nil {
+		app.errorJSON(w, errors.New("no two-factor enrolment in progress"))
+		return
+	}
+
+	step, ok := totp.Validate(user.TOTPSecret, requestPayload.Code, time.Now())
+	if !ok {
+		app.errorJSON(w, errors.New("invalid two-factor authentication code"))
+		return
+	}
+
+	err = user.EnableTOTP(step)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	app.audit(r, user.ID, auditTOTPEnable, user.ID, "", nil)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Two-factor authentication enabled",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *application) ResetUserTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.models.User.GetOne(userID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = user.ResetTOTP()
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	app.audit(r, app.contextGetUser(r).ID, auditTOTPReset, user.ID, "", nil)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Two-factor authentication reset",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
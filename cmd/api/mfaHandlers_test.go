@@ -0,0 +1,232 @@
+package main
+
+import (
+	"dss-api/internal/data"
+	"dss-api/internal/totp"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// TestLoginTOTPRefusesReplayedCode sends a valid code whose time step has
+// already been used.
+func TestLoginTOTPRefusesReplayedCode(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.Code(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enabledAt := time.Now()
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", Active: 1, Level: data.LevelUser,
+		TOTPSecret: secret, TOTPEnabledAt: &enabledAt}
+
+	expectConsumeToken(mock, data.ScopeMFAPending, user)
+	mock.ExpectExec(`and totp_last_step < \$1`).WithArgs(sqlmock.AnyArg(), user.ID).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	rec, payload := do(t, app, http.MethodPost, "/users/login/2fa", map[string]string{"mfa_token": "pending", "code": code}, nil)
+	if rec.Code != http.StatusUnauthorized || payload.Message != "invalid two-factor authentication code" {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+}
+
+// expectMFATokenInsert expects a new mfa pending token of the user to replace
+// any earlier one.
+func expectMFATokenInsert(mock sqlmock.Sqlmock, userID int) {
+	mock.ExpectBegin()
+	mock.ExpectExec(`delete from tokens where user_id = \$1 and scope = \$2`).WithArgs(userID, data.ScopeMFAPending).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`insert into tokens`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+// TestLoginRequiresTOTPEnrolment logs in with the password of an admin who
+// has no two-factor authentication, which must not start a session.
+func TestLoginRequiresTOTPEnrolment(t *testing.T) {
+	app, mock := newTestApp(t)
+	app.config.totpLevels = map[int]bool{data.LevelAdmin: true}
+	mock.MatchExpectationsInOrder(false)
+
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", Password: passwordHash(t, "password"),
+		Active: 1, Level: data.LevelAdmin}
+
+	expectThrottleLookups(mock, "jane")
+	mock.ExpectQuery(`from users where email = \$1 or lower\(username\) = \$1`).WillReturnRows(userRows(user))
+	expectThrottleLookups(mock, "user:7")
+	mock.ExpectExec(`delete from login_throttles`).WillReturnResult(sqlmock.NewResult(0, 0))
+	expectMFATokenInsert(mock, 7)
+
+	rec, payload := do(t, app, http.MethodPost, "/users/login", map[string]string{"username": "jane", "password": "password"}, nil)
+	if rec.Code != http.StatusOK || payload.Error {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+
+	var required bool
+	var token string
+	decodeData(t, payload, "mfa_enrollment_required", &required)
+	decodeData(t, payload, "mfa_token", &token)
+	if !required || token == "" {
+		t.Errorf("payload = %+v", payload)
+	}
+
+	err := mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnrollTOTPAtLogin(t *testing.T) {
+	app, mock := newTestApp(t)
+	app.config.totpLevels = map[int]bool{data.LevelAdmin: true}
+
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", Active: 1, Level: data.LevelAdmin}
+
+	stored := &capture{}
+	expectConsumeToken(mock, data.ScopeMFAPending, user)
+	mock.ExpectBegin()
+	mock.ExpectExec(`update users set totp_secret = \$1`).WithArgs(stored, sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`delete from recovery_codes`).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < recoveryCodeCount; i++ {
+		mock.ExpectExec(`insert into recovery_codes`).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+	expectMFATokenInsert(mock, 7)
+
+	rec, payload := do(t, app, http.MethodPost, "/users/login/2fa/enroll", map[string]string{"mfa_token": "pending"}, nil)
+	if rec.Code != http.StatusOK || payload.Error {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+
+	var secret, token string
+	var codes []string
+	decodeData(t, payload, "secret", &secret)
+	decodeData(t, payload, "mfa_token", &token)
+	decodeData(t, payload, "recovery_codes", &codes)
+	if secret == "" || token == "" || token == "pending" || len(codes) != recoveryCodeCount {
+		t.Errorf("payload = %+v", payload)
+	}
+
+	// the secret is only stored encrypted
+	if sealed, _ := stored.value.(string); sealed == "" || strings.Contains(sealed, secret) {
+		t.Errorf("stored secret %q", stored.value)
+	}
+
+	err := mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnrollTOTPAtLoginRefuses(t *testing.T) {
+	enabledAt := time.Now()
+
+	tests := []struct {
+		name string
+		user data.User
+	}{
+		{"level without the requirement", data.User{ID: 7, Email: "jane@example.com", Active: 1, Level: data.LevelUser}},
+		{"already enrolled", data.User{ID: 7, Email: "jane@example.com", Active: 1, Level: data.LevelAdmin,
+			TOTPSecret: "JBSWY3DPEHPK3PXP", TOTPEnabledAt: &enabledAt}},
+		{"inactive", data.User{ID: 7, Email: "jane@example.com", Active: 0, Level: data.LevelAdmin}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newTestApp(t)
+			app.config.totpLevels = map[int]bool{data.LevelAdmin: true}
+
+			expectConsumeToken(mock, data.ScopeMFAPending, tt.user)
+
+			rec, _ := do(t, app, http.MethodPost, "/users/login/2fa/enroll", map[string]string{"mfa_token": "pending"}, nil)
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("status = %d", rec.Code)
+			}
+
+			err := mock.ExpectationsWereMet()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// TestLoginTOTPConfirmsEnrolment sends the first code of an admin enrolling
+// at login, which switches two-factor authentication on and starts a session.
+func TestLoginTOTPConfirmsEnrolment(t *testing.T) {
+	app, mock := newTestApp(t)
+	app.config.totpLevels = map[int]bool{data.LevelAdmin: true}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.Code(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", Active: 1, Level: data.LevelAdmin, TOTPSecret: secret}
+
+	expectConsumeToken(mock, data.ScopeMFAPending, user)
+	mock.ExpectExec(`update users set totp_enabled_at = \$1, totp_last_step = \$2`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 7).WillReturnResult(sqlmock.NewResult(0, 1))
+	expectAudit(mock, auditTOTPEnable)
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into sessions`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into tokens`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into tokens`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	rec, payload := do(t, app, http.MethodPost, "/users/login/2fa", map[string]string{"mfa_token": "pending", "code": code}, nil)
+	if rec.Code != http.StatusOK || payload.Message != "Logged in" {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoginTOTPRefusesUnfinishedEnrolment(t *testing.T) {
+	tests := []struct {
+		name   string
+		levels map[int]bool
+		user   data.User
+		body   map[string]string
+	}{
+		// recovery codes are only good once a code has confirmed the secret
+		{"recovery code", map[int]bool{data.LevelAdmin: true},
+			data.User{ID: 7, Email: "jane@example.com", Active: 1, Level: data.LevelAdmin, TOTPSecret: "JBSWY3DPEHPK3PXP"},
+			map[string]string{"mfa_token": "pending", "recovery_code": "aaaaaaaa-bbbbbbbb"}},
+		{"no secret", map[int]bool{data.LevelAdmin: true},
+			data.User{ID: 7, Email: "jane@example.com", Active: 1, Level: data.LevelAdmin},
+			map[string]string{"mfa_token": "pending", "code": "123456"}},
+		{"level without the requirement", map[int]bool{},
+			data.User{ID: 7, Email: "jane@example.com", Active: 1, Level: data.LevelAdmin, TOTPSecret: "JBSWY3DPEHPK3PXP"},
+			map[string]string{"mfa_token": "pending", "code": "123456"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newTestApp(t)
+			app.config.totpLevels = tt.levels
+
+			expectConsumeToken(mock, data.ScopeMFAPending, tt.user)
+
+			rec, _ := do(t, app, http.MethodPost, "/users/login/2fa", tt.body, nil)
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("status = %d", rec.Code)
+			}
+		})
+	}
+}
@@ -1,10 +1,18 @@
 package main
 
-import "net/http"
+import (
+	"dss-api/internal/data"
+	"errors"
+	"net/http"
+	"strconv"
+)
 
+// AuthTokenMiddleware authenticates requests by bearer token, API key or
+// session cookie. Requests authenticated by cookie must pass the double
+// submit CSRF check to change anything.
 func (app *application) AuthTokenMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, err := app.models.Token.AuthenticateToken(r)
+		p, err := app.authenticate(r)
 		if err != nil {
 			payload := jsonResponse{
 				Error:   true,
@@ -14,6 +22,78 @@ func (app *application) AuthTokenMiddleware(next http.Handler) http.Handler {
 			_ = app.writeJSON(w, http.StatusUnauthorized, payload)
 			return
 		}
+
+		if p.Cookie && !validCSRF(r) {
+			app.errorJSON(w, errInvalidCSRF, http.StatusForbidden)
+			return
+		}
+
+		if p.Impersonator != nil {
+			w.Header().Set("X-Impersonated-By", strconv.Itoa(p.Impersonator.ID))
+			w.Header().Set("X-Impersonated-User", strconv.Itoa(p.User.ID))
+			app.infoLog.Printf("user %d impersonating user %d: %s %s", p.Impersonator.ID, p.User.ID, r.Method, r.URL.Path)
+		}
+
+		next.ServeHTTP(w, app.contextSetPrincipal(r, p))
+	})
+}
+
+// RequireScope refuses requests made with an API key that lacks scope.
+// Requests authenticated by a login session are not limited by scopes.
+func (app *application) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if key := app.contextGetAPIKey(r); key != nil && !key.HasScope(scope) {
+				app.errorJSON(w, errors.New("api key lacks the "+scope+" scope"), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequirePermission refuses requests from users whose role lacks perm.
+func (app *application) RequirePermission(perm data.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := app.contextGetUser(r)
+			if !user.Can(perm) {
+				payload := jsonResponse{
+					Error:   true,
+					Message: "Permission denied: your role does not grant " + string(perm),
+				}
+
+				_ = app.writeJSON(w, http.StatusForbidden, payload)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RejectAPIKeys keeps API keys away from routes that manage credentials.
+func (app *application) RejectAPIKeys(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.errorJSON(w, errors.New("this route can't be used with an api key"), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RejectImpersonation keeps impersonation tokens away from routes that change
+// credentials or start another impersonation.
+func (app *application) RejectImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetImpersonator(r) != nil {
+			app.errorJSON(w, errImpersonating, http.StatusForbidden)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
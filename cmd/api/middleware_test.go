@@ -0,0 +1,106 @@
+package main
+
+import (
+	"dss-api/internal/data"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectAPIKey expects the API key of user to be looked up, with scopes.
+func expectAPIKey(mock sqlmock.Sqlmock, user data.User, scopes string) {
+	lastUsed := time.Now()
+	mock.ExpectQuery(`from api_keys where key_hash = \$1`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "prefix", "scopes", "last_used_at", "expires_at", "created_at"}).
+			AddRow(3, user.ID, "ci", data.APIKeyPrefix+"abcd", scopes, lastUsed, nil, lastUsed))
+	mock.ExpectQuery(`from users where id = \$1`).WithArgs(user.ID).WillReturnRows(userRows(user))
+}
+
+func TestRequireScope(t *testing.T) {
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", Active: 1, Level: data.LevelUser}
+	header := http.Header{"Authorization": {"Bearer " + data.APIKeyPrefix + "abcdefghijklmnopqrstuvwxyz234567"}}
+
+	t.Run("missing scope", func(t *testing.T) {
+		app, mock := newTestApp(t)
+		expectAPIKey(mock, user, data.APIScopeSessionsRead)
+
+		rec, payload := do(t, app, http.MethodGet, "/me/", nil, header)
+		if rec.Code != http.StatusForbidden || payload.Message != "api key lacks the users:read scope" {
+			t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+		}
+
+		err := mock.ExpectationsWereMet()
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("granted scope", func(t *testing.T) {
+		app, mock := newTestApp(t)
+		expectAPIKey(mock, user, data.APIScopeSessionsRead+" "+data.APIScopeUsersRead)
+		mock.ExpectQuery(`from users where id = \$1`).WithArgs(7).WillReturnRows(userRows(user))
+
+		rec, payload := do(t, app, http.MethodGet, "/me/", nil, header)
+		if rec.Code != http.StatusOK || payload.Error {
+			t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+		}
+
+		err := mock.ExpectationsWereMet()
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	// routes that manage credentials refuse keys whatever their scopes
+	t.Run("credential route", func(t *testing.T) {
+		app, mock := newTestApp(t)
+		expectAPIKey(mock, user, data.APIScopeUsersWrite)
+
+		rec, _ := do(t, app, http.MethodPost, "/me/password", map[string]string{}, header)
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("status = %d", rec.Code)
+		}
+	})
+}
+
+func TestRequirePermission(t *testing.T) {
+	tests := []struct {
+		name   string
+		level  int
+		path   string
+		status int
+	}{
+		{"user reading users", data.LevelUser, "/admin/users", http.StatusForbidden},
+		{"manager reading users", data.LevelManager, "/admin/users", http.StatusOK},
+		{"manager saving a user", data.LevelManager, "/admin/users/save", http.StatusForbidden},
+		{"manager deleting a user", data.LevelManager, "/admin/users/delete", http.StatusForbidden},
+		{"manager reading the audit log", data.LevelManager, "/admin/audit", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newTestApp(t)
+			header := signIn(t, app, 7, tt.level)
+			if tt.status == http.StatusOK {
+				mock.ExpectQuery(`from users order by last_name`).
+					WillReturnRows(sqlmock.NewRows(append(userColumnNames, "hash_token", "last_seen_at")))
+			}
+
+			rec, payload := do(t, app, http.MethodPost, tt.path, map[string]any{}, header)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+			}
+			if tt.status == http.StatusForbidden && !strings.HasPrefix(payload.Message, "Permission denied") {
+				t.Errorf("message = %q", payload.Message)
+			}
+
+			err := mock.ExpectationsWereMet()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
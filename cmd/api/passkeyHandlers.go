@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"dss-api/internal/data"
+	"dss-api/internal/webauthn"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+)
+
+var (
+	errInvalidPasskey    = errors.New("invalid or expired passkey login, please try again")
+	errPasskeyNotAllowed = errors.New("passkeys are not available for your account")
+)
+
+// passkeyAllowed reports whether users of level may use passkeys.
+func (app *application) passkeyAllowed(level int) bool {
+	return app.config.passkeyLevels[level]
+}
+
+// userHandle is the WebAuthn user handle of a user: their id, which reveals
+// nothing the credential id doesn't.
+func userHandle(userID int) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(userID))
+}
+
+// credentialIDs returns the WebAuthn credential ids of passkeys.
+func credentialIDs(passkeys []*data.Passkey) [][]byte {
+	ids := [][]byte{}
+	for _, passkey := range passkeys {
+		ids = append(ids, passkey.CredentialID)
+	}
+
+	return ids
+}
+
+// START PASSKEY MANAGEMENT
+func (app *application) MyPasskeys(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	passkeys, err := app.models.Passkey.GetAllForUser(user.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"passkeys": passkeys},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// BeginPasskeyRegistration returns the options to pass to
+// navigator.credentials.create() to register a passkey for the current user.
+func (app *application) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	// signed access tokens carry only the id and level, and the options need
+	// the user's names
+	user, err := app.models.User.GetOne(app.contextGetUser(r).ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if !app.passkeyAllowed(user.Level) {
+		app.errorJSON(w, errPasskeyNotAllowed, http.StatusForbidden)
+		return
+	}
+
+	passkeys, err := app.models.Passkey.GetAllForUser(user.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.models.Passkey.InsertChallenge(challenge, &user.ID, data.ChallengeRegister, app.webauthn.Timeout())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	displayName := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if displayName == "" {
+		displayName = user.UserName
+	}
+
+	options := app.webauthn.CreationOptions(challenge, webauthn.User{
+		ID:          userHandle(user.ID),
+		Name:        user.UserName,
+		DisplayName: displayName,
+	}, credentialIDs(passkeys))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"options": options},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// FinishPasskeyRegistration verifies the credential created with the options
+// from BeginPasskeyRegistration and stores it as a passkey of the user.
+func (app *application) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var requestPayload struct {
+		Name       string                       `json:"name"`
+		Credential webauthn.AttestationResponse `json:"credential"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+
+	requestPayload.Name = strings.TrimSpace(requestPayload.Name)
+	if requestPayload.Name == "" {
+		app.errorJSON(w, errors.New("name is required"))
+		return
+	}
+
+	if !app.passkeyAllowed(user.Level) {
+		app.errorJSON(w, errPasskeyNotAllowed, http.StatusForbidden)
+		return
+	}
+
+	challenge, err := webauthn.Challenge(requestPayload.Credential.Response.ClientDataJSON)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// the challenge is spent whatever the outcome
+	userID, err := app.models.Passkey.ConsumeChallenge(challenge, data.ChallengeRegister)
+	if err != nil || userID == nil || *userID != user.ID {
+		app.errorJSON(w, data.ErrInvalidChallenge)
+		return
+	}
+
+	credential, err := app.webauthn.VerifyRegistration(challenge, &requestPayload.Credential)
+	if err != nil {
+		app.errorLog.Printf("passkey registration for user %d: %v", user.ID, err)
+		app.errorJSON(w, errors.New("the passkey could not be verified"))
+		return
+	}
+
+	_, err = app.models.Passkey.GetByCredentialID(credential.ID)
+	if err == nil {
+		app.errorJSON(w, errors.New("this passkey is already registered"))
+		return
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, err)
+		return
+	}
+
+	passkey := &data.Passkey{
+		UserID:       user.ID,
+		Name:         requestPayload.Name,
+		CredentialID: credential.ID,
+		PublicKey:    credential.PublicKey,
+		AAGUID:       credential.AAGUID,
+		SignCount:    credential.SignCount,
+	}
+
+	err = app.models.Passkey.Insert(passkey)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	app.audit(r, user.ID, auditPasskeyCreate, user.ID, "passkey:"+strconv.Itoa(passkey.ID), map[string]any{"name": passkey.Name})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Passkey registered",
+		Data:    envelope{"passkey": passkey},
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, payload)
+}
+
+func (app *application) RenamePasskey(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	passkeyID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var requestPayload struct {
+		Name string `json:"name"`
+	}
+
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+
+	requestPayload.Name = strings.TrimSpace(requestPayload.Name)
+	if requestPayload.Name == "" {
+		app.errorJSON(w, errors.New("name is required"))
+		return
+	}
+
+	err = app.models.Passkey.Rename(user.ID, passkeyID, requestPayload.Name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("passkey not found"), http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+	app.audit(r, user.ID, auditPasskeyRename, user.ID, "passkey:"+strconv.Itoa(passkeyID), map[string]any{"name": requestPayload.Name})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Passkey renamed",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *application) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	passkeyID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.models.Passkey.Delete(user.ID, passkeyID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("passkey not found"), http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+	app.audit(r, user.ID, auditPasskeyDelete, user.ID, "passkey:"+strconv.Itoa(passkeyID), nil)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Passkey deleted",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// END PASSKEY MANAGEMENT
+
+// START PASSKEY LOGIN
+// BeginPasskeyLogin returns the options to pass to navigator.credentials.get().
+// With a username, only that user's passkeys are offered; without one, the
+// authenticator offers whichever passkeys it holds for us. Unknown users get
+// the same answer as users without passkeys.
+func (app *application) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		UserName string `json:"username"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+
+	var userID *int
+	allow := [][]byte{}
+
+	if requestPayload.UserName != "" {
+		user, err := app.models.User.GetByLogin(requestPayload.UserName)
+		if err == nil && app.passkeyAllowed(user.Level) {
+			passkeys, err := app.models.Passkey.GetAllForUser(user.ID)
+			if err != nil {
+				app.errorJSON(w, err)
+				return
+			}
+			userID = &user.ID
+			allow = credentialIDs(passkeys)
+		}
+	}
+
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.models.Passkey.InsertChallenge(challenge, userID, data.ChallengeLogin, app.webauthn.Timeout())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"options": app.webauthn.RequestOptions(challenge, allow)},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// FinishPasskeyLogin verifies the assertion made with the options from
+// BeginPasskeyLogin and starts a session, like Login does with a password.
+// A passkey that verified its user counts as both factors; otherwise users
+// with two-factor authentication still have to enter a code.
+func (app *application) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Credential webauthn.AssertionResponse `json:"credential"`
+		// Cookie asks for a browser session kept in cookies
+		Cookie bool `json:"cookie"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+	resp := &requestPayload.Credential
+
+	challenge, err := webauthn.Challenge(resp.Response.ClientDataJSON)
+	if err != nil {
+		app.errorJSON(w, errInvalidPasskey, http.StatusUnauthorized)
+		return
+	}
+
+	challengeUserID, err := app.models.Passkey.ConsumeChallenge(challenge, data.ChallengeLogin)
+	if err != nil {
+		app.errorJSON(w, errInvalidPasskey, http.StatusUnauthorized)
+		return
+	}
+
+	passkey, err := app.models.Passkey.GetByCredentialID(resp.RawID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.errorLog.Println(err)
+		}
+		// there is no account to count this against, only the address
+		_, err = app.models.LoginThrottle.RecordFailure(data.ThrottleIP, clientIP(r), app.config.ipLockout)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+		app.audit(r, 0, auditLoginFailed, 0, "passkey", nil)
+		app.errorJSON(w, errInvalidPasskey, http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.models.User.GetOne(passkey.UserID)
+	if err != nil {
+		app.errorJSON(w, errInvalidPasskey, http.StatusUnauthorized)
+		return
+	}
+
+	account := accountKey(user.ID)
+	ip := clientIP(r)
+	if until := app.loginLockedUntil(account, ip); !until.IsZero() {
+		app.lockedOut(w, until)
+		return
+	}
+
+	// the passkey has to belong to the user the login was started for, and
+	// to the user the authenticator says it is for
+	wrongUser := challengeUserID != nil && *challengeUserID != user.ID
+	wrongHandle := len(resp.Response.UserHandle) > 0 && !bytes.Equal(resp.Response.UserHandle, userHandle(user.ID))
+
+	var assertion *webauthn.Assertion
+	if !wrongUser && !wrongHandle {
+		assertion, err = app.webauthn.VerifyAssertion(challenge, passkey.PublicKey, passkey.SignCount, resp)
+	}
+	if wrongUser || wrongHandle || err != nil {
+		if errors.Is(err, webauthn.ErrClonedAuthenticator) {
+			app.errorLog.Printf("passkey %d of user %d: %v", passkey.ID, user.ID, err)
+		}
+		app.recordLoginFailure(account, ip)
+		app.audit(r, 0, auditLoginFailed, user.ID, "passkey:"+strconv.Itoa(passkey.ID), nil)
+		app.recordLoginEvent(r, user.ID, false, data.LoginReasonInvalidPasskey)
+		app.errorJSON(w, errInvalidPasskey, http.StatusUnauthorized)
+		return
+	}
+
+	err = app.models.Passkey.UpdateUsage(passkey.ID, assertion.SignCount)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	err = app.models.LoginThrottle.Reset(data.ThrottleAccount, account)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	// the level may have changed since the passkey was registered
+	if !app.passkeyAllowed(user.Level) {
+		app.errorJSON(w, errPasskeyNotAllowed, http.StatusForbidden)
+		return
+	}
+
+	if user.Active == 0 {
+		app.recordLoginEvent(r, user.ID, false, data.LoginReasonInactive)
+		app.errorJSON(w, errors.New("User is not active"))
+		return
+	}
+
+	if app.config.requireVerifiedEmail && user.VerifiedAt == nil {
+		app.recordLoginEvent(r, user.ID, false, data.LoginReasonEmailNotVerified)
+		app.errorJSON(w, errors.New("Email address is not verified"), http.StatusForbidden)
+		return
+	}
+
+	// a passkey that verified the user is a second factor itself
+	if app.needsSecondFactor(user) && !assertion.UserVerified {
+		app.requireSecondFactor(w, user)
+		return
+	}
+
+	app.startSession(w, r, user, data.LoginReasonPasskey, requestPayload.Cookie)
+}
+
+// END PASSKEY LOGIN
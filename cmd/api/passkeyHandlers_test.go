@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/sha256"
+	"dss-api/internal/data"
+	"dss-api/internal/webauthn"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const testOrigin = "http://localhost:8080"
+
+// passkeyColumnNames are the columns of data.Passkey rows, in scan order.
+var passkeyColumnNames = []string{"id", "user_id", "name", "credential_id", "public_key", "aaguid", "sign_count",
+	"last_used_at", "created_at"}
+
+func passkeyRows(passkeys ...data.Passkey) *sqlmock.Rows {
+	rows := sqlmock.NewRows(passkeyColumnNames)
+	for _, p := range passkeys {
+		rows.AddRow(p.ID, p.UserID, p.Name, p.CredentialID, p.PublicKey, p.AAGUID, int64(p.SignCount), p.LastUsedAt, p.CreatedAt)
+	}
+
+	return rows
+}
+
+// expectConsumeChallenge expects the challenge of a ceremony to be spent.
+// A nil purpose means the challenge is unknown.
+func expectConsumeChallenge(mock sqlmock.Sqlmock, challenge []byte, userID *int, purpose *string) {
+	hash := sha256.Sum256(challenge)
+	rows := sqlmock.NewRows([]string{"user_id", "purpose", "expires_at"})
+	if purpose != nil {
+		rows.AddRow(userID, *purpose, time.Now().Add(time.Minute))
+	}
+
+	mock.ExpectQuery(`delete from webauthn_challenges where challenge_hash = \$1 returning`).WithArgs(hash[:]).WillReturnRows(rows)
+}
+
+// expectThrottleLookups expects the lockouts of account and of any address to
+// be looked up, finding none.
+func expectThrottleLookups(mock sqlmock.Sqlmock, account string) {
+	none := sqlmock.NewRows([]string{"locked_until"})
+	mock.ExpectQuery(`from login_throttles`).WithArgs(data.ThrottleAccount, account).WillReturnRows(none)
+	mock.ExpectQuery(`from login_throttles`).WithArgs(data.ThrottleIP, sqlmock.AnyArg()).WillReturnRows(none)
+}
+
+// decodeData decodes the field of a response's data into v.
+func decodeData(t *testing.T, payload jsonResponse, field string, v any) {
+	t.Helper()
+
+	m, ok := payload.Data.(map[string]any)
+	if !ok {
+		t.Fatalf("data = %v", payload.Data)
+	}
+	raw, err := json.Marshal(m[field])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(raw, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// registerPasskey registers a passkey for user with the application's relying
+// party, without going through the handlers.
+func registerPasskey(t *testing.T, app *application, a *webauthn.Authenticator, user data.User) data.Passkey {
+	t.Helper()
+
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := a.Create(testOrigin, app.webauthn.CreationOptions(challenge, webauthn.User{ID: userHandle(user.ID), Name: user.UserName}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential, err := app.webauthn.VerifyRegistration(challenge, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data.Passkey{ID: 3, UserID: user.ID, Name: "Laptop", CredentialID: credential.ID, PublicKey: credential.PublicKey,
+		AAGUID: credential.AAGUID, SignCount: credential.SignCount, CreatedAt: time.Now()}
+}
+
+// TestPasskeyRegistration registers a passkey through both steps, with the
+// user known only from a signed access token.
+func TestPasskeyRegistration(t *testing.T) {
+	app, mock := newTestApp(t)
+	header := signIn(t, app, 7, data.LevelAdmin)
+
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", FirstName: "Jane", LastName: "Doe", Active: 1,
+		Level: data.LevelAdmin}
+	register := data.ChallengeRegister
+
+	mock.ExpectQuery(`from users where id = \$1`).WithArgs(7).WillReturnRows(userRows(user))
+	mock.ExpectQuery(`from passkeys where user_id = \$1`).WithArgs(7).WillReturnRows(passkeyRows())
+	mock.ExpectExec(`delete from webauthn_challenges where expires_at < \$1`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`insert into webauthn_challenges`).WithArgs(sqlmock.AnyArg(), 7, register, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rec, payload := do(t, app, http.MethodPost, "/users/passkeys/register/begin", nil, header)
+	if rec.Code != http.StatusOK || payload.Error {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+
+	var opts webauthn.CreationOptions
+	decodeData(t, payload, "options", &opts)
+	if opts.User.Name != "jane" || opts.User.DisplayName != "Jane Doe" || string(opts.User.ID) != string(userHandle(7)) {
+		t.Errorf("user = %+v", opts.User)
+	}
+
+	a := webauthn.NewAuthenticator()
+	resp, err := a.Create(testOrigin, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectConsumeChallenge(mock, opts.Challenge, &user.ID, &register)
+	mock.ExpectQuery(`from passkeys where credential_id = \$1`).WithArgs([]byte(resp.RawID)).WillReturnRows(passkeyRows())
+	mock.ExpectQuery(`insert into passkeys`).
+		WithArgs(7, "Laptop", []byte(resp.RawID), sqlmock.AnyArg(), sqlmock.AnyArg(), int64(0), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(3, time.Now()))
+
+	body := map[string]any{"name": " Laptop ", "credential": resp}
+
+	rec, payload = do(t, app, http.MethodPost, "/users/passkeys/register/finish", body, header)
+	if rec.Code != http.StatusCreated || payload.Error {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+
+	var passkey data.Passkey
+	decodeData(t, payload, "passkey", &passkey)
+	if passkey.ID != 3 || passkey.Name != "Laptop" || string(passkey.CredentialID) != string(resp.RawID) {
+		t.Errorf("passkey = %+v", passkey)
+	}
+
+	// the challenge is gone once answered
+	expectConsumeChallenge(mock, opts.Challenge, nil, nil)
+
+	rec, payload = do(t, app, http.MethodPost, "/users/passkeys/register/finish", body, header)
+	if rec.Code != http.StatusBadRequest || payload.Message != data.ErrInvalidChallenge.Error() {
+		t.Errorf("replayed: status = %d, payload = %+v", rec.Code, payload)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestBeginPasskeyRegistrationUsesCurrentLevel checks that the level is read
+// from the database, not from a token issued before a demotion.
+func TestBeginPasskeyRegistrationUsesCurrentLevel(t *testing.T) {
+	app, mock := newTestApp(t)
+	header := signIn(t, app, 7, data.LevelAdmin)
+
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", Active: 1, Level: data.LevelUser}
+	mock.ExpectQuery(`from users where id = \$1`).WithArgs(7).WillReturnRows(userRows(user))
+
+	rec, payload := do(t, app, http.MethodPost, "/users/passkeys/register/begin", nil, header)
+	if rec.Code != http.StatusForbidden || payload.Message != errPasskeyNotAllowed.Error() {
+		t.Errorf("status = %d, payload = %+v", rec.Code, payload)
+	}
+
+	err := mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFinishPasskeyRegistrationRefusesForeignOrigin(t *testing.T) {
+	app, mock := newTestApp(t)
+	header := signIn(t, app, 7, data.LevelAdmin)
+
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", Active: 1, Level: data.LevelAdmin}
+	register := data.ChallengeRegister
+
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := app.webauthn.CreationOptions(challenge, webauthn.User{ID: userHandle(7), Name: "jane"}, nil)
+	resp, err := webauthn.NewAuthenticator().Create("https://evil.example", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectConsumeChallenge(mock, challenge, &user.ID, &register)
+
+	rec, payload := do(t, app, http.MethodPost, "/users/passkeys/register/finish", map[string]any{"name": "Laptop", "credential": resp}, header)
+	if rec.Code != http.StatusBadRequest || payload.Message != "the passkey could not be verified" {
+		t.Errorf("status = %d, payload = %+v", rec.Code, payload)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestPasskeyLogin logs in with a discoverable credential and checks that the
+// signature counter is stored.
+func TestPasskeyLogin(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", Active: 1, Level: data.LevelAdmin}
+	a := webauthn.NewAuthenticator()
+	passkey := registerPasskey(t, app, a, user)
+	login := data.ChallengeLogin
+
+	mock.ExpectExec(`delete from webauthn_challenges where expires_at < \$1`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`insert into webauthn_challenges`).WithArgs(sqlmock.AnyArg(), nil, login, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rec, payload := do(t, app, http.MethodPost, "/users/passkeys/login/begin", map[string]string{}, nil)
+	if rec.Code != http.StatusOK || payload.Error {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+
+	var opts webauthn.RequestOptions
+	decodeData(t, payload, "options", &opts)
+	if opts.RPID != "localhost" || len(opts.AllowCredentials) != 0 {
+		t.Errorf("options = %+v", opts)
+	}
+
+	resp, err := a.Get(testOrigin, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the throttles are looked up in no particular order
+	mock.MatchExpectationsInOrder(false)
+
+	signCount := &capture{}
+
+	expectConsumeChallenge(mock, opts.Challenge, nil, &login)
+	mock.ExpectQuery(`from passkeys where credential_id = \$1`).WithArgs([]byte(resp.RawID)).WillReturnRows(passkeyRows(passkey))
+	mock.ExpectQuery(`from users where id = \$1`).WithArgs(7).WillReturnRows(userRows(user))
+	expectThrottleLookups(mock, "user:7")
+	mock.ExpectExec(`update passkeys set sign_count = \$1, last_used_at = \$2 where id = \$3`).
+		WithArgs(signCount, sqlmock.AnyArg(), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`delete from login_throttles`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into sessions`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into tokens`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`insert into tokens`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	rec, payload = do(t, app, http.MethodPost, "/users/passkeys/login/finish", map[string]any{"credential": resp}, nil)
+	if rec.Code != http.StatusOK || payload.Message != "Logged in" {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+	if count, ok := signCount.value.(int64); !ok || count != 1 {
+		t.Errorf("sign_count = %v, want 1", signCount.value)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFinishPasskeyLoginRefuses(t *testing.T) {
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", Active: 1, Level: data.LevelAdmin}
+	other := 8
+	login := data.ChallengeLogin
+
+	tests := []struct {
+		name string
+		// expect sets up the queries of the login, given the passkey stored
+		// for the credential
+		expect func(mock sqlmock.Sqlmock, challenge []byte, passkey data.Passkey)
+	}{
+		{"replayed challenge", func(mock sqlmock.Sqlmock, challenge []byte, passkey data.Passkey) {
+			expectConsumeChallenge(mock, challenge, nil, nil)
+		}},
+		{"challenge of a registration", func(mock sqlmock.Sqlmock, challenge []byte, passkey data.Passkey) {
+			register := data.ChallengeRegister
+			expectConsumeChallenge(mock, challenge, &user.ID, &register)
+		}},
+		{"unknown credential", func(mock sqlmock.Sqlmock, challenge []byte, passkey data.Passkey) {
+			expectConsumeChallenge(mock, challenge, nil, &login)
+			mock.ExpectQuery(`from passkeys where credential_id = \$1`).WillReturnRows(passkeyRows())
+		}},
+		{"passkey of another user", func(mock sqlmock.Sqlmock, challenge []byte, passkey data.Passkey) {
+			expectConsumeChallenge(mock, challenge, &other, &login)
+			mock.ExpectQuery(`from passkeys where credential_id = \$1`).WillReturnRows(passkeyRows(passkey))
+			mock.ExpectQuery(`from users where id = \$1`).WithArgs(7).WillReturnRows(userRows(user))
+			expectThrottleLookups(mock, "user:7")
+		}},
+		{"sign count regression", func(mock sqlmock.Sqlmock, challenge []byte, passkey data.Passkey) {
+			passkey.SignCount = 10
+			expectConsumeChallenge(mock, challenge, nil, &login)
+			mock.ExpectQuery(`from passkeys where credential_id = \$1`).WillReturnRows(passkeyRows(passkey))
+			mock.ExpectQuery(`from users where id = \$1`).WithArgs(7).WillReturnRows(userRows(user))
+			expectThrottleLookups(mock, "user:7")
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newTestApp(t)
+			mock.MatchExpectationsInOrder(false)
+
+			a := webauthn.NewAuthenticator()
+			passkey := registerPasskey(t, app, a, user)
+
+			challenge, err := webauthn.NewChallenge()
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := a.Get(testOrigin, app.webauthn.RequestOptions(challenge, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.expect(mock, challenge, passkey)
+
+			rec, payload := do(t, app, http.MethodPost, "/users/passkeys/login/finish", map[string]any{"credential": resp}, nil)
+			if rec.Code != http.StatusUnauthorized || payload.Message != errInvalidPasskey.Error() {
+				t.Errorf("status = %d, payload = %+v", rec.Code, payload)
+			}
+
+			err = mock.ExpectationsWereMet()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
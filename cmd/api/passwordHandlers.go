@@ -0,0 +1,130 @@
+package main
+
+import (
+	"dss-api/internal/data"
+	"dss-api/internal/mailer"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+func (app *application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+
+	// The lookup and the email happen in the background, so the response and
+	// its timing are the same whether or not the address belongs to a user.
+	app.background(func() {
+		user, err := app.models.User.GetByEmail(requestPayload.Email)
+		if err != nil || user.Active == 0 {
+			return
+		}
+
+		token, err := app.models.Token.GenerateToken(user.ID, app.config.resetTokenTTL)
+		if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+		token.Scope = data.ScopePasswordReset
+
+		err = app.models.Token.Insert(*token, *user)
+		if err != nil {
+			app.errorLog.Println(err)
+			return
+		}
+
+		link := fmt.Sprintf("%s/reset-password?token=%s", app.config.frontendURL, url.QueryEscape(token.Token))
+
+		err = app.mailer.Send(mailer.Message{
+			To:      user.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hello %s,\n\nSomeone asked to reset the password of your account. "+
+				"If it was you, follow this link within %s:\n\n%s\n\n"+
+				"The link can only be used once. If you did not ask for it, you can ignore this email.\n",
+				user.FirstName, app.config.resetTokenTTL, link),
+		})
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "If the address belongs to an account, a reset link has been sent to it",
+	}
+
+	_ = app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+
+	if requestPayload.Password == "" {
+		app.errorJSON(w, errors.New("password is required"))
+		return
+	}
+
+	// check the password first so that a rejected one does not use up the link
+	token, err := app.models.Token.GetByToken(requestPayload.Token)
+	if err != nil || token.Scope != data.ScopePasswordReset || token.Expiry.Before(time.Now()) {
+		app.errorJSON(w, errors.New("invalid or expired reset link"))
+		return
+	}
+
+	user, err := app.models.Token.GetUserForToken(*token)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid or expired reset link"))
+		return
+	}
+
+	err = data.CheckPassword(requestPayload.Password, *user)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	_, user, err = app.models.Token.Consume(requestPayload.Token, data.ScopePasswordReset)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid or expired reset link"))
+		return
+	}
+
+	err = user.ResetPassword(requestPayload.Password)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	// every session, including one an attacker may hold, ends with the reset
+	err = app.models.Token.DeleteTokensForUser(user.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	app.audit(r, user.ID, auditPasswordReset, user.ID, "", nil)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "Password reset",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/sha256"
+	"dss-api/internal/data"
+	"dss-api/internal/mailer"
+	"dss-api/internal/mailer/mailertest"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestForgotPasswordSendsResetLink(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	server, err := mailertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	app.mailer = mailer.Mailer{Host: server.Host, Port: server.Port, From: "DSS <no-reply@dss-api.local>"}
+
+	user := data.User{ID: 7, UserName: "jane", Email: "jane@example.com", FirstName: "Jane", Active: 1, Level: data.LevelUser}
+	tokenHash := &capture{}
+
+	mock.ExpectQuery(`from users where email = \$1`).WithArgs("jane@example.com").WillReturnRows(userRows(user))
+	mock.ExpectBegin()
+	mock.ExpectExec(`delete from tokens where user_id = \$1 and scope = \$2`).
+		WithArgs(user.ID, data.ScopePasswordReset).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`insert into tokens`).
+		WithArgs(user.ID, user.UserName, user.Email, tokenHash, data.ScopePasswordReset,
+			sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	rec, payload := do(t, app, http.MethodPost, "/users/forgot-password", map[string]string{"email": " Jane@Example.com "}, nil)
+	if rec.Code != http.StatusAccepted || payload.Error {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+
+	received, err := server.Receive(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := received.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := msg.Header.Get("To"); got != "jane@example.com" {
+		t.Errorf("To = %q", got)
+	}
+	if got := msg.Header.Get("Subject"); got != "Reset your password" {
+		t.Errorf("Subject = %q", got)
+	}
+	if got := msg.Header.Get("From"); got != "DSS <no-reply@dss-api.local>" {
+		t.Errorf("From = %q", got)
+	}
+
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !regexp.MustCompile(`^Hello Jane,`).Match(body) {
+		t.Errorf("body doesn't greet the user: %q", body)
+	}
+
+	link := regexp.MustCompile(`http://localhost:8080/reset-password\?token=\S+`).Find(body)
+	if link == nil {
+		t.Fatalf("no reset link in %q", body)
+	}
+
+	u, err := url.Parse(string(link))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the link carries the token whose hash was stored, and only the hash
+	sum := sha256.Sum256([]byte(u.Query().Get("token")))
+	stored, _ := tokenHash.value.([]byte)
+	if string(stored) != string(sum[:]) {
+		t.Errorf("stored hash %x doesn't match the token in the link", stored)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestForgotPasswordUnknownAddress(t *testing.T) {
+	app, mock := newTestApp(t)
+
+	server, err := mailertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	app.mailer = mailer.Mailer{Host: server.Host, Port: server.Port, From: "no-reply@dss-api.local"}
+
+	mock.ExpectQuery(`from users where email = \$1`).WithArgs("nobody@example.com").WillReturnRows(userRows())
+
+	rec, payload := do(t, app, http.MethodPost, "/users/forgot-password", map[string]string{"email": "nobody@example.com"}, nil)
+	if rec.Code != http.StatusAccepted || payload.Error {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+
+	if msg, err := server.Receive(200 * time.Millisecond); err == nil {
+		t.Errorf("sent %q to an unknown address", msg.To)
+	}
+}
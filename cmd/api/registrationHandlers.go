@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"dss-api/internal/data"
+	"dss-api/internal/mailer"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+)
+
+var errRegistrationNotFound = errors.New("registration not found")
+
+// registrationReceived is the answer to every accepted sign-up, whether or
+// not the username or address was taken, so that it doesn't reveal accounts.
+const registrationReceived = "Registration received. Please confirm your email address; you can log in once an admin approves your account"
+
+// registrationAllowed reports whether email belongs to a domain that may
+// register. Every domain may when the allowlist is empty.
+func (app *application) registrationAllowed(email string) bool {
+	if len(app.config.registration.domains) == 0 {
+		return true
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+
+	for _, allowed := range app.config.registration.domains {
+		if domain == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Register creates an inactive account that an admin has to approve, and
+// asks the applicant to confirm their email address in the meantime.
+func (app *application) Register(w http.ResponseWriter, r *http.Request) {
+	if !app.config.registration.enabled {
+		app.errorJSON(w, errors.New("registration is closed"), http.StatusForbidden)
+		return
+	}
+
+	var requestPayload struct {
+		UserName  string `json:"username"`
+		Email     string `json:"email"`
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Password  string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+
+	email := data.NormalizeEmail(requestPayload.Email)
+	if strings.TrimSpace(requestPayload.UserName) == "" || email == "" || requestPayload.Password == "" {
+		app.errorJSON(w, errors.New("username, email and password are required"))
+		return
+	}
+
+	if !app.registrationAllowed(email) {
+		app.errorJSON(w, errors.New("registration is not open to this email domain"), http.StatusForbidden)
+		return
+	}
+
+	newID, err := app.models.Registration.Insert(data.User{
+		UserName:  requestPayload.UserName,
+		Email:     email,
+		FirstName: requestPayload.FirstName,
+		LastName:  requestPayload.LastName,
+		Password:  requestPayload.Password,
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "SQLSTATE 23505") {
+			_ = app.writeJSON(w, http.StatusAccepted, jsonResponse{Error: false, Message: registrationReceived})
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.models.User.GetOne(newID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.audit(r, newID, auditRegister, newID, "", map[string]any{"after": auditUser(user)})
+	app.sendVerificationEmail(*user, user.Email)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: registrationReceived,
+	}
+
+	_ = app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+// Registrations lists the sign-ups waiting for approval, oldest first.
+func (app *application) Registrations(w http.ResponseWriter, r *http.Request) {
+	registrations, err := app.models.Registration.GetAllPending()
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"registrations": registrations},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *application) ApproveRegistration(w http.ResponseWriter, r *http.Request) {
+	app.reviewRegistration(w, r, true)
+}
+
+func (app *application) RejectRegistration(w http.ResponseWriter, r *http.Request) {
+	app.reviewRegistration(w, r, false)
+}
+
+// reviewRegistration approves or rejects a pending sign-up and tells the
+// applicant, with the admin's reason. A rejected applicant's account is
+// deleted, so that they may apply again.
+func (app *application) reviewRegistration(w http.ResponseWriter, r *http.Request, approve bool) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var requestPayload struct {
+		Reason string `json:"reason"`
+	}
+
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, errors.New("Invalid JSON"))
+		return
+	}
+
+	reason := strings.TrimSpace(requestPayload.Reason)
+	if !approve && reason == "" {
+		app.errorJSON(w, errors.New("a reason is required to reject a registration"))
+		return
+	}
+
+	user, err := app.models.Registration.GetPendingUser(userID)
+	if err == nil {
+		if approve {
+			err = app.models.Registration.Approve(userID, app.contextGetUser(r).ID)
+		} else {
+			err = app.models.Registration.Reject(userID)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errRegistrationNotFound, http.StatusNotFound)
+			return
+		}
+		app.errorJSON(w, err)
+		return
+	}
+
+	actorID := app.contextGetUser(r).ID
+	message := "Registration approved"
+	if approve {
+		app.audit(r, actorID, auditRegistrationApprove, user.ID, "", map[string]any{"reason": reason})
+	} else {
+		message = "Registration rejected"
+		app.audit(r, actorID, auditRegistrationReject, 0, "user:"+strconv.Itoa(user.ID),
+			map[string]any{"reason": reason, "before": auditUser(user)})
+	}
+	app.sendRegistrationDecision(*user, approve, reason)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: message,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// sendRegistrationDecision tells an applicant whether their registration was
+// approved, and why.
+func (app *application) sendRegistrationDecision(user data.User, approved bool, reason string) {
+	app.background(func() {
+		msg := mailer.Message{To: user.Email}
+
+		if approved {
+			msg.Subject = "Your account has been approved"
+			msg.Body = fmt.Sprintf("Hello %s,\n\nYour registration has been approved. You can now log in at %s.\n",
+				user.FirstName, app.config.frontendURL)
+		} else {
+			msg.Subject = "Your registration was not approved"
+			msg.Body = fmt.Sprintf("Hello %s,\n\nYour registration has not been approved.\n", user.FirstName)
+		}
+		if reason != "" {
+			msg.Body += "\nReason: " + reason + "\n"
+		}
+
+		err := app.mailer.Send(msg)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	})
+}
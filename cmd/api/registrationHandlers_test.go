@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseDomains(t *testing.T) {
+	got := parseDomains(" Example.COM, @Partner.org ,, ")
+	want := []string{"example.com", "partner.org"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRegisterRefusesDomainNotAllowed(t *testing.T) {
+	app, mock := newTestApp(t)
+	app.config.registration.enabled = true
+	app.config.registration.domains = parseDomains("Example.com")
+
+	rr, payload := do(t, app, http.MethodPost, "/users/register", map[string]string{
+		"username": "jane", "email": "jane@example.org", "password": "Correct-Horse-9",
+	}, nil)
+	if rr.Code != http.StatusForbidden || payload.Message != "registration is not open to this email domain" {
+		t.Fatalf("got %d %q", rr.Code, payload.Message)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestRegisterHidesDuplicateEmail makes sure a sign-up with an address that
+// is already taken gets the same answer as a new one.
+func TestRegisterHidesDuplicateEmail(t *testing.T) {
+	app, mock := newTestApp(t)
+	passwordHash(t, "unused")
+	app.config.registration.enabled = true
+	app.config.registration.domains = parseDomains(" @Example.COM ")
+
+	mock.ExpectQuery(`insert into users`).
+		WillReturnError(errors.New(`ERROR: duplicate key value violates unique constraint "users_email_key" (SQLSTATE 23505)`))
+
+	rr, payload := do(t, app, http.MethodPost, "/users/register", map[string]string{
+		"username": "jane", "email": " Jane@Example.com", "password": "Correct-Horse-9",
+	}, nil)
+	if rr.Code != http.StatusAccepted || payload.Error || payload.Message != registrationReceived {
+		t.Fatalf("got %d %q", rr.Code, payload.Message)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
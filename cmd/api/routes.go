@@ -1,6 +1,7 @@
 package main
 
 import (
+	"dss-api/internal/data"
 	"net/http"
 
 	"github.com/go-chi/chi"
@@ -10,30 +11,155 @@ import (
 
 func (app *application) routes() http.Handler {
 	mux := chi.NewRouter()
+	mux.Use(middleware.RequestID)
 	mux.Use(middleware.Recoverer)
 	mux.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"http://*", "http://*"},
+		AllowedOrigins:   app.config.corsOrigins,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		ExposedHeaders:   []string{"Link", "X-Impersonated-By", "X-Impersonated-User"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
 	mux.Post("/users/login", app.Login)
+	mux.Post("/users/login/2fa", app.LoginTOTP)
+	mux.Post("/users/login/2fa/enroll", app.EnrollTOTPAtLogin)
+	mux.Post("/users/refresh", app.Refresh)
 	mux.Post("/users/logout", app.Logout)
+	mux.Post("/users/forgot-password", app.ForgotPassword)
+	mux.Post("/users/reset-password", app.ResetPassword)
+	mux.Post("/users/verify-email", app.VerifyEmail)
+	mux.Post("/users/accept-invite", app.AcceptInvitation)
+	mux.Post("/users/register", app.Register)
+	mux.Post("/users/magic-link", app.MagicLink)
+	mux.Post("/users/passkeys/login/begin", app.BeginPasskeyLogin)
+	mux.Post("/users/passkeys/login/finish", app.FinishPasskeyLogin)
 	mux.Post("/validate-token", app.ValidateToken)
+	mux.Get("/.well-known/jwks.json", app.JWKS)
+
+	mux.Route("/me", func(r chi.Router) {
+		r.Use(app.AuthTokenMiddleware)
+
+		r.With(app.RequireScope(data.APIScopeUsersRead)).Get("/", app.GetMe)
+		r.With(app.RequireScope(data.APIScopeUsersWrite)).Put("/", app.UpdateMe)
+		r.With(app.RequireScope(data.APIScopeUsersRead)).Get("/logins", app.MyLoginHistory)
+		r.With(app.RejectAPIKeys, app.RejectImpersonation).Post("/password", app.ChangeMyPassword)
+	})
+
+	mux.Route("/users/sessions", func(r chi.Router) {
+		r.Use(app.AuthTokenMiddleware)
+
+		r.With(app.RequireScope(data.APIScopeSessionsRead)).Post("/", app.MySessions)
+		r.With(app.RequireScope(data.APIScopeSessionsWrite)).Post("/revoke/{sessionID}", app.RevokeMySession)
+	})
+
+	mux.Route("/users/2fa", func(r chi.Router) {
+		r.Use(app.AuthTokenMiddleware)
+		r.Use(app.RejectAPIKeys)
+		r.Use(app.RejectImpersonation)
+
+		r.Post("/enroll", app.EnrollTOTP)
+		r.Post("/confirm", app.ConfirmTOTP)
+	})
+
+	mux.Route("/users/api-keys", func(r chi.Router) {
+		r.Use(app.AuthTokenMiddleware)
+		r.Use(app.RejectAPIKeys)
+		r.Use(app.RejectImpersonation)
+
+		r.Post("/", app.MyAPIKeys)
+		r.Post("/create", app.CreateAPIKey)
+		r.Post("/revoke/{id}", app.RevokeAPIKey)
+	})
+
+	mux.Route("/users/passkeys", func(r chi.Router) {
+		r.Use(app.AuthTokenMiddleware)
+		r.Use(app.RejectAPIKeys)
+		r.Use(app.RejectImpersonation)
+
+		r.Post("/", app.MyPasskeys)
+		r.Post("/register/begin", app.BeginPasskeyRegistration)
+		r.Post("/register/finish", app.FinishPasskeyRegistration)
+		r.Post("/rename/{id}", app.RenamePasskey)
+		r.Post("/delete/{id}", app.DeletePasskey)
+	})
 
 	mux.Route("/admin", func(r chi.Router) {
 		r.Use(app.AuthTokenMiddleware)
 
 		// admin user routes
-		r.Post("/users", app.AllUsers)
-		r.Post("/users/save", app.EditUser)
-		r.Post("/users/get/{id}", app.GetUser)
-		r.Post("/users/delete", app.DeleteUser)
-		r.Post("/log-user-out/{id}", app.LogUserOutAndSetInactive)
+		r.Group(func(r chi.Router) {
+			r.Use(app.RequirePermission(data.PermUsersRead))
+			r.Use(app.RequireScope(data.APIScopeUsersRead))
+
+			r.Post("/users", app.AllUsers)
+			r.Post("/users/get/{id}", app.GetUser)
+			r.Post("/users/logins/{id}", app.LoginHistory)
+			r.Post("/invites", app.Invitations)
+			r.Post("/registrations", app.Registrations)
+			r.Post("/roles", app.Roles)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.RequirePermission(data.PermUsersWrite))
+			r.Use(app.RequireScope(data.APIScopeUsersWrite))
+
+			r.Post("/users/save", app.EditUser)
+			r.Post("/log-user-out/{id}", app.LogUserOutAndSetInactive)
+			r.Post("/users/verify-email/{id}", app.ResendVerification)
+			r.Post("/invites/create", app.InviteUser)
+			r.Post("/invites/resend/{id}", app.ResendInvitation)
+			r.Post("/invites/revoke/{id}", app.RevokeInvitation)
+			r.Post("/registrations/approve/{id}", app.ApproveRegistration)
+			r.Post("/registrations/reject/{id}", app.RejectRegistration)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.RequirePermission(data.PermUsersDelete))
+			r.Use(app.RequireScope(data.APIScopeUsersWrite))
+
+			r.Post("/users/delete", app.DeleteUser)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.RequirePermission(data.PermImpersonate))
+			r.Use(app.RejectAPIKeys)
+			r.Use(app.RejectImpersonation)
+
+			r.Post("/users/impersonate/{id}", app.Impersonate)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.RequirePermission(data.PermSecurityManage))
 
+			r.With(app.RequireScope(data.APIScopeUsersRead)).Post("/lockouts", app.LockoutEvents)
+			r.With(app.RequireScope(data.APIScopeUsersRead)).Post("/metrics", app.Metrics)
+
+			r.Group(func(r chi.Router) {
+				r.Use(app.RequireScope(data.APIScopeUsersWrite))
+
+				r.Post("/users/2fa/reset/{id}", app.ResetUserTOTP)
+				r.Post("/users/unlock/{id}", app.UnlockUser)
+				r.Post("/lockouts/unlock-ip", app.UnlockIP)
+			})
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.RequirePermission(data.PermSessionsManage))
+
+			r.With(app.RequireScope(data.APIScopeSessionsRead)).Post("/users/sessions/{id}", app.UserSessions)
+			r.With(app.RequireScope(data.APIScopeSessionsWrite)).Post("/users/sessions/{id}/revoke/{sessionID}", app.RevokeUserSession)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(app.RequirePermission(data.PermAuditRead))
+			r.Use(app.RequireScope(data.APIScopeAuditRead))
+
+			r.Post("/audit", app.AuditLog)
+			r.Post("/audit/export", app.ExportAuditLog)
+			r.Post("/audit/verify", app.VerifyAuditLog)
+		})
 	})
 
 	// TEST ADD A USER
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestCORSAllowsConfiguredOrigins makes sure credentialed requests, which
+// carry the session cookies, are only allowed from the configured origins.
+func TestCORSAllowsConfiguredOrigins(t *testing.T) {
+	app, _ := newTestApp(t)
+	app.config.corsOrigins = []string{"https://app.example.com"}
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://app.example.com", true},
+		{"https://evil.example.com", false},
+		{"http://app.example.com", false},
+		{"http://localhost:8080", false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodOptions, "/users/refresh", nil)
+		req.Header.Set("Origin", tt.origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		rec := httptest.NewRecorder()
+		app.routes().ServeHTTP(rec, req)
+
+		got := rec.Header().Get("Access-Control-Allow-Origin")
+		if tt.allowed && (got != tt.origin || rec.Header().Get("Access-Control-Allow-Credentials") != "true") {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, credentials %q", tt.origin, got,
+				rec.Header().Get("Access-Control-Allow-Credentials"))
+		}
+		if !tt.allowed && got != "" {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want none", tt.origin, got)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"dss-api/internal/data"
+	"errors"
 	"net/http"
 	"strconv"
 
@@ -42,49 +43,98 @@ func (app *application) GetUser(w http.ResponseWriter, r *http.Request) {
 	_ = app.writeJSON(w, http.StatusOK, user)
 }
 
+// userPayload is a user as admins send it. data.User never includes the
+// password hash in JSON, so the password of the request is read separately.
+type userPayload struct {
+	data.User
+	Password string `json:"password"`
+}
+
 func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
-	var user data.User
-	err := app.readJSON(w, r, &user)
+	var requestPayload userPayload
+	err := app.readJSON(w, r, &requestPayload)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
+	user := requestPayload.User
+	user.Password = requestPayload.Password
+
+	actor := app.contextGetUser(r)
 
 	if user.ID == 0 {
-		// Add user
-		if _, err := app.models.User.Insert(user); err != nil {
-			app.errorJSON(w, err)
+		// new users are invited and choose their own password
+		app.inviteUser(w, r, user)
+		return
+	}
+
+	// edit user
+	u, err := app.models.User.GetOne(user.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.checkUserChange(actor, u, user.Level, user.Active)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	before := auditUser(u)
+
+	// a new email only replaces the current one once it is confirmed
+	user.Email = data.NormalizeEmail(user.Email)
+	if user.Email == "" {
+		user.Email = u.Email
+	}
+	emailChanged := user.Email != u.Email && user.Email != u.PendingEmail
+	if user.Email == u.Email {
+		u.PendingEmail = ""
+	} else {
+		u.PendingEmail = user.Email
+	}
+
+	u.UserName = user.UserName
+	u.FirstName = user.FirstName
+	u.LastName = user.LastName
+	u.Active = user.Active
+	u.Level = user.Level
+
+	// reject a bad password before anything else is saved
+	if user.Password != "" {
+		if app.contextGetImpersonator(r) != nil {
+			app.errorJSON(w, errImpersonating, http.StatusForbidden)
 			return
 		}
-	} else {
-		// edit user
-		u, err := app.models.User.GetOne(user.ID)
+
+		err := data.CheckPassword(user.Password, *u)
 		if err != nil {
 			app.errorJSON(w, err)
 			return
 		}
+	}
+
+	if err := u.Update(); err != nil {
+		app.errorJSON(w, err)
+		return
+	}
 
-		u.UserName = user.UserName
-		u.Email = user.Email
-		u.FirstName = user.FirstName
-		u.LastName = user.LastName
-		u.Active = user.Active
-		u.Level = user.Level
+	if emailChanged {
+		app.sendVerificationEmail(*u, u.PendingEmail)
+	}
 
-		if err := u.Update(); err != nil {
+	// check if password != "", then update password
+	changes := auditDiff(before, auditUser(u))
+	if user.Password != "" {
+		err := u.ResetPassword(user.Password)
+		if err != nil {
 			app.errorJSON(w, err)
 			return
 		}
-
-		// check if password != "", then update password
-		if user.Password != "" {
-			err := u.ResetPassword(user.Password)
-			if err != nil {
-				app.errorJSON(w, err)
-				return
-			}
-		}
+		changes["password"] = "changed"
 	}
+	app.audit(r, actor.ID, auditUserUpdate, u.ID, "", changes)
 
 	payload := jsonResponse{
 		Error:   false,
@@ -105,11 +155,35 @@ func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	actor := app.contextGetUser(r)
+	if actor.ID == requestPayload.ID {
+		app.errorJSON(w, errors.New("you can't delete your own account"), http.StatusForbidden)
+		return
+	}
+
+	target, err := app.models.User.GetOne(requestPayload.ID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if target.Level > actor.Level {
+		app.errorJSON(w, errOutranked, http.StatusForbidden)
+		return
+	}
+
+	err = app.protectLastAdmin(target)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
 	err = app.models.User.DeleteByID(requestPayload.ID)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
+	app.audit(r, actor.ID, auditUserDelete, target.ID, "", map[string]any{"before": auditUser(target)})
 
 	payload := jsonResponse{
 		Error:   false,
@@ -118,3 +192,66 @@ func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 
 	_ = app.writeJSON(w, http.StatusOK, payload)
 }
+
+func (app *application) Roles(w http.ResponseWriter, r *http.Request) {
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"roles": data.Roles},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+var (
+	errHigherLevel = errors.New("you can't give a user a higher level than your own")
+	errOutranked   = errors.New("you can't change a user of a higher level than your own")
+)
+
+// checkUserChange makes sure actor may change target to the given level and
+// active state: nobody changes a user above their own level or raises one
+// above it, demotes or deactivates themselves, or removes the last active
+// admin.
+func (app *application) checkUserChange(actor, target *data.User, level, active int) error {
+	if target.Level > actor.Level {
+		return errOutranked
+	}
+
+	if level > actor.Level && level != target.Level {
+		return errHigherLevel
+	}
+
+	if actor.ID == target.ID {
+		if level < target.Level {
+			return errors.New("you can't lower your own level")
+		}
+		if active == 0 {
+			return errors.New("you can't deactivate your own account")
+		}
+	}
+
+	if level < data.LevelAdmin || active == 0 {
+		return app.protectLastAdmin(target)
+	}
+
+	return nil
+}
+
+// protectLastAdmin refuses to remove target's admin rights when target is
+// the only active admin left.
+func (app *application) protectLastAdmin(target *data.User) error {
+	if !target.IsAdmin() || target.Active == 0 {
+		return nil
+	}
+
+	count, err := app.models.User.CountActiveAdmins()
+	if err != nil {
+		return err
+	}
+
+	if count <= 1 {
+		return errors.New("the last active admin can't be demoted, deactivated or deleted")
+	}
+
+	return nil
+}
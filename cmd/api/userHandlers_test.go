@@ -0,0 +1,153 @@
+package main
+
+import (
+	"dss-api/internal/data"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCheckUserChange(t *testing.T) {
+	admin := &data.User{ID: 1, Active: 1, Level: data.LevelAdmin}
+	otherAdmin := &data.User{ID: 2, Active: 1, Level: data.LevelAdmin}
+	user := &data.User{ID: 3, Active: 1, Level: data.LevelUser}
+	superAdmin := &data.User{ID: 4, Active: 1, Level: 20}
+
+	tests := []struct {
+		name          string
+		actor, target *data.User
+		level, active int
+		// admins is the count of active admins, when it is looked up
+		admins int
+		want   string
+	}{
+		{"promote to manager", admin, user, data.LevelManager, 1, 0, ""},
+		{"promote to own level", admin, user, data.LevelAdmin, 1, 0, ""},
+		{"promote above own level", admin, user, 20, 1, 0, errHigherLevel.Error()},
+		{"deactivate a user", admin, user, data.LevelUser, 0, 0, ""},
+		{"edit a user of a higher level", admin, superAdmin, 20, 1, 0, errOutranked.Error()},
+		{"demote a user of a higher level", admin, superAdmin, data.LevelUser, 1, 0, errOutranked.Error()},
+		{"demote self", admin, admin, data.LevelManager, 1, 0, "you can't lower your own level"},
+		{"deactivate self", admin, admin, data.LevelAdmin, 0, 0, "you can't deactivate your own account"},
+		{"edit self", admin, admin, data.LevelAdmin, 1, 0, ""},
+		{"demote an admin", admin, otherAdmin, data.LevelUser, 1, 2, ""},
+		{"demote the last active admin", admin, otherAdmin, data.LevelUser, 1, 1,
+			"the last active admin can't be demoted, deactivated or deleted"},
+		{"deactivate the last active admin", admin, otherAdmin, data.LevelAdmin, 0, 1,
+			"the last active admin can't be demoted, deactivated or deleted"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newTestApp(t)
+			if tt.admins > 0 {
+				mock.ExpectQuery(`select count\(id\) from users where active = 1 and level >= \$1`).
+					WithArgs(data.LevelAdmin).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.admins))
+			}
+
+			err := app.checkUserChange(tt.actor, tt.target, tt.level, tt.active)
+			if got := errorString(err); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+
+			err = mock.ExpectationsWereMet()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
+
+// TestEditUserRefusesSelfDemotion demotes the signed in admin through the
+// route.
+func TestEditUserRefusesSelfDemotion(t *testing.T) {
+	app, mock := newTestApp(t)
+	header := signIn(t, app, 1, data.LevelAdmin)
+
+	admin := data.User{ID: 1, UserName: "root", Email: "root@example.com", Active: 1, Level: data.LevelAdmin}
+	mock.ExpectQuery(`from users where id = \$1`).WithArgs(1).WillReturnRows(userRows(admin))
+
+	body := map[string]any{"id": 1, "username": "root", "email": "root@example.com", "level": data.LevelUser, "active": 1}
+	rec, payload := do(t, app, http.MethodPost, "/admin/users/save", body, header)
+	if rec.Code != http.StatusForbidden || payload.Message != "you can't lower your own level" {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+
+	err := mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeleteUserRefuses(t *testing.T) {
+	tests := []struct {
+		name   string
+		target data.User
+		admins int
+		want   error
+	}{
+		{"the last active admin", data.User{ID: 2, Active: 1, Level: data.LevelAdmin}, 1,
+			errors.New("the last active admin can't be demoted, deactivated or deleted")},
+		{"a user of a higher level", data.User{ID: 2, Active: 1, Level: 20}, 0, errOutranked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newTestApp(t)
+			header := signIn(t, app, 1, data.LevelAdmin)
+
+			mock.ExpectQuery(`from users where id = \$1`).WithArgs(2).WillReturnRows(userRows(tt.target))
+			if tt.admins > 0 {
+				mock.ExpectQuery(`select count\(id\) from users`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.admins))
+			}
+
+			rec, payload := do(t, app, http.MethodPost, "/admin/users/delete", map[string]int{"id": 2}, header)
+			if rec.Code != http.StatusForbidden || payload.Message != tt.want.Error() {
+				t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+			}
+
+			err := mock.ExpectationsWereMet()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	t.Run("self", func(t *testing.T) {
+		app, _ := newTestApp(t)
+		header := signIn(t, app, 1, data.LevelAdmin)
+
+		rec, payload := do(t, app, http.MethodPost, "/admin/users/delete", map[string]int{"id": 1}, header)
+		if rec.Code != http.StatusForbidden || payload.Message != "you can't delete your own account" {
+			t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+		}
+	})
+}
+
+// TestInviteUserRefusesPassword checks that the password of a request is
+// still read, although users never carry it in JSON.
+func TestInviteUserRefusesPassword(t *testing.T) {
+	app, mock := newTestApp(t)
+	header := signIn(t, app, 1, data.LevelAdmin)
+
+	body := map[string]any{"email": "new@example.com", "level": data.LevelUser, "password": "chosen by the admin"}
+	rec, payload := do(t, app, http.MethodPost, "/admin/invites/create", body, header)
+	if !payload.Error || payload.Message != "new users choose their own password when they accept the invitation" {
+		t.Fatalf("status = %d, payload = %+v", rec.Code, payload)
+	}
+
+	err := mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
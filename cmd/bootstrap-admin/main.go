@@ -0,0 +1,71 @@
+// Command bootstrap-admin gives an installation without an active admin its
+// first one. The account to promote is named, by username or email, in
+// BOOTSTRAP_ADMIN; nothing is changed without it, and nothing is changed
+// when an active admin exists already.
+//
+//	BOOTSTRAP_ADMIN=admin@example.com DSN='...' go run ./cmd/bootstrap-admin
+//
+// An account with two-factor authentication also needs the API's
+// TOTP_ENCRYPTION_KEY.
+//
+// Further admins are made by an admin through the API.
+package main
+
+import (
+	"dss-api/internal/data"
+	"dss-api/internal/driver"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+)
+
+func main() {
+	identifier := os.Getenv("BOOTSTRAP_ADMIN")
+	if identifier == "" {
+		log.Fatal("BOOTSTRAP_ADMIN must name the account to promote")
+	}
+
+	db, err := driver.ConnectPostgres(os.Getenv("DSN"))
+	if err != nil {
+		log.Fatal("Cannot connect to database")
+	}
+	defer db.SQL.Close()
+
+	models := data.New(db.SQL)
+
+	// the account can only be read with the key its TOTP secret is sealed with
+	if encoded := os.Getenv("TOTP_ENCRYPTION_KEY"); encoded != "" {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err == nil {
+			err = data.SetTOTPKey(key)
+		}
+		if err != nil {
+			log.Fatal("TOTP_ENCRYPTION_KEY must be 32 base64 encoded bytes")
+		}
+	}
+
+	count, err := models.User.CountActiveAdmins()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if count > 0 {
+		log.Fatalf("there are %d active admins already; promote users through the API", count)
+	}
+
+	user, err := models.User.GetByLogin(identifier)
+	if err != nil {
+		log.Fatalf("no user %q: %v", identifier, err)
+	}
+	if user.Active == 0 {
+		log.Fatalf("user %q is not active", identifier)
+	}
+
+	user.Level = data.LevelAdmin
+	err = user.Update()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("promoted %s (user %d) to admin\n", user.UserName, user.ID)
+}
@@ -0,0 +1,243 @@
+// Command loadtest measures API latency and throughput under load. It has two
+// scenarios:
+//
+// The login-storm scenario measures how the latency of ordinary requests
+// holds up while the API is flooded with logins. It first probes a non-login
+// route on its own for a baseline, then probes it again while a number of
+// clients log in as fast as they can, and prints latency percentiles for both
+// phases.
+//
+//	go run ./cmd/loadtest -user admin@example.com -password '...' -logins 64
+//
+// The auth scenario logs in once and then calls an authenticated route
+// (GET /me by default) as fast as the clients can. Run it once against an API
+// started with the token cache and once with TOKEN_CACHE_SIZE=0 to compare.
+//
+//	go run ./cmd/loadtest -scenario auth -user admin@example.com -password '...'
+//
+// The login account must exist and be active, and should not use two-factor
+// authentication. Failed logins would lock out the client address, so the
+// password has to be right.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type result struct {
+	latency time.Duration
+	status  int
+}
+
+// recorder collects the results of one kind of request.
+type recorder struct {
+	mu      sync.Mutex
+	results []result
+}
+
+func (r *recorder) add(latency time.Duration, status int) {
+	r.mu.Lock()
+	r.results = append(r.results, result{latency, status})
+	r.mu.Unlock()
+}
+
+func (r *recorder) report(name string, elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.results) == 0 {
+		fmt.Printf("%-18s no requests\n", name)
+		return
+	}
+
+	latencies := make([]time.Duration, len(r.results))
+	statuses := map[int]int{}
+	for i, res := range r.results {
+		latencies[i] = res.latency
+		statuses[res.status]++
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	pct := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+
+	fmt.Printf("%-18s n=%-6d rps=%-8.1f p50=%-10s p90=%-10s p99=%-10s max=%-10s status=%v\n",
+		name, len(latencies), float64(len(latencies))/elapsed.Seconds(),
+		pct(0.50).Round(time.Microsecond), pct(0.90).Round(time.Microsecond),
+		pct(0.99).Round(time.Microsecond), latencies[len(latencies)-1].Round(time.Microsecond),
+		statuses)
+}
+
+func main() {
+	baseURL := flag.String("url", "http://localhost:8081", "base URL of the API")
+	user := flag.String("user", "", "username or email to log in with")
+	password := flag.String("password", "", "password of the login account")
+	scenario := flag.String("scenario", "login-storm", "login-storm or auth")
+	logins := flag.Int("logins", 32, "number of clients logging in concurrently")
+	probes := flag.Int("probes", 4, "number of clients calling the probe route concurrently")
+	probePath := flag.String("probe", "", "route to measure (default /.well-known/jwks.json, or /me for the auth scenario)")
+	duration := flag.Duration("duration", 20*time.Second, "length of each phase")
+	flag.Parse()
+
+	if *probePath == "" {
+		*probePath = "/.well-known/jwks.json"
+		if *scenario == "auth" {
+			*probePath = "/me"
+		}
+	}
+
+	if *user == "" || *password == "" {
+		log.Fatal("-user and -password are required")
+	}
+
+	body, err := json.Marshal(map[string]string{"username": *user, "password": *password})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: *logins + *probes,
+		},
+	}
+
+	var bearer string
+
+	probe := func(rec *recorder, stop <-chan struct{}, wg *sync.WaitGroup) {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			req, err := http.NewRequest(http.MethodGet, *baseURL+*probePath, nil)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+bearer)
+			}
+
+			start := time.Now()
+			resp, err := client.Do(req)
+			if err != nil {
+				rec.add(time.Since(start), 0)
+				continue
+			}
+			resp.Body.Close()
+			rec.add(time.Since(start), resp.StatusCode)
+		}
+	}
+
+	login := func(rec *recorder, stop <-chan struct{}, wg *sync.WaitGroup) {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			start := time.Now()
+			resp, err := client.Post(*baseURL+"/users/login", "application/json", bytes.NewReader(body))
+			if err != nil {
+				rec.add(time.Since(start), 0)
+				continue
+			}
+			resp.Body.Close()
+			rec.add(time.Since(start), resp.StatusCode)
+
+			// back off like a well behaved client when the API is saturated
+			if resp.StatusCode == http.StatusServiceUnavailable {
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+	}
+
+	run := func(withLogins bool) (*recorder, *recorder, time.Duration) {
+		probeRec, loginRec := &recorder{}, &recorder{}
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+
+		if withLogins {
+			for i := 0; i < *logins; i++ {
+				wg.Add(1)
+				go login(loginRec, stop, &wg)
+			}
+		}
+		for i := 0; i < *probes; i++ {
+			wg.Add(1)
+			go probe(probeRec, stop, &wg)
+		}
+
+		start := time.Now()
+		time.Sleep(*duration)
+		close(stop)
+		wg.Wait()
+
+		return probeRec, loginRec, time.Since(start)
+	}
+
+	if *scenario == "auth" {
+		bearer, err = accessToken(client, *baseURL, body)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("calling %s for %s with %d clients\n", *probePath, *duration, *probes)
+		authed, _, elapsed := run(false)
+		authed.report("authenticated", elapsed)
+		return
+	}
+
+	fmt.Printf("probing %s for %s without logins\n", *probePath, *duration)
+	baseline, _, elapsed := run(false)
+	baseline.report("probe (baseline)", elapsed)
+
+	fmt.Printf("probing %s for %s with %d clients logging in\n", *probePath, *duration, *logins)
+	loaded, loginRec, elapsed := run(true)
+	loaded.report("probe (loaded)", elapsed)
+	loginRec.report("login", elapsed)
+}
+
+// accessToken logs in and returns the access token of the new session.
+func accessToken(client *http.Client, baseURL string, body []byte) (string, error) {
+	resp, err := client.Post(baseURL+"/users/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var payload struct {
+		Message string `json:"message"`
+		Data    struct {
+			Token struct {
+				Token string `json:"token"`
+			} `json:"token"`
+		} `json:"data"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&payload)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK || payload.Data.Token.Token == "" {
+		return "", errors.New("login failed: " + payload.Message)
+	}
+
+	return payload.Data.Token.Token, nil
+}
@@ -0,0 +1,189 @@
+// Command passkey runs the WebAuthn ceremonies against a running API with a
+// software authenticator, so that passkey registration and login can be
+// checked end to end without a browser. It logs in with a password,
+// registers a new passkey, lists the account's passkeys, logs in with the
+// passkey (once naming the user and once letting the authenticator pick the
+// credential) and, unless -keep is given, deletes the passkey again.
+//
+//	go run ./cmd/passkey -user admin@example.com -password '...'
+//
+// The account must be allowed passkeys by PASSKEY_LEVELS and should not use
+// two-factor authentication. -origin has to be one of WEBAUTHN_ORIGINS.
+package main
+
+import (
+	"bytes"
+	"dss-api/internal/webauthn"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// client calls the API as one user.
+type client struct {
+	http    *http.Client
+	baseURL string
+	bearer  string
+}
+
+// post sends body to path and decodes the data of the response into data.
+func (c *client) post(path string, body, data any) error {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+path, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+c.bearer)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var payload struct {
+		Error   bool            `json:"error"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%s: %d: %w", path, resp.StatusCode, err)
+	}
+
+	if payload.Error || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %d: %s", path, resp.StatusCode, payload.Message)
+	}
+
+	if data == nil || len(payload.Data) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(payload.Data, data)
+}
+
+// session is the data of a successful login.
+type session struct {
+	Token struct {
+		Token string `json:"token"`
+	} `json:"token"`
+	User struct {
+		ID       int    `json:"id"`
+		UserName string `json:"username"`
+	} `json:"user"`
+}
+
+type passkey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func main() {
+	baseURL := flag.String("url", "http://localhost:8081", "base URL of the API")
+	user := flag.String("user", "", "username or email to log in with")
+	password := flag.String("password", "", "password of the login account")
+	origin := flag.String("origin", "http://localhost:8080", "origin the ceremonies claim to come from")
+	name := flag.String("name", "software authenticator", "name of the new passkey")
+	keep := flag.Bool("keep", false, "keep the passkey instead of deleting it at the end")
+	flag.Parse()
+
+	if *user == "" || *password == "" {
+		log.Fatal("-user and -password are required")
+	}
+
+	authenticator := webauthn.NewAuthenticator()
+	api := &client{http: &http.Client{Timeout: 30 * time.Second}, baseURL: *baseURL}
+
+	var login session
+	err := api.post("/users/login", map[string]string{"username": *user, "password": *password}, &login)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if login.Token.Token == "" {
+		log.Fatal("password login did not return a token; is two-factor authentication on?")
+	}
+	api.bearer = login.Token.Token
+	fmt.Printf("logged in with password as %s (user %d)\n", login.User.UserName, login.User.ID)
+
+	var creation struct {
+		Options webauthn.CreationOptions `json:"options"`
+	}
+	err = api.post("/users/passkeys/register/begin", struct{}{}, &creation)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	attestation, err := authenticator.Create(*origin, &creation.Options)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var registered struct {
+		Passkey passkey `json:"passkey"`
+	}
+	err = api.post("/users/passkeys/register/finish", map[string]any{"name": *name, "credential": attestation}, &registered)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("registered passkey %d %q\n", registered.Passkey.ID, registered.Passkey.Name)
+
+	var list struct {
+		Passkeys []passkey `json:"passkeys"`
+	}
+	err = api.post("/users/passkeys", struct{}{}, &list)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("account has %d passkeys\n", len(list.Passkeys))
+
+	// log in twice: naming the user, then with a discoverable credential
+	public := &client{http: api.http, baseURL: *baseURL}
+	for _, username := range []string{*user, ""} {
+		var request struct {
+			Options webauthn.RequestOptions `json:"options"`
+		}
+		err = public.post("/users/passkeys/login/begin", map[string]string{"username": username}, &request)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		assertion, err := authenticator.Get(*origin, &request.Options)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var passkeyLogin session
+		err = public.post("/users/passkeys/login/finish", map[string]any{"credential": assertion}, &passkeyLogin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if passkeyLogin.User.ID != login.User.ID || passkeyLogin.Token.Token == "" {
+			log.Fatalf("passkey login returned user %d without the expected session", passkeyLogin.User.ID)
+		}
+
+		fmt.Printf("logged in with passkey (%d allowed credentials)\n", len(request.Options.AllowCredentials))
+	}
+
+	if *keep {
+		return
+	}
+
+	err = api.post("/users/passkeys/delete/"+strconv.Itoa(registered.Passkey.ID), struct{}{}, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("deleted passkey %d\n", registered.Passkey.ID)
+}
@@ -0,0 +1,215 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+// APIKeyPrefix starts every API key, so that leaked keys are easy to spot
+// for secret scanners.
+const APIKeyPrefix = "dss_pat_"
+
+// API key scopes, checked per route.
+const (
+	APIScopeUsersRead     = "users:read"
+	APIScopeUsersWrite    = "users:write"
+	APIScopeSessionsRead  = "sessions:read"
+	APIScopeSessionsWrite = "sessions:write"
+	APIScopeAuditRead     = "audit:read"
+)
+
+// APIScopes lists every scope a key can be given.
+var APIScopes = []string{APIScopeUsersRead, APIScopeUsersWrite, APIScopeSessionsRead, APIScopeSessionsWrite, APIScopeAuditRead}
+
+// apiKeyLastUsedInterval limits how often using a key writes its last used
+// time.
+const apiKeyLastUsedInterval = time.Minute
+
+var ErrInvalidAPIKey = errors.New("invalid, expired or revoked api key")
+
+// HasScope reports whether the key was given scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// START CRUD API KEYS
+// Generate creates a new key for the user. The plain text key is only set on
+// the returned value; the database keeps its hash.
+func (k *APIKey) Generate(userID int, name string, scopes []string, ttl time.Duration) (*APIKey, error) {
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	plainText := APIKeyPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+
+	key := &APIKey{
+		UserID: userID,
+		Name:   name,
+		Key:    plainText,
+		Prefix: plainText[:len(APIKeyPrefix)+4],
+		Scopes: scopes,
+	}
+
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		key.ExpiresAt = &expiresAt
+	}
+
+	return key, nil
+}
+
+// Insert stores a key generated by Generate.
+func (k *APIKey) Insert(key *APIKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	stmt := `insert into api_keys(user_id, name, prefix, key_hash, scopes, expires_at, created_at)
+		values($1, $2, $3, $4, $5, $6, $7) returning id, created_at`
+
+	return db.QueryRowContext(ctx, stmt,
+		key.UserID,
+		key.Name,
+		key.Prefix,
+		hashToken(key.Key),
+		strings.Join(key.Scopes, " "),
+		key.ExpiresAt,
+		time.Now(),
+	).Scan(&key.ID, &key.CreatedAt)
+}
+
+// GetAllForUser lists the keys of a user, newest first.
+func (k *APIKey) GetAllForUser(userID int) ([]*APIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	query := `select id, user_id, name, prefix, scopes, last_used_at, expires_at, created_at
+		from api_keys where user_id = $1 order by created_at desc`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+		err := scanAPIKey(rows, &key)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	return keys, rows.Err()
+}
+
+// Delete revokes a key of the user. sql.ErrNoRows is returned when the user
+// has no such key.
+func (k *APIKey) Delete(userID, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `delete from api_keys where id = $1 and user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// DeleteAll revokes every key of the user.
+func (k *APIKey) DeleteAll(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `delete from api_keys where user_id = $1`, userID)
+
+	return err
+}
+
+// END CRUD API KEYS
+
+// START AUTHENTICATE API KEY
+// Authenticate returns a key and its user for the plain text key, and records
+// when the key was last used.
+func (k *APIKey) Authenticate(plainText string) (*APIKey, *User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	query := `select id, user_id, name, prefix, scopes, last_used_at, expires_at, created_at
+		from api_keys where key_hash = $1`
+
+	var key APIKey
+	err := scanAPIKey(db.QueryRowContext(ctx, query, hashToken(plainText)), &key)
+	if err != nil {
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	if key.ExpiresAt != nil && key.ExpiresAt.Before(time.Now()) {
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	var t Token
+	user, err := t.GetUserForToken(Token{UserID: key.UserID})
+	if err != nil || user.Active == 0 {
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) >= apiKeyLastUsedInterval {
+		_, err = db.ExecContext(ctx, `update api_keys set last_used_at = $1 where id = $2`, time.Now(), key.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return &key, user, nil
+}
+
+// END AUTHENTICATE API KEY
+
+func scanAPIKey(row interface{ Scan(...any) error }, key *APIKey) error {
+	var scopes string
+
+	err := row.Scan(
+		&key.ID,
+		&key.UserID,
+		&key.Name,
+		&key.Prefix,
+		&scopes,
+		&key.LastUsedAt,
+		&key.ExpiresAt,
+		&key.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	key.Scopes = strings.Fields(scopes)
+
+	return nil
+}
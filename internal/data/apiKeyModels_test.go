@@ -0,0 +1,79 @@
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// apiKeyColumnNames are the columns scanAPIKey reads, in order.
+var apiKeyColumnNames = []string{"id", "user_id", "name", "prefix", "scopes", "last_used_at", "expires_at", "created_at"}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	const plainText = APIKeyPrefix + "abcdefghijklmnopqrstuvwxyz234567"
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	recently := time.Now().Add(-10 * time.Second)
+	active := User{ID: 7, UserName: "jane", Email: "jane@example.com", Active: 1, Level: LevelUser}
+	inactive := active
+	inactive.Active = 0
+
+	tests := []struct {
+		name       string
+		lastUsedAt *time.Time
+		expiresAt  *time.Time
+		user       *User
+		// recorded says whether the last used time is written
+		recorded bool
+		want     error
+	}{
+		{"first use", nil, nil, &active, true, nil},
+		{"used a while ago", &past, &future, &active, true, nil},
+		{"used within the last minute", &recently, nil, &active, false, nil},
+		{"expired", nil, &past, nil, false, ErrInvalidAPIKey},
+		{"inactive user", nil, nil, &inactive, false, ErrInvalidAPIKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDB(t)
+
+			mock.ExpectQuery(`from api_keys where key_hash = \$1`).WithArgs(hashToken(plainText)).
+				WillReturnRows(sqlmock.NewRows(apiKeyColumnNames).
+					AddRow(3, 7, "ci", plainText[:len(APIKeyPrefix)+4], "users:read", tt.lastUsedAt, tt.expiresAt, past))
+			if tt.user != nil {
+				mock.ExpectQuery(`from users where id = \$1`).WithArgs(7).WillReturnRows(userRows(*tt.user))
+			}
+			if tt.recorded {
+				mock.ExpectExec(`update api_keys set last_used_at = \$1 where id = \$2`).WithArgs(sqlmock.AnyArg(), 3).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			key, user, err := (&APIKey{}).Authenticate(plainText)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if tt.want == nil && (key.ID != 3 || user.ID != 7 || !key.HasScope(APIScopeUsersRead)) {
+				t.Errorf("key = %+v, user = %+v", key, user)
+			}
+
+			err = mock.ExpectationsWereMet()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestAuthenticateUnknownAPIKey(t *testing.T) {
+	mock := newMockDB(t)
+
+	mock.ExpectQuery(`from api_keys where key_hash = \$1`).WillReturnRows(sqlmock.NewRows(apiKeyColumnNames))
+
+	_, _, err := (&APIKey{}).Authenticate(APIKeyPrefix + "unknown")
+	if !errors.Is(err, ErrInvalidAPIKey) {
+		t.Errorf("err = %v, want %v", err, ErrInvalidAPIKey)
+	}
+}
@@ -0,0 +1,321 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditLockID is the advisory lock that serialises appends to the audit log,
+// so that every entry is chained to the one committed right before it.
+const auditLockID = 7301
+
+// auditExportTimeout bounds how long exporting or verifying the whole audit
+// log may take.
+const auditExportTimeout = 5 * time.Minute
+
+// AuditFilter selects audit entries. Zero fields match everything.
+type AuditFilter struct {
+	ActorID        *int
+	ImpersonatorID *int
+	TargetID       *int
+	Action         string
+	From           *time.Time
+	To             *time.Time
+	Limit          int
+}
+
+// AuditVerification is the result of checking the audit log's hash chain.
+// BrokenAt is the id of the first entry that doesn't match its hash or its
+// predecessor, or zero if the chain is intact.
+type AuditVerification struct {
+	Checked  int   `json:"checked"`
+	BrokenAt int64 `json:"broken_at,omitempty"`
+	Valid    bool  `json:"valid"`
+}
+
+// START AUDIT LOG
+// Insert appends an entry to the audit log. Changes is stored as JSON.
+func (a *AuditEntry) Insert(entry AuditEntry, changes any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	if changes != nil {
+		raw, err := json.Marshal(changes)
+		if err != nil {
+			return err
+		}
+		entry.Changes = raw
+	}
+
+	// postgres keeps microseconds, and the hash has to survive the round trip
+	entry.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	entry.UserAgent = truncate(entry.UserAgent, 255)
+	entry.RequestID = truncate(entry.RequestID, 255)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `select pg_advisory_xact_lock($1)`, auditLockID)
+	if err != nil {
+		return err
+	}
+
+	var prevHash []byte
+	err = tx.QueryRowContext(ctx, `select hash from audit_log order by id desc limit 1`).Scan(&prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	// the first entry is chained to an empty hash
+	if prevHash == nil {
+		prevHash = []byte{}
+	}
+	hash := auditHash(prevHash, entry)
+
+	stmt := `insert into audit_log(actor_id, impersonator_id, action, target_id, target, changes, ip, user_agent, request_id, created_at, prev_hash, hash)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+
+	_, err = tx.ExecContext(ctx, stmt,
+		entry.ActorID,
+		entry.ImpersonatorID,
+		entry.Action,
+		entry.TargetID,
+		entry.Target,
+		string(entry.Changes),
+		entry.IP,
+		entry.UserAgent,
+		entry.RequestID,
+		entry.CreatedAt,
+		prevHash,
+		hash,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetAll returns the entries matching filter, newest first.
+func (a *AuditEntry) GetAll(filter AuditFilter) ([]*AuditEntry, error) {
+	entries := []*AuditEntry{}
+
+	err := a.Each(filter, false, func(entry *AuditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Each calls fn for every entry matching filter, oldest first when ascending
+// is true and newest first otherwise, without loading them all at once.
+func (a *AuditEntry) Each(filter AuditFilter, ascending bool, fn func(*AuditEntry) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), auditExportTimeout)
+	defer cancel()
+
+	var where []string
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, strings.Replace(cond, "?", "$"+strconv.Itoa(len(args)), 1))
+	}
+
+	if filter.ActorID != nil {
+		add("actor_id = ?", *filter.ActorID)
+	}
+	if filter.ImpersonatorID != nil {
+		add("impersonator_id = ?", *filter.ImpersonatorID)
+	}
+	if filter.TargetID != nil {
+		add("target_id = ?", *filter.TargetID)
+	}
+	if filter.Action != "" {
+		add("action = ?", filter.Action)
+	}
+	if filter.From != nil {
+		add("created_at >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		add("created_at < ?", *filter.To)
+	}
+
+	query := `select ` + auditColumns + ` from audit_log`
+	if len(where) > 0 {
+		query += " where " + strings.Join(where, " and ")
+	}
+	if ascending {
+		query += " order by id"
+	} else {
+		query += " order by id desc"
+	}
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += " limit $" + strconv.Itoa(len(args))
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, _, _, err := scanAuditEntry(rows)
+		if err != nil {
+			return err
+		}
+
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Verify walks the whole audit log and checks every entry against its hash
+// and its predecessor.
+func (a *AuditEntry) Verify() (*AuditVerification, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), auditExportTimeout)
+	defer cancel()
+
+	query := `select ` + auditColumns + ` from audit_log order by id`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := &AuditVerification{Valid: true}
+	var last []byte
+
+	for rows.Next() {
+		entry, prevHash, hash, err := scanAuditEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		result.Checked++
+
+		if !bytes.Equal(prevHash, last) || !bytes.Equal(hash, auditHash(prevHash, *entry)) {
+			result.Valid = false
+			result.BrokenAt = entry.ID
+			break
+		}
+
+		last = hash
+	}
+
+	return result, rows.Err()
+}
+
+// auditColumns lists the audit_log columns in the order scanAuditEntry reads
+// them.
+const auditColumns = `id, actor_id, impersonator_id, action, target_id, target, changes, ip, user_agent, request_id,
+	created_at, prev_hash, hash`
+
+func scanAuditEntry(rows *sql.Rows) (*AuditEntry, []byte, []byte, error) {
+	var entry AuditEntry
+	var changes string
+	var prevHash, hash []byte
+
+	err := rows.Scan(
+		&entry.ID,
+		&entry.ActorID,
+		&entry.ImpersonatorID,
+		&entry.Action,
+		&entry.TargetID,
+		&entry.Target,
+		&changes,
+		&entry.IP,
+		&entry.UserAgent,
+		&entry.RequestID,
+		&entry.CreatedAt,
+		&prevHash,
+		&hash,
+	)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if changes != "" {
+		entry.Changes = json.RawMessage(changes)
+	}
+	entry.CreatedAt = entry.CreatedAt.UTC()
+	entry.PrevHash = hex.EncodeToString(prevHash)
+	entry.Hash = hex.EncodeToString(hash)
+
+	return &entry, prevHash, hash, nil
+}
+
+// auditHash hashes an entry together with the hash of the entry before it.
+// The id is left out, since it is only known after the insert; the chain
+// itself fixes the order. The impersonator is only hashed when there is one,
+// so that entries written before it was recorded keep their hashes.
+func auditHash(prevHash []byte, entry AuditEntry) []byte {
+	fields := struct {
+		PrevHash       string `json:"prev_hash"`
+		ActorID        *int   `json:"actor_id"`
+		ImpersonatorID *int   `json:"impersonator_id,omitempty"`
+		Action         string `json:"action"`
+		TargetID       *int   `json:"target_id"`
+		Target         string `json:"target"`
+		Changes        string `json:"changes"`
+		IP             string `json:"ip"`
+		UserAgent      string `json:"user_agent"`
+		RequestID      string `json:"request_id"`
+		CreatedAt      string `json:"created_at"`
+	}{
+		PrevHash:       hex.EncodeToString(prevHash),
+		ActorID:        entry.ActorID,
+		ImpersonatorID: entry.ImpersonatorID,
+		Action:         entry.Action,
+		TargetID:       entry.TargetID,
+		Target:         entry.Target,
+		Changes:        string(entry.Changes),
+		IP:             entry.IP,
+		UserAgent:      entry.UserAgent,
+		RequestID:      entry.RequestID,
+		CreatedAt:      entry.CreatedAt.UTC().Format(time.RFC3339Nano),
+	}
+
+	// marshalling a struct can't fail
+	raw, _ := json.Marshal(fields)
+	sum := sha256.Sum256(raw)
+
+	return sum[:]
+}
+
+// truncate shortens s to at most n characters, as varchar columns count
+// them, without splitting a character. Invalid UTF-8, which postgres
+// refuses, is replaced first.
+func truncate(s string, n int) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+
+	count := 0
+	for i := range s {
+		if count == n {
+			return s[:i]
+		}
+		count++
+	}
+
+	return s
+}
+
+// END AUDIT LOG
@@ -0,0 +1,173 @@
+package data
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"curl/8.0", 255, "curl/8.0"},
+		{"abcdef", 3, "abc"},
+		{"äöü", 3, "äöü"},
+		{"äöüß", 3, "äöü"},
+		{"a😀b", 2, "a😀"},
+		{"ab\xffcd", 4, "ab�c"},
+		{"", 3, ""},
+	}
+
+	for _, tt := range tests {
+		got := truncate(tt.s, tt.n)
+		if got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) is not valid UTF-8", tt.s, tt.n)
+		}
+	}
+}
+
+func TestAuditInsertChainsEntries(t *testing.T) {
+	mock := newMockDB(t)
+
+	prev := auditHash([]byte{}, AuditEntry{Action: "user.create"})
+	createdAt, prevHash, hash := &capture{}, &capture{}, &capture{}
+	userAgent := &capture{}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`select pg_advisory_xact_lock\(\$1\)`).WithArgs(auditLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`select hash from audit_log order by id desc limit 1`).
+		WillReturnRows(sqlmock.NewRows([]string{"hash"}).AddRow(prev))
+	mock.ExpectExec(`insert into audit_log`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "user.update", sqlmock.AnyArg(), "", `{"level":[1,10]}`,
+			"192.0.2.1", userAgent, "req-1", createdAt, prevHash, hash).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectCommit()
+
+	actor, target := 1, 7
+	entry := AuditEntry{
+		ActorID:   &actor,
+		Action:    "user.update",
+		TargetID:  &target,
+		IP:        "192.0.2.1",
+		UserAgent: strings.Repeat("ü", 300),
+		RequestID: "req-1",
+	}
+
+	err := entry.Insert(entry, map[string][2]int{"level": {1, 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := userAgent.value.(string); got != strings.Repeat("ü", 255) {
+		t.Errorf("user agent of %d characters stored", utf8.RuneCountInString(got))
+	}
+	if got := prevHash.value.([]byte); hex.EncodeToString(got) != hex.EncodeToString(prev) {
+		t.Errorf("chained to %x, want %x", got, prev)
+	}
+
+	entry.UserAgent = userAgent.value.(string)
+	entry.Changes = []byte(`{"level":[1,10]}`)
+	entry.CreatedAt = createdAt.value.(time.Time)
+	if got, want := hash.value.([]byte), auditHash(prev, entry); hex.EncodeToString(got) != hex.EncodeToString(want) {
+		t.Errorf("hash = %x, want %x", got, want)
+	}
+}
+
+// auditChain returns n chained entries as stored, with their hashes.
+func auditChain(n int) ([]AuditEntry, [][]byte, [][]byte) {
+	entries := make([]AuditEntry, n)
+	prevHashes := make([][]byte, n)
+	hashes := make([][]byte, n)
+
+	prev := []byte{}
+	for i := range entries {
+		actor := i + 1
+		entries[i] = AuditEntry{
+			ID:        int64(i + 1),
+			ActorID:   &actor,
+			Action:    "user.update",
+			Changes:   []byte(`{"active":[1,0]}`),
+			IP:        "192.0.2.1",
+			UserAgent: "curl/8.0",
+			CreatedAt: time.Date(2024, 1, 1, 0, 0, i, 123000, time.UTC),
+		}
+		prevHashes[i] = prev
+		hashes[i] = auditHash(prev, entries[i])
+		prev = hashes[i]
+	}
+
+	return entries, prevHashes, hashes
+}
+
+func auditRows(entries []AuditEntry, prevHashes, hashes [][]byte) *sqlmock.Rows {
+	rows := sqlmock.NewRows(strings.Fields(strings.ReplaceAll(auditColumns, ",", " ")))
+	for i, e := range entries {
+		rows.AddRow(e.ID, e.ActorID, e.ImpersonatorID, e.Action, e.TargetID, e.Target, string(e.Changes), e.IP,
+			e.UserAgent, e.RequestID, e.CreatedAt, prevHashes[i], hashes[i])
+	}
+
+	return rows
+}
+
+func TestAuditVerify(t *testing.T) {
+	tests := []struct {
+		name     string
+		tamper   func(entries []AuditEntry, prevHashes, hashes [][]byte)
+		valid    bool
+		brokenAt int64
+		checked  int
+	}{
+		{"intact", func([]AuditEntry, [][]byte, [][]byte) {}, true, 0, 4},
+		{"edited entry", func(e []AuditEntry, _, _ [][]byte) { e[2].Action = "user.delete" }, false, 3, 3},
+		{"edited time", func(e []AuditEntry, _, _ [][]byte) { e[1].CreatedAt = e[1].CreatedAt.Add(time.Second) }, false, 2, 2},
+		{"rehashed entry", func(e []AuditEntry, p, h [][]byte) {
+			// recomputing the hash of an edited entry breaks the link to the next
+			e[1].IP = "203.0.113.9"
+			h[1] = auditHash(p[1], e[1])
+		}, false, 3, 3},
+		{"deleted entry", func(e []AuditEntry, p, h [][]byte) {
+			// the second entry is replaced by the third
+			e[1], p[1], h[1] = e[2], p[2], h[2]
+		}, false, 3, 2},
+		{"first entry not chained to nothing", func(e []AuditEntry, p, h [][]byte) {
+			p[0] = []byte{1}
+			h[0] = auditHash(p[0], e[0])
+		}, false, 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDB(t)
+
+			entries, prevHashes, hashes := auditChain(4)
+			tt.tamper(entries, prevHashes, hashes)
+
+			mock.ExpectQuery(`select .* from audit_log order by id`).WillReturnRows(auditRows(entries, prevHashes, hashes))
+
+			var a AuditEntry
+			result, err := a.Verify()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result.Valid != tt.valid || result.BrokenAt != tt.brokenAt || result.Checked != tt.checked {
+				t.Errorf("result = %+v, want valid %v, broken at %d after %d", *result, tt.valid, tt.brokenAt, tt.checked)
+			}
+		})
+	}
+}
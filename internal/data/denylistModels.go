@@ -0,0 +1,113 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// RevocationRetention is how long a revocation stays on the denylist. It only
+// has to outlive the signed access tokens issued before the revocation.
+var RevocationRetention = time.Hour
+
+// signingKeyLockID is the advisory lock that lets one API instance at a time
+// create or rotate the JWT signing keys of a shared key directory.
+const signingKeyLockID = 7302
+
+// WithSigningKeyLock runs fn while holding the signing key lock, waiting for
+// any other instance holding it. The lock is released when fn returns.
+func WithSigningKeyLock(fn func() error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `select pg_advisory_xact_lock($1)`, signingKeyLockID)
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SessionSubject and UserSubject name what a revocation applies to.
+func SessionSubject(id string) string { return "sid:" + id }
+func UserSubject(id int) string       { return fmt.Sprintf("uid:%d", id) }
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// revocationHook is told about every revocation this instance makes.
+var revocationHook = func(subject string, revokedAt time.Time) {}
+
+// SetRevocationHook registers fn to be called with every revocation this
+// instance makes, so that it takes effect here without waiting for the
+// revocations table to be read again. fn is called before the surrounding
+// transaction commits, and so may see a revocation that is rolled back.
+func SetRevocationHook(fn func(subject string, revokedAt time.Time)) {
+	revocationHook = fn
+}
+
+// revoke puts subject on the denylist. Signed access tokens of the subject
+// issued up to now are refused from then on, and cached lookups of its
+// opaque tokens are dropped.
+func revoke(ctx context.Context, exec execer, subject string) error {
+	stmt := `insert into revocations(subject, revoked_at, expires_at) values($1, $2, $3)
+		on conflict (subject) do update set revoked_at = excluded.revoked_at, expires_at = excluded.expires_at`
+
+	now := time.Now()
+	_, err := exec.ExecContext(ctx, stmt, subject, now, now.Add(RevocationRetention))
+	if err != nil {
+		return err
+	}
+
+	revocationHook(subject, now)
+
+	return invalidateTokens(ctx, exec, subject)
+}
+
+// START DENYLIST
+// GetActive returns the revocations that have not expired yet, after pruning
+// the ones that have.
+func (r *Revocation) GetActive() ([]*Revocation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `delete from revocations where expires_at < $1`, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `select subject, revoked_at, expires_at from revocations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revocations := []*Revocation{}
+
+	for rows.Next() {
+		var revocation Revocation
+		err := rows.Scan(&revocation.Subject, &revocation.RevokedAt, &revocation.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+
+		revocations = append(revocations, &revocation)
+	}
+
+	return revocations, rows.Err()
+}
+
+// END DENYLIST
@@ -0,0 +1,41 @@
+package data
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestWithSigningKeyLock(t *testing.T) {
+	mock := newMockDB(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`select pg_advisory_xact_lock\(\$1\)`).WithArgs(signingKeyLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	ran := false
+	err := WithSigningKeyLock(func() error {
+		ran = true
+		return nil
+	})
+	if err != nil || !ran {
+		t.Fatalf("ran = %v, err = %v", ran, err)
+	}
+
+	// a failure of fn releases the lock and is returned
+	failed := errors.New("no space left on device")
+	mock.ExpectBegin()
+	mock.ExpectExec(`select pg_advisory_xact_lock\(\$1\)`).WithArgs(signingKeyLockID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err = WithSigningKeyLock(func() error { return failed })
+	if !errors.Is(err, failed) {
+		t.Errorf("err = %v, want %v", err, failed)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
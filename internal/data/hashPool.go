@@ -0,0 +1,147 @@
+package data
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrHashPoolBusy is returned when a password could not be hashed or checked
+// because every hashing slot stayed busy for the whole queue timeout.
+var ErrHashPoolBusy = errors.New("too many password checks in progress, try again later")
+
+// hashPool bounds how many password hashes are computed at once, so that a
+// burst of logins cannot take every CPU from the rest of the API. Callers
+// that can't get a slot within the queue timeout give up with
+// ErrHashPoolBusy.
+type hashPool struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+
+	queued   atomic.Int64
+	running  atomic.Int64
+	done     atomic.Int64
+	rejected atomic.Int64
+
+	mu      sync.Mutex
+	waitSum time.Duration
+	waitMax time.Duration
+	hashSum time.Duration
+	hashMax time.Duration
+}
+
+// HashPoolStats describes the hashing pool. Durations are in milliseconds.
+type HashPoolStats struct {
+	Workers        int     `json:"workers"`
+	QueueTimeoutMS float64 `json:"queue_timeout_ms"`
+	Queued         int64   `json:"queued"`
+	Running        int64   `json:"running"`
+	Completed      int64   `json:"completed"`
+	Rejected       int64   `json:"rejected"`
+	AvgWaitMS      float64 `json:"avg_wait_ms"`
+	MaxWaitMS      float64 `json:"max_wait_ms"`
+	AvgHashMS      float64 `json:"avg_hash_ms"`
+	MaxHashMS      float64 `json:"max_hash_ms"`
+}
+
+var passwordPool = newHashPool(runtime.NumCPU(), 2*time.Second)
+
+func newHashPool(workers int, queueTimeout time.Duration) *hashPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &hashPool{
+		slots:        make(chan struct{}, workers),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// SetHashPool configures how many password hashes may be computed at once
+// and how long a caller waits for a free slot.
+func SetHashPool(workers int, queueTimeout time.Duration) {
+	passwordPool = newHashPool(workers, queueTimeout)
+}
+
+// HashPoolQueueTimeout returns how long callers wait for a hashing slot.
+func HashPoolQueueTimeout() time.Duration {
+	return passwordPool.queueTimeout
+}
+
+// GetHashPoolStats returns the current state of the hashing pool.
+func GetHashPoolStats() HashPoolStats {
+	return passwordPool.stats()
+}
+
+// run calls fn once a slot is free, or returns ErrHashPoolBusy if none frees
+// up within the queue timeout.
+func (p *hashPool) run(fn func()) error {
+	start := time.Now()
+
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		p.queued.Add(1)
+		timer := time.NewTimer(p.queueTimeout)
+		select {
+		case p.slots <- struct{}{}:
+			timer.Stop()
+			p.queued.Add(-1)
+		case <-timer.C:
+			p.queued.Add(-1)
+			p.rejected.Add(1)
+			return ErrHashPoolBusy
+		}
+	}
+
+	waited := time.Since(start)
+	p.running.Add(1)
+	defer func() {
+		hashed := time.Since(start) - waited
+		p.running.Add(-1)
+		<-p.slots
+
+		p.mu.Lock()
+		p.done.Add(1)
+		p.waitSum += waited
+		p.hashSum += hashed
+		if waited > p.waitMax {
+			p.waitMax = waited
+		}
+		if hashed > p.hashMax {
+			p.hashMax = hashed
+		}
+		p.mu.Unlock()
+	}()
+
+	fn()
+	return nil
+}
+
+func (p *hashPool) stats() HashPoolStats {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+	s := HashPoolStats{
+		Workers:        cap(p.slots),
+		QueueTimeoutMS: ms(p.queueTimeout),
+		Queued:         p.queued.Load(),
+		Running:        p.running.Load(),
+		Rejected:       p.rejected.Load(),
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s.Completed = p.done.Load()
+
+	if s.Completed > 0 {
+		s.AvgWaitMS = ms(p.waitSum) / float64(s.Completed)
+		s.AvgHashMS = ms(p.hashSum) / float64(s.Completed)
+	}
+	s.MaxWaitMS = ms(p.waitMax)
+	s.MaxHashMS = ms(p.hashMax)
+
+	return s
+}
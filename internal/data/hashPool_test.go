@@ -0,0 +1,158 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHashPoolRejectsWhenSaturated(t *testing.T) {
+	pool := newHashPool(1, 20*time.Millisecond)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- pool.run(func() {
+			close(started)
+			<-release
+		})
+	}()
+	<-started
+
+	start := time.Now()
+	err := pool.run(func() { t.Error("ran without a free slot") })
+	if !errors.Is(err, ErrHashPoolBusy) {
+		t.Fatalf("err = %v, want %v", err, ErrHashPoolBusy)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("gave up after %s, before the queue timeout", waited)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// the freed slot is taken again
+	ran := false
+	err = pool.run(func() { ran = true })
+	if err != nil || !ran {
+		t.Fatalf("after release: ran = %v, err = %v", ran, err)
+	}
+
+	s := pool.stats()
+	if s.Completed != 2 || s.Rejected != 1 || s.Queued != 0 || s.Running != 0 {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+func TestHashPoolBoundsConcurrency(t *testing.T) {
+	pool := newHashPool(3, time.Minute)
+
+	var mu sync.Mutex
+	running, peak := 0, 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := pool.run(func() {
+				mu.Lock()
+				running++
+				if running > peak {
+					peak = running
+				}
+				mu.Unlock()
+
+				time.Sleep(2 * time.Millisecond)
+
+				mu.Lock()
+				running--
+				mu.Unlock()
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak != 3 {
+		t.Errorf("%d hashes ran at once, want 3", peak)
+	}
+}
+
+// benchHasher is a light argon2id configuration, so that the benchmark
+// measures queueing in the pool rather than memory bandwidth.
+var benchHasher = Argon2idHasher{Memory: 8 * 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+// BenchmarkHashPool hashes passwords through a pool of one worker per CPU
+// with an increasing number of concurrent callers, and reports percentiles
+// of the time spent waiting for a slot and of the whole call:
+//
+//	go test ./internal/data -run '^$' -bench HashPool
+func BenchmarkHashPool(b *testing.B) {
+	workers := runtime.NumCPU()
+
+	for _, perWorker := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("callers-per-worker=%d", perWorker), func(b *testing.B) {
+			pool := newHashPool(workers, 2*time.Second)
+
+			var mu sync.Mutex
+			var waits, latencies []time.Duration
+			var rejected int
+
+			b.SetParallelism(max(1, perWorker*workers/runtime.GOMAXPROCS(0)))
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					start := time.Now()
+					var waited time.Duration
+
+					err := pool.run(func() {
+						waited = time.Since(start)
+						_, _ = benchHasher.Hash("correct horse battery staple")
+					})
+					latency := time.Since(start)
+
+					mu.Lock()
+					if err != nil {
+						rejected++
+					} else {
+						waits = append(waits, waited)
+						latencies = append(latencies, latency)
+					}
+					mu.Unlock()
+				}
+			})
+
+			b.StopTimer()
+
+			for _, p := range []float64{50, 90, 99} {
+				b.ReportMetric(percentileMS(waits, p), fmt.Sprintf("wait-p%.0f-ms", p))
+			}
+			for _, p := range []float64{50, 90, 99} {
+				b.ReportMetric(percentileMS(latencies, p), fmt.Sprintf("latency-p%.0f-ms", p))
+			}
+			b.ReportMetric(float64(rejected), "rejected")
+		})
+	}
+}
+
+// percentileMS returns the p-th percentile of durations in milliseconds.
+func percentileMS(durations []time.Duration, p float64) float64 {
+	if len(durations) == 0 {
+		return 0
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	i := int(p / 100 * float64(len(durations)-1))
+
+	return float64(durations[i]) / float64(time.Millisecond)
+}
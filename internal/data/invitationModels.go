@@ -0,0 +1,155 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// pendingInvitation selects invited users who haven't accepted yet.
+const pendingInvitation = `invited_at is not null and invitation_accepted_at is null`
+
+// START INVITATIONS
+// Insert creates an inactive user without a password, invited by the user
+// invitedBy. They get a password by accepting the invitation.
+func (i *Invitation) Insert(user User, invitedBy int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	var newID int
+	stmt := `
+	insert into users(username, email, first_name, last_name, password, active, level, created_at, updated_at, invited_by, invited_at)
+	values ($1, $2, $3, $4, '', 0, $5, $6, $6, $7, $6) returning id
+	`
+
+	err := db.QueryRowContext(ctx, stmt,
+		strings.TrimSpace(user.UserName),
+		NormalizeEmail(user.Email),
+		user.FirstName,
+		user.LastName,
+		user.Level,
+		time.Now(),
+		invitedBy,
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetAllPending returns the invitations not accepted yet, newest first, with
+// the expiry of their latest link. Expiry is nil when no link was stored.
+func (i *Invitation) GetAllPending() ([]*Invitation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	query := `select u.id, u.username, u.email, u.first_name, u.last_name, u.level, u.invited_by, u.invited_at,
+		(select max(t.expiry) from tokens t where t.user_id = u.id and t.scope = $1)
+		from users u where ` + pendingInvitation + ` order by u.invited_at desc`
+
+	rows, err := db.QueryContext(ctx, query, ScopeInvitation)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []*Invitation{}
+
+	for rows.Next() {
+		var invitation Invitation
+		err := rows.Scan(
+			&invitation.UserID,
+			&invitation.UserName,
+			&invitation.Email,
+			&invitation.FirstName,
+			&invitation.LastName,
+			&invitation.Level,
+			&invitation.InvitedBy,
+			&invitation.InvitedAt,
+			&invitation.Expiry,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		invitation.Expired = invitation.Expiry == nil || invitation.Expiry.Before(time.Now())
+		invitations = append(invitations, &invitation)
+	}
+
+	return invitations, rows.Err()
+}
+
+// GetPendingUser returns the user of an invitation not accepted yet, or
+// sql.ErrNoRows.
+func (i *Invitation) GetPendingUser(userID int) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	query := `select ` + userColumns + ` from users where id = $1 and ` + pendingInvitation
+
+	var user User
+	err := scanUser(db.QueryRowContext(ctx, query, userID), &user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// Delete revokes an invitation not accepted yet by deleting its user, along
+// with the link. It returns sql.ErrNoRows when there is no such invitation.
+func (i *Invitation) Delete(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, `delete from users where id = $1 and `+pendingInvitation, userID)
+	if err != nil {
+		return err
+	}
+
+	return expectRow(res)
+}
+
+// Accept sets the invited user's password and activates them. Following the
+// link proves they own the address it was sent to, so it counts as verified
+// when that is still their email.
+func (i *Invitation) Accept(user User, password string, emailVerified bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	err := CheckPassword(password, user)
+	if err != nil {
+		return err
+	}
+
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	verifiedAt := user.VerifiedAt
+	if emailVerified && verifiedAt == nil {
+		verifiedAt = &now
+	}
+
+	stmt := `update users set password = $1, active = 1, verified_at = $2, invitation_accepted_at = $3, updated_at = $3
+		where id = $4 and ` + pendingInvitation
+
+	res, err := db.ExecContext(ctx, stmt, hashedPassword, verifiedAt, now, user.ID)
+	if err != nil {
+		return err
+	}
+
+	err = expectRow(res)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidToken
+	}
+
+	return err
+}
+
+// END INVITATIONS
@@ -0,0 +1,97 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// Reasons recorded with login events.
+const (
+	LoginReasonPassword         = "password"
+	LoginReasonTOTP             = "2fa"
+	LoginReasonMagicLink        = "magic_link"
+	LoginReasonInvalidMagicLink = "invalid_magic_link"
+	LoginReasonPasskey          = "passkey"
+	LoginReasonInvalidPasskey   = "invalid_passkey"
+	LoginReasonInvalidPassword  = "invalid_password"
+	LoginReasonInactive         = "inactive"
+	LoginReasonEmailNotVerified = "email_not_verified"
+	LoginReasonInvalidTOTP      = "invalid_2fa_code"
+)
+
+// START LOGIN EVENTS
+// Insert records a login attempt. A successful one also becomes the user's
+// last login and clears their failed login count; a failed one adds to it.
+func (l *LoginEvent) Insert(event LoginEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	event.CreatedAt = time.Now()
+	event.UserAgent = truncate(event.UserAgent, 255)
+
+	stmt := `insert into login_events(user_id, success, reason, ip, user_agent, created_at)
+		values ($1, $2, $3, $4, $5, $6)`
+
+	_, err = tx.ExecContext(ctx, stmt, event.UserID, event.Success, event.Reason, event.IP, event.UserAgent, event.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if event.Success {
+		stmt = `update users set last_login_at = $1, last_login_ip = $2, failed_logins = 0 where id = $3`
+		_, err = tx.ExecContext(ctx, stmt, event.CreatedAt, event.IP, event.UserID)
+	} else {
+		stmt = `update users set failed_logins = failed_logins + 1 where id = $1`
+		_, err = tx.ExecContext(ctx, stmt, event.UserID)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetAllForUser returns the most recent login attempts of the user.
+func (l *LoginEvent) GetAllForUser(userID, limit int) ([]*LoginEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	query := `select id, user_id, success, reason, ip, user_agent, created_at
+		from login_events where user_id = $1 order by created_at desc limit $2`
+
+	rows, err := db.QueryContext(ctx, query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*LoginEvent{}
+
+	for rows.Next() {
+		var event LoginEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.UserID,
+			&event.Success,
+			&event.Reason,
+			&event.IP,
+			&event.UserAgent,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
+
+// END LOGIN EVENTS
@@ -0,0 +1,43 @@
+package data
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLoginEventInsert(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   LoginEvent
+		counter string
+	}{
+		{"success", LoginEvent{UserID: 7, Success: true, Reason: LoginReasonPassword, IP: "192.0.2.1"},
+			`update users set last_login_at = \$1, last_login_ip = \$2, failed_logins = 0 where id = \$3`},
+		{"failure", LoginEvent{UserID: 7, Reason: LoginReasonInvalidPassword, IP: "192.0.2.1"},
+			`update users set failed_logins = failed_logins \+ 1 where id = \$1`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDB(t)
+
+			mock.ExpectBegin()
+			mock.ExpectExec(`insert into login_events`).
+				WithArgs(7, tt.event.Success, tt.event.Reason, "192.0.2.1", "", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(tt.counter).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			err := (&LoginEvent{}).Insert(tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = mock.ExpectationsWereMet()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package data
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// START TOTP SECRET ENCRYPTION
+// totpSecretPrefix marks an encrypted TOTP secret. Base32 secrets never
+// contain a colon, so secrets stored before encryption are told apart.
+const totpSecretPrefix = "v1:"
+
+// ErrTOTPKey is returned when a TOTP secret can't be encrypted or decrypted
+// with the configured key.
+var ErrTOTPKey = errors.New("totp secret key missing or wrong")
+
+var totpAEAD cipher.AEAD
+
+// SetTOTPKey configures the AES-256 key TOTP secrets are encrypted with in
+// the users table.
+func SetTOTPKey(key []byte) error {
+	if len(key) != 32 {
+		return errors.New("the totp secret key must be 32 bytes long")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	totpAEAD, err = cipher.NewGCM(block)
+	return err
+}
+
+// encryptTOTPSecret seals secret for the user with the given id, who is
+// bound to it as additional data so that it can't be copied to another row.
+func encryptTOTPSecret(secret string, userID int) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	if totpAEAD == nil {
+		return "", ErrTOTPKey
+	}
+
+	nonce := make([]byte, totpAEAD.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	sealed := totpAEAD.Seal(nonce, nonce, []byte(secret), []byte(strconv.Itoa(userID)))
+
+	return totpSecretPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptTOTPSecret opens a secret sealed by encryptTOTPSecret. Secrets
+// stored before encryption are returned as they are.
+func decryptTOTPSecret(stored string, userID int) (string, error) {
+	encoded, ok := strings.CutPrefix(stored, totpSecretPrefix)
+	if !ok {
+		return stored, nil
+	}
+	if totpAEAD == nil {
+		return "", ErrTOTPKey
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < totpAEAD.NonceSize() {
+		return "", ErrTOTPKey
+	}
+
+	nonce, ciphertext := sealed[:totpAEAD.NonceSize()], sealed[totpAEAD.NonceSize():]
+	secret, err := totpAEAD.Open(nil, nonce, ciphertext, []byte(strconv.Itoa(userID)))
+	if err != nil {
+		return "", ErrTOTPKey
+	}
+
+	return string(secret), nil
+}
+
+// EncryptTOTPSecrets encrypts the TOTP secrets stored before encryption was
+// introduced and returns how many there were.
+func (u *User) EncryptTOTPSecrets() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	query := `select id, totp_secret from users where totp_secret <> '' and totp_secret not like 'v1:%'`
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	plain := map[int]string{}
+	for rows.Next() {
+		var id int
+		var secret string
+		err = rows.Scan(&id, &secret)
+		if err != nil {
+			return 0, err
+		}
+		plain[id] = secret
+	}
+	err = rows.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	for id, secret := range plain {
+		encrypted, err := encryptTOTPSecret(secret, id)
+		if err != nil {
+			return 0, err
+		}
+
+		// a secret replaced in the meantime is left alone
+		stmt := `update users set totp_secret = $1 where id = $2 and totp_secret = $3`
+		_, err = db.ExecContext(ctx, stmt, encrypted, id, secret)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(plain), nil
+}
+
+// END TOTP SECRET ENCRYPTION
+
+// START TOTP
+// SetTOTPSecret stores a new, not yet confirmed TOTP secret for the user
+// together with the hashes of fresh recovery codes. Any earlier secret and
+// recovery codes are replaced. The secret is stored encrypted.
+func (u *User) SetTOTPSecret(secret string, recoveryCodes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	encrypted, err := encryptTOTPSecret(secret, u.ID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `update users set totp_secret = $1, totp_enabled_at = null, totp_last_step = 0, updated_at = $2 where id = $3`
+	_, err = tx.ExecContext(ctx, stmt, encrypted, time.Now(), u.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from recovery_codes where user_id = $1`, u.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		stmt = `insert into recovery_codes(user_id, code_hash, created_at) values($1, $2, $3)`
+		_, err = tx.ExecContext(ctx, stmt, u.ID, hashToken(normaliseRecoveryCode(code)), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// EnableTOTP turns two-factor authentication on once the user has proven
+// they can produce a code for the time step.
+func (u *User) EnableTOTP(step int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	stmt := `update users set totp_enabled_at = $1, totp_last_step = $2, updated_at = $1 where id = $3`
+	_, err := db.ExecContext(ctx, stmt, time.Now(), step, u.ID)
+
+	return err
+}
+
+// ResetTOTP turns two-factor authentication off and removes the secret and
+// recovery codes of the user.
+func (u *User) ResetTOTP() error {
+	return u.SetTOTPSecret("", nil)
+}
+
+// UseTOTPStep records that the code of a time step has been used. It returns
+// false when that step, or a later one, has been used already, so a code
+// can't be replayed.
+func (u *User) UseTOTPStep(step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	stmt := `update users set totp_last_step = $1 where id = $2 and totp_last_step < $1`
+	result, err := db.ExecContext(ctx, stmt, step, u.ID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// END TOTP
+
+// START RECOVERY CODES
+// GenerateRecoveryCodes returns n random one-time recovery codes formatted as
+// xxxxxxxx-xxxxxxxx.
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, 0, n)
+
+	for i := 0; i < n; i++ {
+		randomBytes := make([]byte, 8)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		code := hex.EncodeToString(randomBytes)
+		codes = append(codes, code[:8]+"-"+code[8:])
+	}
+
+	return codes, nil
+}
+
+// UseRecoveryCode marks one of the user's unused recovery codes as used and
+// reports whether code was such a code.
+func (u *User) UseRecoveryCode(code string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	stmt := `update recovery_codes set used_at = $1 where user_id = $2 and code_hash = $3 and used_at is null`
+	result, err := db.ExecContext(ctx, stmt, time.Now(), u.ID, hashToken(normaliseRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func normaliseRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// END RECOVERY CODES
@@ -0,0 +1,200 @@
+package data
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// useTOTPKey sets a TOTP secret key for the test.
+func useTOTPKey(t *testing.T, b byte) {
+	t.Helper()
+
+	previous := totpAEAD
+	t.Cleanup(func() {
+		totpAEAD = previous
+	})
+
+	err := SetTOTPKey(bytes.Repeat([]byte{b}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTOTPSecretEncryption(t *testing.T) {
+	const secret = "JBSWY3DPEHPK3PXP"
+	useTOTPKey(t, 1)
+
+	sealed, err := encryptTOTPSecret(secret, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, totpSecretPrefix) || strings.Contains(sealed, secret) {
+		t.Fatalf("sealed = %q", sealed)
+	}
+
+	again, _ := encryptTOTPSecret(secret, 7)
+	if again == sealed {
+		t.Error("two encryptions of the same secret are equal")
+	}
+
+	got, err := decryptTOTPSecret(sealed, 7)
+	if err != nil || got != secret {
+		t.Errorf("decrypted = %q, %v", got, err)
+	}
+
+	// secrets from before encryption, and no secret at all, pass unchanged
+	for _, stored := range []string{secret, ""} {
+		got, err = decryptTOTPSecret(stored, 7)
+		if err != nil || got != stored {
+			t.Errorf("decrypted %q = %q, %v", stored, got, err)
+		}
+	}
+	if empty, _ := encryptTOTPSecret("", 7); empty != "" {
+		t.Errorf("encrypted no secret as %q", empty)
+	}
+
+	tests := []struct {
+		name   string
+		stored string
+		userID int
+	}{
+		{"another user's row", sealed, 8},
+		{"altered", sealed[:len(sealed)-2] + "AA", 7},
+		{"truncated", totpSecretPrefix + "AAAA", 7},
+		{"not base64", totpSecretPrefix + "!!", 7},
+	}
+
+	for _, tt := range tests {
+		_, err := decryptTOTPSecret(tt.stored, tt.userID)
+		if !errors.Is(err, ErrTOTPKey) {
+			t.Errorf("%s: got %v, want ErrTOTPKey", tt.name, err)
+		}
+	}
+
+	useTOTPKey(t, 2)
+	_, err = decryptTOTPSecret(sealed, 7)
+	if !errors.Is(err, ErrTOTPKey) {
+		t.Errorf("other key: got %v, want ErrTOTPKey", err)
+	}
+
+	totpAEAD = nil
+	_, err = encryptTOTPSecret(secret, 7)
+	if !errors.Is(err, ErrTOTPKey) {
+		t.Errorf("no key: got %v, want ErrTOTPKey", err)
+	}
+}
+
+func TestSetTOTPKeyRefusesShortKeys(t *testing.T) {
+	useTOTPKey(t, 1)
+
+	for _, size := range []int{0, 16, 31, 33} {
+		err := SetTOTPKey(make([]byte, size))
+		if err == nil {
+			t.Errorf("accepted a key of %d bytes", size)
+		}
+	}
+}
+
+// TestSetTOTPSecretEncrypts checks that the secret is only stored encrypted,
+// and read back in plain text.
+func TestSetTOTPSecretEncrypts(t *testing.T) {
+	const secret = "JBSWY3DPEHPK3PXP"
+	useTOTPKey(t, 1)
+	mock := newMockDB(t)
+	user := &User{ID: 7, UserName: "jane", Email: "jane@example.com"}
+
+	stored := &capture{}
+	mock.ExpectBegin()
+	mock.ExpectExec(`update users set totp_secret = \$1`).WithArgs(stored, sqlmock.AnyArg(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`delete from recovery_codes`).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`insert into recovery_codes`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	err := user.SetTOTPSecret(secret, []string{"aaaaaaaa-bbbbbbbb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, _ := stored.value.(string)
+	if !strings.HasPrefix(sealed, totpSecretPrefix) {
+		t.Fatalf("stored %q", stored.value)
+	}
+
+	user.TOTPSecret = sealed
+	mock.ExpectQuery(`from users where id = \$1`).WithArgs(7).WillReturnRows(userRows(*user))
+
+	got, err := user.GetOne(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TOTPSecret != secret {
+		t.Errorf("read back %q", got.TOTPSecret)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncryptTOTPSecrets(t *testing.T) {
+	useTOTPKey(t, 1)
+	mock := newMockDB(t)
+
+	sealed := &capture{}
+	mock.ExpectQuery(`select id, totp_secret from users where totp_secret <> '' and totp_secret not like 'v1:%'`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "totp_secret"}).AddRow(7, "JBSWY3DPEHPK3PXP"))
+	mock.ExpectExec(`update users set totp_secret = \$1 where id = \$2 and totp_secret = \$3`).
+		WithArgs(sealed, 7, "JBSWY3DPEHPK3PXP").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	n, err := (&User{}).EncryptTOTPSecrets()
+	if err != nil || n != 1 {
+		t.Fatalf("encrypted %d, %v", n, err)
+	}
+
+	secret, err := decryptTOTPSecret(sealed.value.(string), 7)
+	if err != nil || secret != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("stored %q, decrypted to %q, %v", sealed.value, secret, err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUseTOTPStepRefusesReuse(t *testing.T) {
+	mock := newMockDB(t)
+	user := &User{ID: 7}
+
+	// the update only matches while the recorded step is older
+	guard := `update users set totp_last_step = \$1 where id = \$2 and totp_last_step < \$1`
+	mock.ExpectExec(guard).WithArgs(int64(41152263), 7).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(guard).WithArgs(int64(41152263), 7).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(guard).WithArgs(int64(41152262), 7).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	for i, want := range []bool{true, false, false} {
+		step := int64(41152263)
+		if i == 2 {
+			step--
+		}
+
+		ok, err := user.UseTOTPStep(step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("use %d of step %d = %v, want %v", i+1, step, ok, want)
+		}
+	}
+
+	err := mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -2,25 +2,63 @@ package data
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"time"
 )
 
 const dbTimeOut = time.Second * 3
 
+// Token scopes
+const (
+	ScopeAuthentication = "authentication"
+	ScopeRefresh        = "refresh"
+	ScopePasswordReset  = "password-reset"
+	ScopeEmailVerify    = "email-verification"
+	ScopeMFAPending     = "mfa-pending"
+	ScopeInvitation     = "invitation"
+	ScopeMagicLink      = "magic-link"
+)
+
+var (
+	ErrInvalidToken        = errors.New("invalid or expired token")
+	ErrAmbiguousLogin      = errors.New("login identifier matches more than one user")
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused, session revoked")
+)
+
 var db *sql.DB
 
 func New(dbPool *sql.DB) Models {
 	db = dbPool
 
 	return Models{
-		User:  User{},
-		Token: Token{},
+		User:          User{},
+		Token:         Token{},
+		Session:       Session{},
+		LoginThrottle: LoginThrottle{},
+		Revocation:    Revocation{},
+		APIKey:        APIKey{},
+		Audit:         AuditEntry{},
+		LoginEvent:    LoginEvent{},
+		Invitation:    Invitation{},
+		Registration:  Registration{},
+		Passkey:       Passkey{},
 	}
 }
 
 type Models struct {
-	User  User
-	Token Token
+	User          User
+	Token         Token
+	Session       Session
+	LoginThrottle LoginThrottle
+	Revocation    Revocation
+	APIKey        APIKey
+	Audit         AuditEntry
+	LoginEvent    LoginEvent
+	Invitation    Invitation
+	Registration  Registration
+	Passkey       Passkey
 }
 
 type User struct {
@@ -29,22 +67,162 @@ type User struct {
 	Email     string    `json:"email"`
 	FirstName string    `json:"first_name,omitempty"`
 	LastName  string    `json:"last_name,omitempty"`
-	Password  string    `json:"password"`
+	Password  string    `json:"-"`
 	Active    int       `json:"active"`
 	Level     int       `json:"level"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 	Token     Token     `json:"token"`
+	// VerifiedAt is nil until the user confirms their email address
+	VerifiedAt   *time.Time `json:"verified_at"`
+	PendingEmail string     `json:"pending_email,omitempty"`
+	// TOTPEnabledAt is set once two-factor authentication is confirmed
+	TOTPSecret    string     `json:"-"`
+	TOTPEnabledAt *time.Time `json:"totp_enabled_at"`
+	// FailedLogins counts failed logins since the last successful one
+	LastLoginAt  *time.Time `json:"last_login_at"`
+	LastLoginIP  string     `json:"last_login_ip"`
+	FailedLogins int        `json:"failed_logins"`
+	// LastSeenAt is the latest activity in any session; only GetAll sets it
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
 }
 
 type Token struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	UserName  string     `json:"username"`
+	Email     string     `json:"email"`
+	Token     string     `json:"token"`
+	TokenHash []byte     `json:"-"`
+	Scope     string     `json:"scope"`
+	Family    string     `json:"-"`
+	UsedAt    *time.Time `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	Expiry    time.Time  `json:"expiry"`
+	// ImpersonatorID is the admin an impersonation token was issued to
+	ImpersonatorID *int `json:"impersonator_id,omitempty"`
+	// BindingHash ties a magic link to the browser that asked for it
+	BindingHash []byte `json:"-"`
+}
+
+// Session is one login of a user, shared by the access and refresh tokens
+// issued for it. Its ID is the family of those tokens.
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// LoginThrottle counts failed logins per account identifier and client IP.
+type LoginThrottle struct{}
+
+// LockoutEvent records a throttle key being locked or unlocked. ActorID is
+// the admin who lifted a lockout.
+type LockoutEvent struct {
 	ID        int       `json:"id"`
+	Kind      string    `json:"kind"`
+	Key       string    `json:"key"`
+	Event     string    `json:"event"`
+	ActorID   *int      `json:"actor_id,omitempty"`
+	Until     time.Time `json:"until"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Revocation is an entry of the denylist checked for signed access tokens,
+// which are otherwise valid without a database lookup.
+type Revocation struct {
+	Subject   string    `json:"subject"`
+	RevokedAt time.Time `json:"revoked_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// APIKey is a long-lived personal access token for scripts and integrations.
+// Key holds the plain text only right after the key was generated.
+type APIKey struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Key        string     `json:"key,omitempty"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// AuditEntry is one row of the append-only audit log. Hash covers the entry
+// and PrevHash, the hash of the entry before it.
+type AuditEntry struct {
+	ID      int64 `json:"id"`
+	ActorID *int  `json:"actor_id"`
+	// ImpersonatorID is the admin acting as ActorID, if any
+	ImpersonatorID *int            `json:"impersonator_id,omitempty"`
+	Action         string          `json:"action"`
+	TargetID       *int            `json:"target_id"`
+	Target         string          `json:"target,omitempty"`
+	Changes        json.RawMessage `json:"changes,omitempty"`
+	IP             string          `json:"ip"`
+	UserAgent      string          `json:"user_agent"`
+	RequestID      string          `json:"request_id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	PrevHash       string          `json:"prev_hash"`
+	Hash           string          `json:"hash"`
+}
+
+// LoginEvent is one login attempt for an existing account. Reason says how
+// the user logged in, or why the attempt failed.
+type LoginEvent struct {
+	ID        int64     `json:"id"`
 	UserID    int       `json:"user_id"`
-	UserName  string    `json:"username"`
-	Email     string    `json:"email"`
-	Token     string    `json:"token"`
-	TokenHash []byte    `json:"-"`
+	Success   bool      `json:"success"`
+	Reason    string    `json:"reason"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
 	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	Expiry    time.Time `json:"expiry"`
+}
+
+// Invitation is a user invited by an admin who hasn't accepted yet. Expiry is
+// when the latest invitation link stops working.
+type Invitation struct {
+	UserID    int        `json:"user_id"`
+	UserName  string     `json:"username"`
+	Email     string     `json:"email"`
+	FirstName string     `json:"first_name,omitempty"`
+	LastName  string     `json:"last_name,omitempty"`
+	Level     int        `json:"level"`
+	InvitedBy *int       `json:"invited_by"`
+	InvitedAt time.Time  `json:"invited_at"`
+	Expiry    *time.Time `json:"expiry"`
+	Expired   bool       `json:"expired"`
+}
+
+// Registration is a sign-up waiting for an admin to approve it. VerifiedAt is
+// set once the applicant has confirmed their email address.
+type Registration struct {
+	UserID       int        `json:"user_id"`
+	UserName     string     `json:"username"`
+	Email        string     `json:"email"`
+	FirstName    string     `json:"first_name,omitempty"`
+	LastName     string     `json:"last_name,omitempty"`
+	VerifiedAt   *time.Time `json:"verified_at"`
+	RegisteredAt time.Time  `json:"registered_at"`
+}
+
+// Passkey is a WebAuthn credential a user can log in with. PublicKey and
+// SignCount are only used to verify logins.
+type Passkey struct {
+	ID           int        `json:"id"`
+	UserID       int        `json:"user_id"`
+	Name         string     `json:"name"`
+	CredentialID []byte     `json:"credential_id"`
+	PublicKey    []byte     `json:"-"`
+	AAGUID       []byte     `json:"aaguid"`
+	SignCount    uint32     `json:"-"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+	CreatedAt    time.Time  `json:"created_at"`
 }
@@ -0,0 +1,83 @@
+package data
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// newMockDB points the models at a mock database for the duration of a test.
+// Queries are matched as regular expressions.
+func newMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := db
+	db = mockDB
+	t.Cleanup(func() {
+		db = previous
+		mockDB.Close()
+	})
+
+	return mock
+}
+
+// capture is a sqlmock argument that matches anything and keeps the value.
+type capture struct {
+	value driver.Value
+}
+
+func (c *capture) Match(v driver.Value) bool {
+	c.value = v
+	return true
+}
+
+// userRows returns users as rows of a query selecting userColumns.
+func userRows(users ...User) *sqlmock.Rows {
+	rows := sqlmock.NewRows(strings.Fields(strings.ReplaceAll(userColumns, ",", " ")))
+	for _, u := range users {
+		if u.CreatedAt.IsZero() {
+			u.CreatedAt = time.Now()
+			u.UpdatedAt = u.CreatedAt
+		}
+		rows.AddRow(u.ID, u.UserName, u.Email, u.FirstName, u.LastName, u.Password, u.Active, u.Level, u.CreatedAt,
+			u.UpdatedAt, u.VerifiedAt, u.PendingEmail, u.TOTPSecret, u.TOTPEnabledAt, u.LastLoginAt, u.LastLoginIP,
+			u.FailedLogins)
+	}
+
+	return rows
+}
+
+// TestUserJSONLeavesOutSecrets makes sure handlers that return a user never
+// expose its password hash or TOTP secret.
+func TestUserJSONLeavesOutSecrets(t *testing.T) {
+	user := User{ID: 7, UserName: "jane", Password: "$argon2id$v=19$m=65536,t=3,p=2$c2FsdA$aGFzaA", TOTPSecret: "JBSWY3DPEHPK3PXP"}
+
+	raw, err := json.Marshal(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]any
+	err = json.Unmarshal(raw, &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, field := range []string{"password", "totp_secret", "Password", "TOTPSecret"} {
+		if _, ok := fields[field]; ok {
+			t.Errorf("%s is in %s", field, raw)
+		}
+	}
+	if strings.Contains(string(raw), "argon2id") || strings.Contains(string(raw), user.TOTPSecret) {
+		t.Errorf("secret in %s", raw)
+	}
+}
@@ -0,0 +1,204 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Purposes of WebAuthn challenges.
+const (
+	ChallengeRegister = "register"
+	ChallengeLogin    = "login"
+)
+
+var ErrInvalidChallenge = errors.New("unknown or expired challenge")
+
+// START WEBAUTHN CHALLENGES
+// InsertChallenge stores a challenge for a ceremony of purpose, by its hash.
+// userID is nil for a login where the authenticator picks the credential.
+// Expired challenges are cleared on the way.
+func (p *Passkey) InsertChallenge(challenge []byte, userID *int, purpose string, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `delete from webauthn_challenges where expires_at < $1`, time.Now())
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(challenge)
+
+	stmt := `insert into webauthn_challenges(challenge_hash, user_id, purpose, expires_at) values ($1, $2, $3, $4)`
+
+	_, err = db.ExecContext(ctx, stmt, hash[:], userID, purpose, time.Now().Add(ttl))
+
+	return err
+}
+
+// ConsumeChallenge deletes a challenge, so that it can only be answered
+// once, and returns the user it was issued for. ErrInvalidChallenge is
+// returned when it is unknown, expired or meant for another purpose.
+func (p *Passkey) ConsumeChallenge(challenge []byte, purpose string) (*int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	hash := sha256.Sum256(challenge)
+
+	var userID *int
+	var storedPurpose string
+	var expiresAt time.Time
+
+	stmt := `delete from webauthn_challenges where challenge_hash = $1 returning user_id, purpose, expires_at`
+
+	err := db.QueryRowContext(ctx, stmt, hash[:]).Scan(&userID, &storedPurpose, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if storedPurpose != purpose || expiresAt.Before(time.Now()) {
+		return nil, ErrInvalidChallenge
+	}
+
+	return userID, nil
+}
+
+// END WEBAUTHN CHALLENGES
+
+// START CRUD PASSKEYS
+// Insert stores a newly registered passkey.
+func (p *Passkey) Insert(passkey *Passkey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	stmt := `insert into passkeys(user_id, name, credential_id, public_key, aaguid, sign_count, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id, created_at`
+
+	return db.QueryRowContext(ctx, stmt,
+		passkey.UserID,
+		passkey.Name,
+		passkey.CredentialID,
+		passkey.PublicKey,
+		passkey.AAGUID,
+		int64(passkey.SignCount),
+		time.Now(),
+	).Scan(&passkey.ID, &passkey.CreatedAt)
+}
+
+// GetAllForUser lists the passkeys of a user, oldest first.
+func (p *Passkey) GetAllForUser(userID int) ([]*Passkey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	query := `select ` + passkeyColumns + ` from passkeys where user_id = $1 order by created_at`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []*Passkey{}
+
+	for rows.Next() {
+		var passkey Passkey
+		err := scanPasskey(rows, &passkey)
+		if err != nil {
+			return nil, err
+		}
+
+		passkeys = append(passkeys, &passkey)
+	}
+
+	return passkeys, rows.Err()
+}
+
+// GetByCredentialID returns the passkey with a WebAuthn credential id.
+func (p *Passkey) GetByCredentialID(credentialID []byte) (*Passkey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	query := `select ` + passkeyColumns + ` from passkeys where credential_id = $1`
+
+	var passkey Passkey
+	err := scanPasskey(db.QueryRowContext(ctx, query, credentialID), &passkey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &passkey, nil
+}
+
+// Rename renames a passkey of the user. sql.ErrNoRows is returned when the
+// user has no such passkey.
+func (p *Passkey) Rename(userID, id int, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, `update passkeys set name = $1 where id = $2 and user_id = $3`, name, id, userID)
+	if err != nil {
+		return err
+	}
+
+	return expectRow(res)
+}
+
+// Delete removes a passkey of the user. sql.ErrNoRows is returned when the
+// user has no such passkey.
+func (p *Passkey) Delete(userID, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, `delete from passkeys where id = $1 and user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+
+	return expectRow(res)
+}
+
+// UpdateUsage records a login with the passkey and its new signature
+// counter.
+func (p *Passkey) UpdateUsage(id int, signCount uint32) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `update passkeys set sign_count = $1, last_used_at = $2 where id = $3`,
+		int64(signCount), time.Now(), id)
+
+	return err
+}
+
+// END CRUD PASSKEYS
+
+// passkeyColumns lists the passkeys columns in the order scanPasskey reads
+// them.
+const passkeyColumns = `id, user_id, name, credential_id, public_key, aaguid, sign_count, last_used_at, created_at`
+
+func scanPasskey(row interface{ Scan(...any) error }, passkey *Passkey) error {
+	var signCount int64
+
+	err := row.Scan(
+		&passkey.ID,
+		&passkey.UserID,
+		&passkey.Name,
+		&passkey.CredentialID,
+		&passkey.PublicKey,
+		&passkey.AAGUID,
+		&signCount,
+		&passkey.LastUsedAt,
+		&passkey.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	passkey.SignCount = uint32(signCount)
+
+	return nil
+}
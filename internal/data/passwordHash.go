@@ -0,0 +1,228 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUnknownPasswordHash is returned for stored password hashes of an
+// algorithm no hasher understands.
+var ErrUnknownPasswordHash = errors.New("unknown password hash format")
+
+// PasswordHasher hashes passwords into self describing strings in PHC (or,
+// for bcrypt, modular crypt) format, so that the algorithm and parameters of
+// every stored hash can be read back from the hash itself.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of password.
+	Hash(password string) (string, error)
+	// Verify reports whether password matches an encoded hash made by this
+	// kind of hasher, whatever parameters it was made with.
+	Verify(encoded, password string) (bool, error)
+	// Outdated reports whether encoded was made by another algorithm or with
+	// other parameters than the hasher would use now.
+	Outdated(encoded string) bool
+}
+
+// Argon2idHasher hashes passwords with argon2id. Memory is in KiB.
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2id is the argon2id configuration used unless one is set with
+// SetPasswordHasher.
+var DefaultArgon2id = Argon2idHasher{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+const argon2idPrefix = "$argon2id$"
+
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h Argon2idHasher) Verify(encoded, password string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h Argon2idHasher) Outdated(encoded string) bool {
+	params, salt, _, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+
+	return params.Memory != h.Memory ||
+		params.Iterations != h.Iterations ||
+		params.Parallelism != h.Parallelism ||
+		params.KeyLength != h.KeyLength ||
+		uint32(len(salt)) != h.SaltLength
+}
+
+// decodeArgon2id parses "$argon2id$v=19$m=65536,t=3,p=2$salt$key".
+func decodeArgon2id(encoded string) (Argon2idHasher, []byte, []byte, error) {
+	var params Argon2idHasher
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
+
+// BcryptHasher hashes passwords with bcrypt at the given cost.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func (h BcryptHasher) Verify(encoded, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (h BcryptHasher) Outdated(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+var (
+	passwordHasher PasswordHasher = DefaultArgon2id
+
+	dummyHashOnce     sync.Once
+	dummyPasswordHash string
+)
+
+// SetPasswordHasher configures the hasher new password hashes are made with.
+// Hashes of other algorithms keep verifying and are replaced at the next
+// successful login.
+func SetPasswordHasher(h PasswordHasher) {
+	passwordHasher = h
+}
+
+// hashPassword hashes password with the configured hasher, in the hashing
+// pool.
+func hashPassword(password string) (string, error) {
+	var hash string
+	var err error
+
+	poolErr := passwordPool.run(func() {
+		hash, err = passwordHasher.Hash(password)
+	})
+	if poolErr != nil {
+		return "", poolErr
+	}
+
+	return hash, err
+}
+
+// verifyPassword checks password against a stored hash of any supported
+// algorithm, in the hashing pool.
+func verifyPassword(encoded, password string) (bool, error) {
+	var hasher PasswordHasher
+	switch {
+	case strings.HasPrefix(encoded, argon2idPrefix):
+		hasher = Argon2idHasher{}
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		hasher = BcryptHasher{}
+	default:
+		return false, ErrUnknownPasswordHash
+	}
+
+	var valid bool
+	var err error
+
+	poolErr := passwordPool.run(func() {
+		valid, err = hasher.Verify(encoded, password)
+	})
+	if poolErr != nil {
+		return false, poolErr
+	}
+
+	return valid, err
+}
+
+// dummyHash returns a hash made with the configured hasher, to compare
+// against when there is no user to check a password for.
+func dummyHash() string {
+	dummyHashOnce.Do(func() {
+		dummyPasswordHash, _ = passwordHasher.Hash("dummy password")
+	})
+
+	return dummyPasswordHash
+}
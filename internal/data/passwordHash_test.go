@@ -0,0 +1,254 @@
+package data
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2id is a cheap argon2id configuration for tests.
+var testArgon2id = Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+// useHasher sets the hasher new hashes are made with for the test.
+func useHasher(t *testing.T, h PasswordHasher) {
+	t.Helper()
+
+	previous := passwordHasher
+	SetPasswordHasher(h)
+	t.Cleanup(func() {
+		SetPasswordHasher(previous)
+	})
+}
+
+func TestArgon2idEncoding(t *testing.T) {
+	encoded, err := testArgon2id.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 16 bytes of salt and 32 of key, base64 without padding
+	phc := regexp.MustCompile(`^\$argon2id\$v=19\$m=64,t=1,p=1\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`)
+	if !phc.MatchString(encoded) {
+		t.Fatalf("encoded = %q", encoded)
+	}
+
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params != testArgon2id || len(salt) != 16 || len(key) != 32 {
+		t.Errorf("decoded %+v with %d bytes of salt and %d of key", params, len(salt), len(key))
+	}
+
+	again, _ := testArgon2id.Hash("correct horse")
+	if again == encoded {
+		t.Error("two hashes of the same password share a salt")
+	}
+
+	for password, want := range map[string]bool{"correct horse": true, "correct horse ": false, "": false} {
+		ok, err := testArgon2id.Verify(encoded, password)
+		if err != nil || ok != want {
+			t.Errorf("Verify(%q) = %v, %v, want %v", password, ok, err, want)
+		}
+	}
+
+	// the parameters are read from the hash, not taken from the hasher
+	ok, err := DefaultArgon2id.Verify(encoded, "correct horse")
+	if err != nil || !ok {
+		t.Errorf("hasher with other parameters: %v, %v", ok, err)
+	}
+}
+
+func TestDecodeArgon2idRefuses(t *testing.T) {
+	valid, err := testArgon2id.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, "$")
+	with := func(i int, part string) string {
+		changed := append([]string(nil), parts...)
+		changed[i] = part
+		return strings.Join(changed, "$")
+	}
+
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"empty", ""},
+		{"argon2i", with(1, "argon2i")},
+		{"old version", with(2, "v=16")},
+		{"no version", with(2, "19")},
+		{"missing parameter", with(3, "m=64,t=1")},
+		{"parameter not a number", with(3, "m=x,t=1,p=1")},
+		{"salt not base64", with(4, "!!!!")},
+		{"key not base64", with(5, "!!!!")},
+		{"missing key", strings.Join(parts[:5], "$")},
+		{"extra part", valid + "$x"},
+		{"bcrypt", "$2a$04$abcdefghijklmnopqrstuuABCDEFGHIJKLMNOPQRSTUVWXYZ01234"},
+	}
+
+	for _, tt := range tests {
+		_, _, _, err := decodeArgon2id(tt.encoded)
+		if !errors.Is(err, ErrUnknownPasswordHash) {
+			t.Errorf("%s: got %v, want ErrUnknownPasswordHash", tt.name, err)
+		}
+
+		_, err = testArgon2id.Verify(tt.encoded, "correct horse")
+		if !errors.Is(err, ErrUnknownPasswordHash) {
+			t.Errorf("%s: Verify got %v, want ErrUnknownPasswordHash", tt.name, err)
+		}
+	}
+}
+
+func TestOutdated(t *testing.T) {
+	argon, err := testArgon2id.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := func(change func(h *Argon2idHasher)) Argon2idHasher {
+		h := testArgon2id
+		change(&h)
+		return h
+	}
+
+	tests := []struct {
+		name    string
+		hasher  PasswordHasher
+		encoded string
+		want    bool
+	}{
+		{"same argon2id parameters", testArgon2id, argon, false},
+		{"more memory", changed(func(h *Argon2idHasher) { h.Memory *= 2 }), argon, true},
+		{"more iterations", changed(func(h *Argon2idHasher) { h.Iterations++ }), argon, true},
+		{"more parallelism", changed(func(h *Argon2idHasher) { h.Parallelism++ }), argon, true},
+		{"longer key", changed(func(h *Argon2idHasher) { h.KeyLength = 64 }), argon, true},
+		{"longer salt", changed(func(h *Argon2idHasher) { h.SaltLength = 32 }), argon, true},
+		{"bcrypt hash for argon2id", testArgon2id, bcryptHash, true},
+		{"unreadable hash for argon2id", testArgon2id, "$argon2id$garbage", true},
+		{"same bcrypt cost", BcryptHasher{Cost: bcrypt.MinCost}, bcryptHash, false},
+		{"higher bcrypt cost", BcryptHasher{Cost: bcrypt.MinCost + 1}, bcryptHash, true},
+		{"argon2id hash for bcrypt", BcryptHasher{Cost: bcrypt.MinCost}, argon, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.hasher.Outdated(tt.encoded); got != tt.want {
+			t.Errorf("%s: Outdated = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestVerifyPasswordBcrypt checks that hashes of every bcrypt variant, as
+// stored before argon2id, keep verifying.
+func TestVerifyPasswordBcrypt(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		encoded := prefix + string(hash[4:])
+
+		ok, err := verifyPassword(encoded, "correct horse")
+		if err != nil || !ok {
+			t.Errorf("%s: right password = %v, %v", prefix, ok, err)
+		}
+
+		ok, err = verifyPassword(encoded, "wrong horse")
+		if err != nil || ok {
+			t.Errorf("%s: wrong password = %v, %v", prefix, ok, err)
+		}
+	}
+
+	for _, encoded := range []string{"", "correct horse", "$1$salt$hash", "$argon2i$v=19$m=64,t=1,p=1$c2FsdA$aGFzaA"} {
+		_, err := verifyPassword(encoded, "correct horse")
+		if !errors.Is(err, ErrUnknownPasswordHash) {
+			t.Errorf("%q: got %v, want ErrUnknownPasswordHash", encoded, err)
+		}
+	}
+}
+
+func TestPasswordMatchesRehashes(t *testing.T) {
+	const password = "correct horse"
+
+	bcryptHash, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := testArgon2id
+	old.Iterations = 2
+	oldArgon, err := old.Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := testArgon2id.Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		stored   string
+		password string
+		valid    bool
+		rehashed bool
+		// failed makes the write of the new hash fail
+		failed bool
+	}{
+		{"bcrypt upgraded to argon2id", bcryptHash, password, true, true, false},
+		{"argon2id with old parameters", oldArgon, password, true, true, false},
+		{"current hash", current, password, true, false, false},
+		{"wrong password", bcryptHash, "wrong horse", false, false, false},
+		{"failed rehash", bcryptHash, password, true, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useHasher(t, testArgon2id)
+			mock := newMockDB(t)
+			user := &User{ID: 7, Password: tt.stored}
+
+			newHash := &capture{}
+			if tt.rehashed || tt.failed {
+				exec := mock.ExpectExec(`update users set password = \$1 where id = \$2 and password = \$3`).
+					WithArgs(newHash, 7, tt.stored)
+				if tt.failed {
+					exec.WillReturnError(errors.New("connection reset"))
+				} else {
+					exec.WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+			}
+
+			valid, err := user.PasswordMatches(tt.password)
+			if err != nil || valid != tt.valid {
+				t.Fatalf("PasswordMatches = %v, %v, want %v", valid, err, tt.valid)
+			}
+
+			if tt.rehashed {
+				encoded, _ := newHash.value.(string)
+				if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") || user.Password != encoded {
+					t.Errorf("stored %q, user has %q", newHash.value, user.Password)
+				}
+				if ok, _ := verifyPassword(user.Password, password); !ok {
+					t.Error("the new hash doesn't verify")
+				}
+			} else if user.Password != tt.stored {
+				t.Errorf("hash replaced by %q", user.Password)
+			}
+
+			err = mock.ExpectationsWereMet()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
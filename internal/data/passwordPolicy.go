@@ -0,0 +1,326 @@
+package data
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Password policy rules, reported in PasswordViolation.Rule.
+const (
+	RuleMinLength  = "min_length"
+	RuleMaxLength  = "max_length"
+	RuleCharClass  = "character_classes"
+	RuleIdentity   = "contains_identity"
+	RuleBreached   = "breached"
+	bcryptMaxBytes = 72
+)
+
+// PasswordPolicy describes which passwords users may choose. Lengths count
+// characters; with the bcrypt hasher passwords are also limited to 72 bytes,
+// since bcrypt ignores everything past the 72nd byte. MinClasses is the number of
+// character classes (lower case, upper case, digits and symbols) the password
+// has to mix.
+type PasswordPolicy struct {
+	MinLength        int
+	MaxLength        int
+	MinClasses       int
+	DisallowIdentity bool
+}
+
+// PasswordViolation is a single rule a password breaks.
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError lists every rule a rejected password breaks.
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Message
+	}
+
+	return "password rejected: " + strings.Join(messages, "; ")
+}
+
+var (
+	passwordPolicy = PasswordPolicy{
+		MinLength:        10,
+		MaxLength:        bcryptMaxBytes,
+		MinClasses:       2,
+		DisallowIdentity: true,
+	}
+	breachedPasswords *BreachedList
+)
+
+// SetPasswordPolicy configures the policy new passwords are checked against.
+// A nil breached list disables the breached password check.
+func SetPasswordPolicy(policy PasswordPolicy, breached *BreachedList) {
+	if policy.MaxLength <= 0 {
+		policy.MaxLength = bcryptMaxBytes
+	}
+
+	passwordPolicy = policy
+	breachedPasswords = breached
+}
+
+// CheckPassword checks password against the password policy for user, whose
+// username and email must not appear in it. It returns a *PasswordPolicyError
+// listing every broken rule, nil, or the error of reading the breached list.
+func CheckPassword(password string, user User) error {
+	policy := passwordPolicy
+	length := utf8.RuneCountInString(password)
+
+	var violations []PasswordViolation
+
+	if length < policy.MinLength {
+		violations = append(violations, PasswordViolation{
+			Rule:    RuleMinLength,
+			Message: fmt.Sprintf("must be at least %d characters long", policy.MinLength),
+		})
+	}
+
+	if length > policy.MaxLength {
+		violations = append(violations, PasswordViolation{
+			Rule:    RuleMaxLength,
+			Message: fmt.Sprintf("must be at most %d characters long", policy.MaxLength),
+		})
+	} else if _, ok := passwordHasher.(BcryptHasher); ok && len(password) > bcryptMaxBytes {
+		violations = append(violations, PasswordViolation{
+			Rule:    RuleMaxLength,
+			Message: fmt.Sprintf("must be at most %d bytes long", bcryptMaxBytes),
+		})
+	}
+
+	if classes := characterClasses(password); classes < policy.MinClasses {
+		violations = append(violations, PasswordViolation{
+			Rule:    RuleCharClass,
+			Message: fmt.Sprintf("must mix at least %d of lower case, upper case, digits and symbols", policy.MinClasses),
+		})
+	}
+
+	if policy.DisallowIdentity && containsIdentity(password, user) {
+		violations = append(violations, PasswordViolation{
+			Rule:    RuleIdentity,
+			Message: "must not contain the username or email address",
+		})
+	}
+
+	if breachedPasswords != nil {
+		breached, err := breachedPasswords.Contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			violations = append(violations, PasswordViolation{
+				Rule:    RuleBreached,
+				Message: "appears in a list of breached passwords",
+			})
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+
+	return nil
+}
+
+// characterClasses counts the character classes used in password.
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+
+	return lower + upper + digit + symbol
+}
+
+// containsIdentity reports whether password contains the username, the email
+// address or its local part. Very short names are ignored.
+func containsIdentity(password string, user User) bool {
+	password = strings.ToLower(password)
+
+	email := NormalizeEmail(user.Email)
+	local, _, _ := strings.Cut(email, "@")
+
+	for _, part := range []string{strings.ToLower(strings.TrimSpace(user.UserName)), email, local} {
+		if len(part) >= 3 && strings.Contains(password, part) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// BreachedList looks passwords up in a file of SHA-1 hashes of breached
+// passwords sorted by hash, like the "ordered by hash" downloads of Have I
+// Been Pwned. The file is searched on disk, so it can be far larger than
+// memory. Passwords are only ever compared by hash.
+type BreachedList struct {
+	file *os.File
+	size int64
+}
+
+// breachedListCheckLines is how many lines OpenBreachedList checks for
+// format and order.
+const breachedListCheckLines = 1000
+
+// OpenBreachedList opens a breached password file. Each line holds an upper
+// or lower case SHA-1 hex digest, optionally followed by ":count", and the
+// lines must be sorted by digest. Empty lines and lines starting with # are
+// skipped. The beginning of the file is checked, so that a file in another
+// format or order is refused.
+func OpenBreachedList(path string) (*BreachedList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	list := &BreachedList{file: f, size: info.Size()}
+
+	r := bufio.NewReader(f)
+	previous := ""
+	for line := 1; line <= breachedListCheckLines; line++ {
+		entry, err := r.ReadString('\n')
+		if entry == "" && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			f.Close()
+			return nil, err
+		}
+
+		digest, ok, valid := parseBreachedLine(entry)
+		if !valid {
+			f.Close()
+			return nil, fmt.Errorf("%s:%d: invalid SHA-1 digest", path, line)
+		}
+		if !ok {
+			continue
+		}
+
+		if digest < previous {
+			f.Close()
+			return nil, fmt.Errorf("%s:%d: digests are not sorted", path, line)
+		}
+		previous = digest
+	}
+
+	return list, nil
+}
+
+// Close closes the file of the list.
+func (b *BreachedList) Close() error {
+	return b.file.Close()
+}
+
+// Contains reports whether password is in the list.
+func (b *BreachedList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	target := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	// find the smallest offset whose next digest is not below target
+	lo, hi := int64(0), b.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		digest, err := b.digestAt(mid)
+		if err != nil {
+			return false, err
+		}
+
+		if digest == "" || digest >= target {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	digest, err := b.digestAt(lo)
+
+	return digest == target, err
+}
+
+// digestAt returns the digest of the first line starting at or after offset,
+// or "" when there is none.
+func (b *BreachedList) digestAt(offset int64) (string, error) {
+	start := offset
+	if start > 0 {
+		// the line starts after offset unless the byte before ends a line
+		start--
+	}
+
+	r := bufio.NewReaderSize(io.NewSectionReader(b.file, start, b.size-start), 256)
+	if offset > 0 {
+		_, err := r.ReadString('\n')
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	for {
+		entry, err := r.ReadString('\n')
+		if entry == "" && err == io.EOF {
+			return "", nil
+		}
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+
+		digest, ok, valid := parseBreachedLine(entry)
+		if !valid {
+			return "", fmt.Errorf("%s: invalid SHA-1 digest near offset %d", b.file.Name(), offset)
+		}
+		if ok {
+			return digest, nil
+		}
+	}
+}
+
+// parseBreachedLine returns the upper case digest of a line of a breached
+// password file. ok is false for lines without one, and valid is false for
+// lines that are neither a digest, empty nor a comment.
+func parseBreachedLine(line string) (digest string, ok, valid bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", false, true
+	}
+
+	digest, _, _ = strings.Cut(line, ":")
+	digest = strings.ToUpper(digest)
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != sha1.Size*2 {
+		return "", false, false
+	}
+
+	return digest, true, true
+}
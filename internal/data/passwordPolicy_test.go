@@ -0,0 +1,193 @@
+package data
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// writeBreachedFile writes the hashes of passwords sorted by hash, with a
+// comment, counts and mixed case and line endings as found in the wild.
+func writeBreachedFile(t *testing.T, passwords []string) string {
+	t.Helper()
+
+	digests := make([]string, len(passwords))
+	for i, password := range passwords {
+		digests[i] = sha1Hex(password)
+	}
+	sort.Strings(digests)
+
+	var b strings.Builder
+	b.WriteString("# breached passwords\n\n")
+	for i, digest := range digests {
+		switch i % 3 {
+		case 0:
+			fmt.Fprintf(&b, "%s:%d\r\n", digest, i+1)
+		case 1:
+			fmt.Fprintf(&b, "%s\n", strings.ToLower(digest))
+		default:
+			fmt.Fprintf(&b, "%s:%d\n", digest, i+1)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	err := os.WriteFile(path, []byte(b.String()), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestBreachedList(t *testing.T) {
+	var breached []string
+	for i := 0; i < 5000; i++ {
+		breached = append(breached, fmt.Sprintf("password%d", i))
+	}
+
+	list, err := OpenBreachedList(writeBreachedFile(t, breached))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+
+	for _, password := range breached {
+		ok, err := list.Contains(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("%q is not found", password)
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		password := fmt.Sprintf("Password%d", i)
+		ok, err := list.Contains(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Fatalf("%q is found", password)
+		}
+	}
+}
+
+func TestBreachedListEdges(t *testing.T) {
+	for _, passwords := range [][]string{nil, {"only"}, {"one", "two"}} {
+		list, err := OpenBreachedList(writeBreachedFile(t, passwords))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, password := range append(passwords, "missing") {
+			ok, err := list.Contains(password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := password != "missing"; ok != want {
+				t.Errorf("%d entries: Contains(%q) = %v, want %v", len(passwords), password, ok, want)
+			}
+		}
+
+		list.Close()
+	}
+}
+
+func TestOpenBreachedListRefuses(t *testing.T) {
+	a, b := sha1Hex("a"), sha1Hex("b")
+	if a > b {
+		a, b = b, a
+	}
+
+	tests := map[string]string{
+		"unsorted":         b + "\n" + a + "\n",
+		"not a digest":     "password\n",
+		"truncated digest": a[:39] + "\n",
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "breached.txt")
+			err := os.WriteFile(path, []byte(content), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			list, err := OpenBreachedList(path)
+			if err == nil {
+				list.Close()
+				t.Error("file is accepted")
+			}
+		})
+	}
+}
+
+func TestCheckPasswordLength(t *testing.T) {
+	previousPolicy, previousHasher := passwordPolicy, passwordHasher
+	t.Cleanup(func() {
+		passwordPolicy, passwordHasher = previousPolicy, previousHasher
+	})
+
+	SetPasswordPolicy(PasswordPolicy{MinLength: 10, MaxLength: 12}, nil)
+
+	tests := []struct {
+		name     string
+		password string
+		hasher   PasswordHasher
+		rule     string
+	}{
+		// ten characters, twenty bytes
+		{"multi-byte at the minimum", "äöüÄÖÜäöüß", DefaultArgon2id, ""},
+		{"too short", "äöüÄÖÜäöü", DefaultArgon2id, RuleMinLength},
+		{"multi-byte at the maximum", "äöüÄÖÜäöüßäö", DefaultArgon2id, ""},
+		{"too long", "äöüÄÖÜäöüßäöü", DefaultArgon2id, RuleMaxLength},
+		// twelve characters, 48 bytes: within the bcrypt limit
+		{"bcrypt within 72 bytes", strings.Repeat("😀", 12), BcryptHasher{Cost: 4}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			passwordHasher = tt.hasher
+
+			err := CheckPassword(tt.password, User{})
+			if got := violatedRule(err); got != tt.rule {
+				t.Errorf("rule = %q, want %q (%v)", got, tt.rule, err)
+			}
+		})
+	}
+
+	// 20 characters, 80 bytes: allowed by the policy but not by bcrypt
+	SetPasswordPolicy(PasswordPolicy{MinLength: 10, MaxLength: 72}, nil)
+	passwordHasher = BcryptHasher{Cost: 4}
+
+	err := CheckPassword(strings.Repeat("😀", 20), User{})
+	if got := violatedRule(err); got != RuleMaxLength {
+		t.Errorf("bcrypt: rule = %q, want %q (%v)", got, RuleMaxLength, err)
+	}
+}
+
+// violatedRule returns the only rule err reports, "" for nil, or "?".
+func violatedRule(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var policyErr *PasswordPolicyError
+	if !errors.As(err, &policyErr) || len(policyErr.Violations) != 1 {
+		return "?"
+	}
+
+	return policyErr.Violations[0].Rule
+}
@@ -0,0 +1,151 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// pendingRegistration selects registered users who haven't been approved.
+const pendingRegistration = `registered_at is not null and registration_approved_at is null`
+
+// START REGISTRATIONS
+// Insert creates an inactive user with the password they chose, waiting for
+// an admin to approve them.
+func (r *Registration) Insert(user User) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	err := CheckPassword(user.Password, user)
+	if err != nil {
+		return 0, err
+	}
+
+	hashedPassword, err := hashPassword(user.Password)
+	if err != nil {
+		return 0, err
+	}
+
+	var newID int
+	stmt := `
+	insert into users(username, email, first_name, last_name, password, active, level, created_at, updated_at, registered_at)
+	values ($1, $2, $3, $4, $5, 0, $6, $7, $7, $7) returning id
+	`
+
+	err = db.QueryRowContext(ctx, stmt,
+		strings.TrimSpace(user.UserName),
+		NormalizeEmail(user.Email),
+		user.FirstName,
+		user.LastName,
+		hashedPassword,
+		LevelUser,
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetAllPending returns the registrations waiting for approval, oldest
+// first.
+func (r *Registration) GetAllPending() ([]*Registration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	query := `select id, username, email, first_name, last_name, verified_at, registered_at
+		from users where ` + pendingRegistration + ` order by registered_at`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	registrations := []*Registration{}
+
+	for rows.Next() {
+		var registration Registration
+		err := rows.Scan(
+			&registration.UserID,
+			&registration.UserName,
+			&registration.Email,
+			&registration.FirstName,
+			&registration.LastName,
+			&registration.VerifiedAt,
+			&registration.RegisteredAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		registrations = append(registrations, &registration)
+	}
+
+	return registrations, rows.Err()
+}
+
+// GetPendingUser returns the user of a registration waiting for approval, or
+// sql.ErrNoRows.
+func (r *Registration) GetPendingUser(userID int) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	query := `select ` + userColumns + ` from users where id = $1 and ` + pendingRegistration
+
+	var user User
+	err := scanUser(db.QueryRowContext(ctx, query, userID), &user)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// Approve activates a registered user. It returns sql.ErrNoRows when the
+// registration isn't pending.
+func (r *Registration) Approve(userID, approvedBy int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	stmt := `update users set active = 1, registration_approved_at = $1, registration_approved_by = $2, updated_at = $1
+		where id = $3 and ` + pendingRegistration
+
+	res, err := db.ExecContext(ctx, stmt, time.Now(), approvedBy, userID)
+	if err != nil {
+		return err
+	}
+
+	return expectRow(res)
+}
+
+// Reject deletes a registered user who was never approved. It returns
+// sql.ErrNoRows when the registration isn't pending.
+func (r *Registration) Reject(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, `delete from users where id = $1 and `+pendingRegistration, userID)
+	if err != nil {
+		return err
+	}
+
+	return expectRow(res)
+}
+
+// END REGISTRATIONS
+
+// expectRow returns sql.ErrNoRows when a statement changed no row.
+func expectRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
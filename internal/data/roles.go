@@ -0,0 +1,96 @@
+package data
+
+import "context"
+
+// Permission is the right to perform one kind of action.
+type Permission string
+
+const (
+	PermUsersRead      Permission = "users:read"
+	PermUsersWrite     Permission = "users:write"
+	PermUsersDelete    Permission = "users:delete"
+	PermSessionsManage Permission = "sessions:manage"
+	PermSecurityManage Permission = "security:manage"
+	PermAuditRead      Permission = "audit:read"
+	PermImpersonate    Permission = "users:impersonate"
+)
+
+// Role is a named set of permissions. For now a user's role follows from
+// User.Level: a user has the highest role whose Level does not exceed theirs.
+type Role struct {
+	Name        string       `json:"name"`
+	Level       int          `json:"level"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// Levels of the built-in roles.
+const (
+	LevelUser    = 1
+	LevelManager = 5
+	LevelAdmin   = 10
+)
+
+// Roles lists the built-in roles, lowest level first.
+var Roles = []Role{
+	{Name: "user", Level: LevelUser},
+	{Name: "manager", Level: LevelManager, Permissions: []Permission{
+		PermUsersRead,
+		PermSessionsManage,
+	}},
+	{Name: "admin", Level: LevelAdmin, Permissions: []Permission{
+		PermUsersRead,
+		PermUsersWrite,
+		PermUsersDelete,
+		PermSessionsManage,
+		PermSecurityManage,
+		PermAuditRead,
+		PermImpersonate,
+	}},
+}
+
+// RoleFor returns the role of a user level. Levels below every role get a
+// role without permissions.
+func RoleFor(level int) Role {
+	role := Role{Name: "none", Level: level}
+
+	for _, r := range Roles {
+		if level >= r.Level {
+			role = r
+		}
+	}
+
+	return role
+}
+
+// Role returns the role of the user.
+func (u *User) Role() Role {
+	return RoleFor(u.Level)
+}
+
+// Can reports whether the user's role grants perm.
+func (u *User) Can(perm Permission) bool {
+	for _, p := range u.Role().Permissions {
+		if p == perm {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsAdmin reports whether the user has the admin role.
+func (u *User) IsAdmin() bool {
+	return u.Level >= LevelAdmin
+}
+
+// CountActiveAdmins returns how many active users have the admin role.
+func (u *User) CountActiveAdmins() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	var count int
+	query := `select count(id) from users where active = 1 and level >= $1`
+	err := db.QueryRowContext(ctx, query, LevelAdmin).Scan(&count)
+
+	return count, err
+}
@@ -0,0 +1,228 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// START SESSION POLICY
+// SessionPolicy limits how long a session may live. The access token expires
+// after IdleTimeout without use, and no token of the session outlives
+// AbsoluteLifetime counted from login.
+type SessionPolicy struct {
+	IdleTimeout      time.Duration
+	AbsoluteLifetime time.Duration
+}
+
+// SessionRenewInterval is the minimum time between two writes that slide the
+// idle timeout of the same access token.
+var SessionRenewInterval = time.Minute
+
+var (
+	defaultSessionPolicy = SessionPolicy{IdleTimeout: 30 * time.Minute, AbsoluteLifetime: 12 * time.Hour}
+	levelSessionPolicies = map[int]SessionPolicy{}
+)
+
+// SetSessionPolicies configures the session policy used for users of each
+// level. Levels missing from byLevel use def.
+func SetSessionPolicies(def SessionPolicy, byLevel map[int]SessionPolicy) {
+	defaultSessionPolicy = def
+	levelSessionPolicies = byLevel
+}
+
+// SessionPolicyFor returns the session policy of a user level.
+func SessionPolicyFor(level int) SessionPolicy {
+	if policy, ok := levelSessionPolicies[level]; ok {
+		return policy
+	}
+
+	return defaultSessionPolicy
+}
+
+// END SESSION POLICY
+
+// START CRUD SESSIONS
+// Insert stores a new session for the user together with its first tokens,
+// in one transaction. When the user already has maxSessions sessions, the
+// least recently used ones are ended to make room.
+func (s *Session) Insert(session Session, maxSessions int, u User, tokens ...Token) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if maxSessions > 0 {
+		query := `select id from sessions where user_id = $1 order by last_seen_at desc offset $2`
+
+		rows, err := tx.QueryContext(ctx, query, session.UserID, maxSessions-1)
+		if err != nil {
+			return err
+		}
+
+		var evicted []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			evicted = append(evicted, id)
+		}
+		rows.Close()
+
+		for _, id := range evicted {
+			if err := deleteSession(ctx, tx, id); err != nil {
+				return err
+			}
+		}
+	}
+
+	stmt := `insert into sessions(id, user_id, user_agent, ip, created_at, last_seen_at, expires_at)
+		values($1, $2, $3, $4, $5, $6, $7)`
+
+	_, err = tx.ExecContext(ctx, stmt,
+		session.ID,
+		session.UserID,
+		session.UserAgent,
+		session.IP,
+		time.Now(),
+		time.Now(),
+		session.ExpiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		token.UserName = u.UserName
+		token.Email = u.Email
+
+		err = insertToken(ctx, tx, token)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetAllForUser returns the sessions of a user, most recently used first.
+func (s *Session) GetAllForUser(userID int) ([]*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	query := `select id, user_id, user_agent, ip, created_at, last_seen_at, expires_at
+		from sessions where user_id = $1 order by last_seen_at desc`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.UserAgent,
+			&session.IP,
+			&session.CreatedAt,
+			&session.LastSeenAt,
+			&session.ExpiresAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// Delete ends one session of a user and removes every token issued for it.
+// sql.ErrNoRows is returned when the user has no such session.
+func (s *Session) Delete(userID int, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var found string
+	query := `select id from sessions where id = $1 and user_id = $2`
+	err = tx.QueryRowContext(ctx, query, id, userID).Scan(&found)
+	if err != nil {
+		return err
+	}
+
+	err = deleteSession(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteOthers ends every session of a user except the one with id keep.
+func (s *Session) DeleteOthers(userID int, keep string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `select id from sessions where user_id = $1 and id <> $2`, userID, keep)
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := deleteSession(ctx, tx, id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func deleteSession(ctx context.Context, tx *sql.Tx, id string) error {
+	_, err := tx.ExecContext(ctx, `delete from tokens where family = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from sessions where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return revoke(ctx, tx, SessionSubject(id))
+}
+
+// END CRUD SESSIONS
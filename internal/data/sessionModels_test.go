@@ -0,0 +1,72 @@
+package data
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSessionInsert(t *testing.T) {
+	mock := newMockDB(t)
+
+	user := User{ID: 7, UserName: "jane", Email: "jane@example.com"}
+	session := Session{ID: "s1", UserID: 7, ExpiresAt: time.Now().Add(time.Hour)}
+	tokens := []Token{{UserID: 7, Scope: ScopeRefresh, Family: "s1"}, {UserID: 7, Scope: ScopeAuthentication, Family: "s1"}}
+
+	// the least recently used session beyond the limit makes room
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select id from sessions where user_id = \$1 order by last_seen_at desc offset \$2`).WithArgs(7, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("s0"))
+	mock.ExpectExec(`delete from tokens where family = \$1`).WithArgs("s0").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`delete from sessions where id = \$1`).WithArgs("s0").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`insert into revocations`).WithArgs("sid:s0", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`select pg_notify`).WithArgs(tokenCacheChannel, "sid:s0").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`insert into sessions`).WithArgs("s1", 7, "", "", sqlmock.AnyArg(), sqlmock.AnyArg(), session.ExpiresAt).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	for _, token := range tokens {
+		mock.ExpectExec(`insert into tokens`).
+			WithArgs(7, "jane", "jane@example.com", sqlmock.AnyArg(), token.Scope, "s1", sqlmock.AnyArg(), sqlmock.AnyArg(),
+				sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	var s Session
+	err := s.Insert(session, 3, user, tokens...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestSessionInsertFailedToken checks that a session whose tokens can't be
+// stored is not stored either.
+func TestSessionInsertFailedToken(t *testing.T) {
+	mock := newMockDB(t)
+
+	failed := errors.New("connection reset")
+	session := Session{ID: "s1", UserID: 7, ExpiresAt: time.Now().Add(time.Hour)}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into sessions`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`insert into tokens`).WillReturnError(failed)
+	mock.ExpectRollback()
+
+	var s Session
+	err := s.Insert(session, 0, User{ID: 7}, Token{UserID: 7, Scope: ScopeRefresh, Family: "s1"})
+	if !errors.Is(err, failed) {
+		t.Fatalf("got %v, want %v", err, failed)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
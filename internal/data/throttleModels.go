@@ -0,0 +1,204 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Kinds of login throttles. Failures are counted both per account identifier
+// and per client IP.
+const (
+	ThrottleAccount = "account"
+	ThrottleIP      = "ip"
+)
+
+// LockoutPolicy decides when repeated login failures lock a throttle key.
+// After Threshold failures within Window the key is locked for BaseLockout,
+// doubling with every further lockout up to MaxLockout.
+type LockoutPolicy struct {
+	Threshold   int
+	Window      time.Duration
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+}
+
+// lockoutFor returns how long the n-th consecutive lockout lasts.
+func (p LockoutPolicy) lockoutFor(n int) time.Duration {
+	d := p.BaseLockout
+	for i := 1; i < n && d < p.MaxLockout; i++ {
+		d *= 2
+	}
+
+	if d > p.MaxLockout {
+		d = p.MaxLockout
+	}
+
+	return d
+}
+
+// START LOGIN THROTTLE
+// LockedUntil returns the time until which the key is locked, or the zero
+// time when it is not locked.
+func (l *LoginThrottle) LockedUntil(kind, key string) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	var lockedUntil sql.NullTime
+	query := `select locked_until from login_throttles where kind = $1 and key = $2`
+	err := db.QueryRowContext(ctx, query, kind, key).Scan(&lockedUntil)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+
+	if !lockedUntil.Valid || lockedUntil.Time.Before(time.Now()) {
+		return time.Time{}, nil
+	}
+
+	return lockedUntil.Time, nil
+}
+
+// RecordFailure counts a failed login for the key. When the failure reaches
+// the policy threshold the key is locked and the lockout is recorded; the
+// time it is locked until is returned.
+func (l *LoginThrottle) RecordFailure(kind, key string, policy LockoutPolicy) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	// failures older than the window no longer count
+	stmt := `insert into login_throttles(kind, key, failures, lockouts, updated_at)
+		values($1, $2, 1, 0, $3)
+		on conflict (kind, key) do update set
+			failures = case when login_throttles.updated_at < $4 then 1 else login_throttles.failures + 1 end,
+			updated_at = $3
+		returning failures, lockouts`
+
+	var failures, lockouts int
+	err = tx.QueryRowContext(ctx, stmt, kind, key, now, now.Add(-policy.Window)).Scan(&failures, &lockouts)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var lockedUntil time.Time
+	if failures >= policy.Threshold {
+		lockouts++
+		lockedUntil = now.Add(policy.lockoutFor(lockouts))
+
+		stmt = `update login_throttles set failures = 0, lockouts = $1, locked_until = $2 where kind = $3 and key = $4`
+		_, err = tx.ExecContext(ctx, stmt, lockouts, lockedUntil, kind, key)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		err = insertLockoutEvent(ctx, tx, kind, key, "locked", nil, lockedUntil)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return lockedUntil, tx.Commit()
+}
+
+// Reset forgets the failures of the key after a successful login.
+func (l *LoginThrottle) Reset(kind, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	stmt := `delete from login_throttles where kind = $1 and key = $2 and (locked_until is null or locked_until < $3)`
+	_, err := db.ExecContext(ctx, stmt, kind, key, time.Now())
+
+	return err
+}
+
+// Unlock lifts a lockout of the key on behalf of the admin actorID and records
+// the unlock.
+func (l *LoginThrottle) Unlock(kind, key string, actorID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `delete from login_throttles where kind = $1 and key = $2 returning locked_until`
+
+	var lockedUntil sql.NullTime
+	err = tx.QueryRowContext(ctx, stmt, kind, key).Scan(&lockedUntil)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	if lockedUntil.Valid && lockedUntil.Time.After(time.Now()) {
+		err = insertLockoutEvent(ctx, tx, kind, key, "unlocked", &actorID, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetLockoutEvents returns the most recent lockouts and unlocks.
+func (l *LoginThrottle) GetLockoutEvents(limit int) ([]*LockoutEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	query := `select id, kind, key, event, actor_id, until, created_at
+		from lockout_events order by created_at desc limit $1`
+
+	rows, err := db.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*LockoutEvent{}
+
+	for rows.Next() {
+		var event LockoutEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.Kind,
+			&event.Key,
+			&event.Event,
+			&event.ActorID,
+			&event.Until,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, &event)
+	}
+
+	return events, rows.Err()
+}
+
+func insertLockoutEvent(ctx context.Context, tx *sql.Tx, kind, key, event string, actorID *int, until time.Time) error {
+	stmt := `insert into lockout_events(kind, key, event, actor_id, until, created_at)
+		values($1, $2, $3, $4, $5, $6)`
+
+	_, err := tx.ExecContext(ctx, stmt, kind, key, event, actorID, until, time.Now())
+
+	return err
+}
+
+// END LOGIN THROTTLE
@@ -0,0 +1,278 @@
+package data
+
+import (
+	"container/list"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v4/stdlib"
+)
+
+// tokenCacheChannel is the Postgres channel cache invalidations are sent on.
+// Payloads are revocation subjects, "sid:<session>" or "uid:<user>", or
+// "tok:<hex token hash>" for a single token.
+const tokenCacheChannel = "token_cache"
+
+// tokenCache keeps recent access token lookups in memory, so that
+// authenticated requests don't query the database every time. Entries live
+// for at most ttl, and the least recently used ones are dropped beyond size.
+// Every instance listens for invalidations sent through Postgres, so an
+// entry disappears everywhere as soon as its token, session or user changes.
+type tokenCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List
+
+	hits          atomic.Int64
+	misses        atomic.Int64
+	evictions     atomic.Int64
+	invalidations atomic.Int64
+}
+
+type tokenCacheEntry struct {
+	key         string
+	token       Token
+	user        User
+	cachedUntil time.Time
+}
+
+// TokenCacheStats describes the token cache.
+type TokenCacheStats struct {
+	Enabled       bool    `json:"enabled"`
+	Size          int     `json:"size"`
+	Capacity      int     `json:"capacity"`
+	TTLSeconds    float64 `json:"ttl_seconds"`
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	HitRatio      float64 `json:"hit_ratio"`
+	Evictions     int64   `json:"evictions"`
+	Invalidations int64   `json:"invalidations"`
+}
+
+var tokenLookups = newTokenCache(0, 0)
+
+func newTokenCache(size int, ttl time.Duration) *tokenCache {
+	return &tokenCache{
+		size:    size,
+		ttl:     ttl,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// SetTokenCache configures the token cache. A size of zero disables it.
+func SetTokenCache(size int, ttl time.Duration) {
+	tokenLookups = newTokenCache(size, ttl)
+}
+
+// GetTokenCacheStats returns the hit rate and size of the token cache.
+func GetTokenCacheStats() TokenCacheStats {
+	return tokenLookups.stats()
+}
+
+func (c *tokenCache) enabled() bool {
+	return c.size > 0
+}
+
+// get returns the cached token and user for a token hash.
+func (c *tokenCache) get(key string) (*Token, *User, bool) {
+	if !c.enabled() {
+		return nil, nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, nil, false
+	}
+
+	entry := elem.Value.(*tokenCacheEntry)
+	if time.Now().After(entry.cachedUntil) {
+		c.remove(elem)
+		c.misses.Add(1)
+		return nil, nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	c.hits.Add(1)
+
+	token, user := entry.token, entry.user
+	return &token, &user, true
+}
+
+// put caches a token and its user, never beyond the token's expiry.
+func (c *tokenCache) put(key string, token Token, user User) {
+	if !c.enabled() {
+		return
+	}
+
+	cachedUntil := time.Now().Add(c.ttl)
+	if token.Expiry.Before(cachedUntil) {
+		cachedUntil = token.Expiry
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+
+	c.entries[key] = c.lru.PushFront(&tokenCacheEntry{key: key, token: token, user: user, cachedUntil: cachedUntil})
+
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// forget drops the entry of a single token hash.
+func (c *tokenCache) forget(key string) {
+	if !c.enabled() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// invalidate drops every entry of a session ("sid:<id>"), a user
+// ("uid:<id>") or a single token ("tok:<hex hash>").
+func (c *tokenCache) invalidate(subject string) {
+	if !c.enabled() {
+		return
+	}
+
+	kind, value, _ := strings.Cut(subject, ":")
+	if kind == "tok" {
+		hash, err := hex.DecodeString(value)
+		if err == nil {
+			c.forget(string(hash))
+			c.invalidations.Add(1)
+		}
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		entry := elem.Value.(*tokenCacheEntry)
+
+		switch {
+		case kind == "sid" && entry.token.Family == value,
+			kind == "uid" && strconv.Itoa(entry.user.ID) == value:
+			c.remove(elem)
+			c.invalidations.Add(1)
+		}
+
+		elem = next
+	}
+}
+
+// flush drops every entry, for when invalidations may have been missed.
+func (c *tokenCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+}
+
+// tokenSubject names a single token in an invalidation.
+func tokenSubject(hash []byte) string {
+	return "tok:" + hex.EncodeToString(hash)
+}
+
+func (c *tokenCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*tokenCacheEntry).key)
+}
+
+func (c *tokenCache) stats() TokenCacheStats {
+	c.mu.Lock()
+	size := c.lru.Len()
+	c.mu.Unlock()
+
+	s := TokenCacheStats{
+		Enabled:       c.enabled(),
+		Size:          size,
+		Capacity:      c.size,
+		TTLSeconds:    c.ttl.Seconds(),
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Evictions:     c.evictions.Load(),
+		Invalidations: c.invalidations.Load(),
+	}
+	if s.Hits+s.Misses > 0 {
+		s.HitRatio = float64(s.Hits) / float64(s.Hits+s.Misses)
+	}
+
+	return s
+}
+
+// invalidateTokens drops the cached tokens of subject on this instance and,
+// once the surrounding transaction commits, on every other one.
+func invalidateTokens(ctx context.Context, exec execer, subject string) error {
+	tokenLookups.invalidate(subject)
+
+	_, err := exec.ExecContext(ctx, `select pg_notify($1, $2)`, tokenCacheChannel, subject)
+
+	return err
+}
+
+// ListenTokenInvalidations applies the cache invalidations sent by every
+// instance until ctx is done or the connection fails. The cache is flushed
+// when listening starts, since invalidations sent in the meantime are lost.
+// It holds on to one connection of the pool while it runs.
+func ListenTokenInvalidations(ctx context.Context) error {
+	if !tokenLookups.enabled() {
+		return nil
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		stdConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return errors.New("token cache invalidation needs the pgx driver")
+		}
+		pgConn := stdConn.Conn()
+
+		_, err := pgConn.Exec(ctx, "listen "+tokenCacheChannel)
+		if err != nil {
+			return err
+		}
+		tokenLookups.flush()
+
+		for {
+			notification, err := pgConn.WaitForNotification(ctx)
+			if err != nil {
+				return fmt.Errorf("token cache invalidations: %w", err)
+			}
+
+			tokenLookups.invalidate(notification.Payload)
+		}
+	})
+}
@@ -0,0 +1,314 @@
+package data
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// useTokenCache replaces the token cache for the duration of a test.
+func useTokenCache(t testing.TB, size int, ttl time.Duration) *tokenCache {
+	previous := tokenLookups
+	tokenLookups = newTokenCache(size, ttl)
+	t.Cleanup(func() { tokenLookups = previous })
+
+	return tokenLookups
+}
+
+func TestTokenCacheTTL(t *testing.T) {
+	c := newTokenCache(10, time.Minute)
+	user := User{ID: 7}
+
+	c.put("a", Token{Expiry: time.Now().Add(time.Hour)}, user)
+	if _, _, ok := c.get("a"); !ok {
+		t.Fatal("fresh entry missed")
+	}
+
+	c.entries["a"].Value.(*tokenCacheEntry).cachedUntil = time.Now().Add(-time.Millisecond)
+	if _, _, ok := c.get("a"); ok {
+		t.Error("entry served after its TTL")
+	}
+	if _, ok := c.entries["a"]; ok {
+		t.Error("expired entry kept")
+	}
+
+	// an entry never outlives its token
+	expiry := time.Now().Add(time.Second)
+	c.put("b", Token{Expiry: expiry}, user)
+	if got := c.entries["b"].Value.(*tokenCacheEntry).cachedUntil; !got.Equal(expiry) {
+		t.Errorf("cached until %s, want the token expiry %s", got, expiry)
+	}
+
+	s := c.stats()
+	if s.Hits != 1 || s.Misses != 1 || s.Size != 1 {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+func TestTokenCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newTokenCache(2, time.Minute)
+	token := Token{Expiry: time.Now().Add(time.Hour)}
+
+	c.put("a", token, User{ID: 1})
+	c.put("b", token, User{ID: 2})
+	c.get("a")
+	c.put("c", token, User{ID: 3})
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, _, ok := c.get(key); ok != want {
+			t.Errorf("%s cached = %v, want %v", key, ok, want)
+		}
+	}
+
+	if s := c.stats(); s.Evictions != 1 || s.Size != 2 {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+func TestTokenCacheInvalidate(t *testing.T) {
+	token := func(family string) Token { return Token{Family: family, Expiry: time.Now().Add(time.Hour)} }
+	hash := hashToken("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+
+	tests := []struct {
+		subject string
+		gone    []string
+	}{
+		{SessionSubject("s1"), []string{"a", "b"}},
+		{UserSubject(7), []string{"a", "b", "c"}},
+		{tokenSubject(hash), []string{string(hash)}},
+		{UserSubject(9), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.subject, func(t *testing.T) {
+			c := newTokenCache(10, time.Minute)
+			c.put("a", token("s1"), User{ID: 7})
+			c.put("b", token("s1"), User{ID: 7})
+			c.put("c", token("s2"), User{ID: 7})
+			c.put(string(hash), token("s3"), User{ID: 8})
+			c.put("d", token("s4"), User{ID: 8})
+
+			c.invalidate(tt.subject)
+
+			gone := map[string]bool{}
+			for _, key := range tt.gone {
+				gone[key] = true
+			}
+			for _, key := range []string{"a", "b", "c", string(hash), "d"} {
+				if _, _, ok := c.get(key); ok == gone[key] {
+					t.Errorf("%x cached = %v after invalidating %s", key, ok, tt.subject)
+				}
+			}
+		})
+	}
+}
+
+var tokenColumnNames = []string{"id", "user_id", "username", "email", "token_hash", "scope", "family", "used_at",
+	"created_at", "updated_at", "expiry", "impersonator_id", "binding_hash"}
+
+// expectTokenLookup expects the queries of an uncached Authenticate.
+func expectTokenLookup(mock sqlmock.Sqlmock, plainText string, user User) {
+	now := time.Now()
+
+	mock.ExpectQuery(`from tokens where token_hash = \$1`).WithArgs(hashToken(plainText)).
+		WillReturnRows(sqlmock.NewRows(tokenColumnNames).AddRow(1, user.ID, user.UserName, user.Email,
+			hashToken(plainText), ScopeAuthentication, "s1", nil, now, now, now.Add(time.Hour), nil, nil))
+	mock.ExpectQuery(`from users where id = \$1`).WithArgs(user.ID).WillReturnRows(userRows(user))
+}
+
+// TestTokenCacheInvalidatedByChanges checks that a cached token is looked up
+// again once its user is logged out, deactivated or given another level.
+func TestTokenCacheInvalidatedByChanges(t *testing.T) {
+	const plainText = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	user := User{ID: 7, UserName: "jane", Email: "jane@example.com", Active: 1, Level: LevelUser}
+
+	expectNotify := func(mock sqlmock.Sqlmock) {
+		mock.ExpectExec(`select pg_notify`).WithArgs(tokenCacheChannel, "uid:7").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	expectRevoke := func(mock sqlmock.Sqlmock) {
+		mock.ExpectExec(`insert into revocations`).WithArgs("uid:7", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		expectNotify(mock)
+	}
+	expectUpdate := func(mock sqlmock.Sqlmock, previousLevel int) {
+		mock.ExpectQuery(`update users set`).WillReturnRows(sqlmock.NewRows([]string{"level"}).AddRow(previousLevel))
+	}
+
+	tests := []struct {
+		name   string
+		expect func(sqlmock.Sqlmock)
+		change func() error
+	}{
+		{"revoked", func(mock sqlmock.Sqlmock) {
+			for _, table := range []string{"tokens", "sessions", "api_keys"} {
+				mock.ExpectExec(`delete from ` + table).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			expectRevoke(mock)
+		}, func() error {
+			var token Token
+			return token.DeleteTokensForUser(user.ID)
+		}},
+		{"deactivated", func(mock sqlmock.Sqlmock) {
+			expectUpdate(mock, LevelUser)
+			expectRevoke(mock)
+		}, func() error {
+			changed := user
+			changed.Active = 0
+			return changed.Update()
+		}},
+		{"level changed", func(mock sqlmock.Sqlmock) {
+			expectUpdate(mock, LevelUser)
+			expectRevoke(mock)
+		}, func() error {
+			changed := user
+			changed.Level = LevelAdmin
+			return changed.Update()
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			cache := useTokenCache(t, 10, time.Minute)
+			var token Token
+
+			// looked up once, then served from the cache
+			expectTokenLookup(mock, plainText, user)
+			for i := 0; i < 2; i++ {
+				_, _, err := token.Authenticate(plainText)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if s := cache.stats(); s.Hits != 1 || s.Size != 1 {
+				t.Fatalf("stats = %+v", s)
+			}
+
+			tt.expect(mock)
+			err := tt.change()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if s := cache.stats(); s.Size != 0 {
+				t.Errorf("%d entries left", s.Size)
+			}
+
+			// the next request sees the change
+			expectTokenLookup(mock, plainText, user)
+			_, _, err = token.Authenticate(plainText)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = mock.ExpectationsWereMet()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// BenchmarkTokenLookup authenticates an opaque token with and without the
+// token cache, against a database that answers at once, so that it measures
+// the cost of querying and scanning rather than network latency:
+//
+//	go test ./internal/data -run '^$' -bench TokenLookup
+func BenchmarkTokenLookup(b *testing.B) {
+	const plainText = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	benchDB, err := sql.Open("tokenbench", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer benchDB.Close()
+
+	previous := db
+	db = benchDB
+	defer func() { db = previous }()
+
+	for _, bm := range []struct {
+		name string
+		size int
+	}{
+		{"cached", 10000},
+		{"uncached", 0},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			useTokenCache(b, bm.size, time.Minute)
+			var token Token
+
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, _, err := token.Authenticate(plainText)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func init() {
+	sql.Register("tokenbench", benchDriver{})
+}
+
+// benchDriver is a database that answers every token lookup with the same
+// token and every user lookup with the same user.
+type benchDriver struct{}
+
+func (benchDriver) Open(string) (driver.Conn, error) { return benchConn{}, nil }
+
+type benchConn struct{}
+
+func (benchConn) Prepare(query string) (driver.Stmt, error) { return benchStmt{query}, nil }
+func (benchConn) Close() error                              { return nil }
+func (benchConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+type benchStmt struct{ query string }
+
+func (benchStmt) Close() error  { return nil }
+func (benchStmt) NumInput() int { return -1 }
+func (benchStmt) Exec([]driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+
+func (s benchStmt) Query([]driver.Value) (driver.Rows, error) {
+	now := time.Now()
+
+	if strings.Contains(s.query, "from tokens") {
+		return &benchRows{columns: tokenColumnNames, values: []driver.Value{1, 7, "jane", "jane@example.com",
+			hashToken("ABCDEFGHIJKLMNOPQRSTUVWXYZ"), ScopeAuthentication, "", nil, now, now, now.Add(time.Hour), nil, nil}}, nil
+	}
+
+	return &benchRows{columns: strings.Fields(strings.ReplaceAll(userColumns, ",", " ")), values: []driver.Value{
+		7, "jane", "jane@example.com", "Jane", "Doe", "", 1, LevelUser, now, now,
+		nil, "", "", nil, nil, "", 0}}, nil
+}
+
+type benchRows struct {
+	columns []string
+	values  []driver.Value
+	done    bool
+}
+
+func (r *benchRows) Columns() []string { return r.columns }
+func (r *benchRows) Close() error      { return nil }
+
+func (r *benchRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	copy(dest, r.values)
+
+	return nil
+}
@@ -4,27 +4,64 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
 	"encoding/base32"
 	"errors"
 	"net/http"
 	"strings"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 // START CRUD USERS
+// userColumns lists the users columns in the order scanUser reads them.
+const userColumns = `id, username, email, first_name, last_name, password, active, level, created_at, updated_at,
+	verified_at, pending_email, totp_secret, totp_enabled_at, last_login_at, last_login_ip, failed_logins`
+
+// scanUser reads the userColumns of one row into user, followed by any extra
+// columns selected after them. The TOTP secret is decrypted.
+func scanUser(row interface{ Scan(...any) error }, user *User, extra ...any) error {
+	dest := []any{
+		&user.ID,
+		&user.UserName,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password,
+		&user.Active,
+		&user.Level,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.VerifiedAt,
+		&user.PendingEmail,
+		&user.TOTPSecret,
+		&user.TOTPEnabledAt,
+		&user.LastLoginAt,
+		&user.LastLoginIP,
+		&user.FailedLogins,
+	}
+
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return err
+	}
+
+	user.TOTPSecret, err = decryptTOTPSecret(user.TOTPSecret, user.ID)
+	return err
+}
+
 func (u *User) GetAll() ([]*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
 	defer cancel()
 
 	query := `
-	select id, username, email, first_name, last_name, password, active, level, created_at, updated_at,
+	select ` + userColumns + `,
 	case
-		when (select count(id) from tokens t where user_id = users.id and t.expiry > NOW()) > 0
+		when (select count(id) from tokens t where user_id = users.id and t.scope = 'authentication' and t.expiry > NOW()) > 0
 		then 1
 		else 0
-	end as hash_token
+	end as hash_token,
+	(select max(s.last_seen_at) from sessions s where s.user_id = users.id) as last_seen_at
 	from users order by last_name
 	`
 
@@ -38,22 +75,16 @@ func (u *User) GetAll() ([]*User, error) {
 
 	for rows.Next() {
 		var user User
-		err := rows.Scan(
-			&user.ID,
-			&user.Email,
-			&user.FirstName,
-			&user.LastName,
-			&user.Password,
-			&user.Active,
-			&user.Level,
-			&user.CreatedAt,
-			&user.UpdatedAt,
-			&user.Token.ID,
-		)
+		err := scanUser(rows, &user, &user.Token.ID, &user.LastSeenAt)
 		if err != nil {
 			return nil, err
 		}
 
+		// sessions are removed when they end, so fall back to the last login
+		if user.LastSeenAt == nil {
+			user.LastSeenAt = user.LastLoginAt
+		}
+
 		users = append(users, &user)
 	}
 
@@ -64,23 +95,12 @@ func (u *User) GetOne(id int) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
 	defer cancel()
 
-	query := `select id, username, email, first_name, last_name, password, active, level, created_at, updated_at from users where id = $1`
+	query := `select ` + userColumns + ` from users where id = $1`
 
 	var user User
 	row := db.QueryRowContext(ctx, query, id)
 
-	err := row.Scan(
-		&user.ID,
-		&user.UserName,
-		&user.Email,
-		&user.FirstName,
-		&user.LastName,
-		&user.Password,
-		&user.Active,
-		&user.Level,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+	err := scanUser(row, &user)
 	if err != nil {
 		return nil, err
 	}
@@ -88,27 +108,22 @@ func (u *User) GetOne(id int) (*User, error) {
 	return &user, nil
 }
 
+// NormalizeEmail returns the form in which email addresses are stored and
+// compared: without surrounding spaces and in lower case.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
 func (u *User) GetByEmail(email string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
 	defer cancel()
 
-	query := `select id, username, email, first_name, last_name, password, active, level, created_at, updated_at from users where email = $1`
+	query := `select ` + userColumns + ` from users where email = $1`
 
 	var user User
-	row := db.QueryRowContext(ctx, query, email)
+	row := db.QueryRowContext(ctx, query, NormalizeEmail(email))
 
-	err := row.Scan(
-		&user.ID,
-		&user.UserName,
-		&user.Email,
-		&user.FirstName,
-		&user.LastName,
-		&user.Password,
-		&user.Active,
-		&user.Level,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+	err := scanUser(row, &user)
 
 	if err != nil {
 		return nil, err
@@ -117,27 +132,16 @@ func (u *User) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-func (u *User) GetByUsername(email string) (*User, error) {
+func (u *User) GetByUsername(username string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
 	defer cancel()
 
-	query := `select id, username, email, first_name, last_name, password, active, level, created_at, updated_at from users where username = $1`
+	query := `select ` + userColumns + ` from users where lower(username) = lower($1)`
 
 	var user User
-	row := db.QueryRowContext(ctx, query, email)
+	row := db.QueryRowContext(ctx, query, strings.TrimSpace(username))
 
-	err := row.Scan(
-		&user.ID,
-		&user.UserName,
-		&user.Email,
-		&user.FirstName,
-		&user.LastName,
-		&user.Password,
-		&user.Active,
-		&user.Level,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+	err := scanUser(row, &user)
 
 	if err != nil {
 		return nil, err
@@ -146,11 +150,61 @@ func (u *User) GetByUsername(email string) (*User, error) {
 	return &user, nil
 }
 
+// GetByLogin looks a user up by either username or email address, ignoring
+// case. The database keeps both identifiers unique across the two columns,
+// so at most one user can match.
+func (u *User) GetByLogin(identifier string) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	identifier = strings.TrimSpace(identifier)
+	if identifier == "" {
+		return nil, sql.ErrNoRows
+	}
+
+	query := `select ` + userColumns + ` from users where email = $1 or lower(username) = $1 limit 2`
+
+	rows, err := db.QueryContext(ctx, query, strings.ToLower(identifier))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		var user User
+		err := scanUser(rows, &user)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	switch len(users) {
+	case 0:
+		return nil, sql.ErrNoRows
+	case 1:
+		return users[0], nil
+	default:
+		return nil, ErrAmbiguousLogin
+	}
+}
+
 func (u *User) Insert(user User) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	err := CheckPassword(user.Password, user)
+	if err != nil {
+		return 0, err
+	}
+
+	hashedPassword, err := hashPassword(user.Password)
 	if err != nil {
 		return 0, err
 	}
@@ -162,8 +216,8 @@ func (u *User) Insert(user User) (int, error) {
 	`
 
 	err = db.QueryRowContext(ctx, stmt,
-		user.UserName,
-		user.Email,
+		strings.TrimSpace(user.UserName),
+		NormalizeEmail(user.Email),
 		user.FirstName,
 		user.LastName,
 		hashedPassword,
@@ -191,25 +245,39 @@ func (u *User) Update() error {
 		last_name = $4,
 		active = $5,
 		level = $6,
-		updated_at = $7
-		where id = $8
+		updated_at = $7,
+		pending_email = $8
+		from (select level from users where id = $9 for update) prev
+		where users.id = $9
+		returning prev.level
 	`
-	_, err := db.ExecContext(ctx, stmt,
-		u.UserName,
-		u.Email,
+	var previousLevel int
+	err := db.QueryRowContext(ctx, stmt,
+		strings.TrimSpace(u.UserName),
+		NormalizeEmail(u.Email),
 		u.FirstName,
 		u.LastName,
 		u.Active,
 		u.Level,
 		u.UpdatedAt,
+		NormalizeEmail(u.PendingEmail),
 		u.ID,
-	)
+	).Scan(&previousLevel)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// signed access tokens of a deactivated user must stop working at once,
+	// and those of a user whose level changed carry the old level
+	if u.Active == 0 || u.Level != previousLevel {
+		return revoke(ctx, db, UserSubject(u.ID))
+	}
 
+	// cached lookups still carry the old level and details
+	return invalidateTokens(ctx, db, UserSubject(u.ID))
 }
 
 func (u *User) DeleteByID(id int) error {
@@ -223,43 +291,111 @@ func (u *User) DeleteByID(id int) error {
 		return err
 	}
 
-	return nil
+	return revoke(ctx, db, UserSubject(id))
+}
+
+// VerifyEmail confirms that the user owns email. A confirmed pending email
+// replaces the current one.
+func (u *User) VerifyEmail(email string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	switch email {
+	case u.PendingEmail:
+	case u.Email:
+		if u.VerifiedAt != nil {
+			return ErrInvalidToken
+		}
+	default:
+		// the link was sent for an address the user no longer asks for
+		return ErrInvalidToken
+	}
+
+	stmt := `update users set email = $1, pending_email = '', verified_at = $2, updated_at = $2 where id = $3`
+	_, err := db.ExecContext(ctx, stmt, email, time.Now(), u.ID)
+
+	return err
 }
 
 // END CRUD USERS
 
 // START ABOUT PASSWORD
-// Matching password
+// Matching password. After a successful match, a password hashed with
+// another algorithm or other parameters than the configured hasher uses is
+// hashed again.
 func (u *User) PasswordMatches(plainText string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(plainText))
+	// invited users have no password until they accept; take as long as a
+	// real check so that they can't be told apart
+	if u.Password == "" {
+		return false, SimulatePasswordCheck(plainText)
+	}
 
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			// invalid password
-			return false, nil
-		default:
-			return false, err
-		}
+	valid, err := verifyPassword(u.Password, plainText)
+	if err != nil || !valid {
+		return false, err
+	}
+
+	if passwordHasher.Outdated(u.Password) {
+		// a failed rehash is not fatal; it is tried again at the next login
+		_ = u.rehashPassword(plainText)
 	}
 
 	return true, nil
 }
 
-// Reset password
+// rehashPassword replaces the stored hash with one made by the configured
+// hasher, unless the password was changed in the meantime.
+func (u *User) rehashPassword(plainText string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	hashedPassword, err := hashPassword(plainText)
+	if err != nil {
+		return err
+	}
+
+	stmt := `update users set password = $1 where id = $2 and password = $3`
+	_, err = db.ExecContext(ctx, stmt, hashedPassword, u.ID, u.Password)
+	if err != nil {
+		return err
+	}
+
+	u.Password = hashedPassword
+	return nil
+}
+
+// SimulatePasswordCheck spends the time of a password check without checking
+// anything, so that a login for an unknown account takes as long as one with
+// a wrong password. It only fails with ErrHashPoolBusy.
+func SimulatePasswordCheck(plainText string) error {
+	_, err := verifyPassword(dummyHash(), plainText)
+	if errors.Is(err, ErrHashPoolBusy) {
+		return err
+	}
+
+	return nil
+}
+
+// Reset password. The new password has to satisfy the password policy,
+// otherwise a *PasswordPolicyError is returned.
 func (u *User) ResetPassword(password string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	err := CheckPassword(password, *u)
 	if err != nil {
-		return nil
+		return err
+	}
+
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
 	}
 
 	stmt := `update users set password = $1 where id = $2`
 	_, err = db.ExecContext(ctx, stmt, hashedPassword, u.ID)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	return nil
@@ -268,24 +404,37 @@ func (u *User) ResetPassword(password string) error {
 // END ABOUT PASSWORD
 
 // START GET TOKEN
+// hashToken returns the sha256 hash of a plain text token. Only this hash is
+// ever stored in, or looked up from, the tokens table.
+func hashToken(plainText string) []byte {
+	hash := sha256.Sum256([]byte(plainText))
+	return hash[:]
+}
+
 func (t *Token) GetByToken(plainText string) (*Token, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
 	defer cancel()
 
-	query := `select id, user_id, username, email, token, token_hash, created_at, updated_at, expiry from tokens where token = $1`
+	query := `select id, user_id, username, email, token_hash, scope, family, used_at, created_at, updated_at, expiry, impersonator_id,
+		binding_hash
+		from tokens where token_hash = $1`
 
 	var token Token
-	row := db.QueryRowContext(ctx, query, plainText)
+	row := db.QueryRowContext(ctx, query, hashToken(plainText))
 	err := row.Scan(
 		&token.ID,
 		&token.UserID,
 		&token.UserName,
 		&token.Email,
-		&token.Token,
 		&token.TokenHash,
+		&token.Scope,
+		&token.Family,
+		&token.UsedAt,
 		&token.CreatedAt,
 		&token.UpdatedAt,
 		&token.Expiry,
+		&token.ImpersonatorID,
+		&token.BindingHash,
 	)
 	if err != nil {
 		return nil, err
@@ -298,23 +447,12 @@ func (t *Token) GetUserForToken(token Token) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
 	defer cancel()
 
-	query := `select id, username, email, first_name, last_name, password, active, level, created_at, updated_at from users where id = $1`
+	query := `select ` + userColumns + ` from users where id = $1`
 
 	var user User
 	row := db.QueryRowContext(ctx, query, token.UserID)
 
-	err := row.Scan(
-		&user.ID,
-		&user.UserName,
-		&user.Email,
-		&user.FirstName,
-		&user.LastName,
-		&user.Password,
-		&user.Active,
-		&user.Level,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+	err := scanUser(row, &user)
 	if err != nil {
 		return nil, err
 	}
@@ -325,6 +463,7 @@ func (t *Token) GetUserForToken(token Token) (*User, error) {
 func (t *Token) GenerateToken(UserID int, ttl time.Duration) (*Token, error) {
 	token := &Token{
 		UserID: UserID,
+		Scope:  ScopeAuthentication,
 		Expiry: time.Now().Add(ttl),
 	}
 
@@ -335,14 +474,248 @@ func (t *Token) GenerateToken(UserID int, ttl time.Duration) (*Token, error) {
 	}
 
 	token.Token = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
-	hash := sha256.Sum256([]byte(token.Token))
-	token.TokenHash = hash[:]
+	token.TokenHash = hashToken(token.Token)
+
+	return token, nil
+}
+
+// GenerateRefreshToken creates a refresh token for the given token family.
+func (t *Token) GenerateRefreshToken(UserID int, family string, ttl time.Duration) (*Token, error) {
+	token, err := t.GenerateToken(UserID, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Scope = ScopeRefresh
+	token.Family = family
+
+	return token, nil
+}
+
+// GenerateImpersonationToken creates an access token that lets the admin
+// impersonatorID act as the user. It belongs to no session and can't be
+// refreshed.
+func (t *Token) GenerateImpersonationToken(UserID, impersonatorID int, ttl time.Duration) (*Token, error) {
+	token, err := t.GenerateToken(UserID, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	token.ImpersonatorID = &impersonatorID
 
 	return token, nil
 }
 
+// GenerateMagicLinkToken creates a login link token bound to binding, a
+// nonce held by the browser that asked for the link.
+func (t *Token) GenerateMagicLinkToken(UserID int, binding string, ttl time.Duration) (*Token, error) {
+	token, err := t.GenerateToken(UserID, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Scope = ScopeMagicLink
+	token.BindingHash = hashToken(binding)
+
+	return token, nil
+}
+
+// BoundTo reports whether the token was issued to the browser holding
+// binding.
+func (t *Token) BoundTo(binding string) bool {
+	return len(t.BindingHash) > 0 && subtle.ConstantTimeCompare(t.BindingHash, hashToken(binding)) == 1
+}
+
+// CapExpiry makes sure the token does not expire after limit.
+func (t *Token) CapExpiry(limit time.Time) {
+	if t.Expiry.After(limit) {
+		t.Expiry = limit
+	}
+}
+
+// NewFamily returns a random id that ties an access token to the refresh
+// tokens rotated from the same login.
+func (t *Token) NewFamily() (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
 // END GET TOKEN
 
+// START REFRESH TOKEN
+// Rotate exchanges a refresh token for a new access token and a new refresh
+// token of the same family. A refresh token can only be used once; presenting
+// it a second time revokes every token of its family. The new access token
+// follows the session policy of the user's level, and neither token outlives
+// the session.
+//
+// When opaqueAccess is false no access token is stored or returned, because
+// the caller issues a signed one instead.
+func (t *Token) Rotate(plainText string, refreshTTL time.Duration, opaqueAccess bool) (*Token, *Token, *User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer tx.Rollback()
+
+	query := `select t.id, t.user_id, t.scope, t.family, t.used_at, t.expiry, coalesce(s.expires_at, t.expiry),
+		s.last_seen_at
+		from tokens t left join sessions s on s.id = t.family
+		where t.token_hash = $1 for update of t`
+
+	var current Token
+	var sessionExpiry time.Time
+	var lastSeen *time.Time
+	err = tx.QueryRowContext(ctx, query, hashToken(plainText)).Scan(
+		&current.ID,
+		&current.UserID,
+		&current.Scope,
+		&current.Family,
+		&current.UsedAt,
+		&current.Expiry,
+		&sessionExpiry,
+		&lastSeen,
+	)
+	if err != nil {
+		return nil, nil, nil, ErrInvalidRefreshToken
+	}
+
+	if current.Scope != ScopeRefresh {
+		return nil, nil, nil, ErrInvalidRefreshToken
+	}
+
+	if current.UsedAt != nil {
+		// the token has already been rotated, so somebody is replaying it
+		err = deleteSession(ctx, tx, current.Family)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		return nil, nil, nil, ErrRefreshTokenReused
+	}
+
+	if current.Expiry.Before(time.Now()) || sessionExpiry.Before(time.Now()) {
+		return nil, nil, nil, ErrInvalidRefreshToken
+	}
+
+	user, err := t.GetUserForToken(current)
+	if err != nil || user.Active == 0 {
+		return nil, nil, nil, ErrInvalidRefreshToken
+	}
+
+	// a refresh token outlives the idle timeout, but mustn't revive a session
+	// that has been idle for longer
+	if lastSeen != nil && time.Since(*lastSeen) > SessionPolicyFor(user.Level).IdleTimeout {
+		return nil, nil, nil, ErrInvalidRefreshToken
+	}
+
+	stmt := `update tokens set used_at = $1, updated_at = $1 where id = $2`
+	_, err = tx.ExecContext(ctx, stmt, time.Now(), current.ID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// access tokens issued from earlier refreshes of this family are retired
+	stmt = `delete from tokens where family = $1 and scope = $2`
+	_, err = tx.ExecContext(ctx, stmt, current.Family, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	err = invalidateTokens(ctx, tx, SessionSubject(current.Family))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	stmt = `update sessions set last_seen_at = $1 where id = $2`
+	_, err = tx.ExecContext(ctx, stmt, time.Now(), current.Family)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	refresh, err := t.GenerateRefreshToken(user.ID, current.Family, refreshTTL)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	refresh.CapExpiry(sessionExpiry)
+
+	issued := []*Token{refresh}
+
+	var access *Token
+	if opaqueAccess {
+		access, err = t.GenerateToken(user.ID, SessionPolicyFor(user.Level).IdleTimeout)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		access.Family = current.Family
+		access.CapExpiry(sessionExpiry)
+
+		issued = append(issued, access)
+	}
+
+	for _, token := range issued {
+		token.UserName = user.UserName
+		token.Email = user.Email
+
+		err = insertToken(ctx, tx, *token)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return access, refresh, user, nil
+}
+
+// END REFRESH TOKEN
+
+// START ONE-OFF TOKEN
+// Consume looks up a token of the given scope, deletes it so that it cannot be
+// used again and returns it with its user. ErrInvalidToken is returned for
+// unknown, expired or wrongly scoped tokens.
+func (t *Token) Consume(plainText, scope string) (*Token, *User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	query := `delete from tokens where token_hash = $1 and scope = $2 returning user_id, email, expiry`
+
+	var token Token
+	err := db.QueryRowContext(ctx, query, hashToken(plainText), scope).Scan(&token.UserID, &token.Email, &token.Expiry)
+	if err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+
+	if token.Expiry.Before(time.Now()) {
+		return nil, nil, ErrInvalidToken
+	}
+
+	user, err := t.GetUserForToken(token)
+	if err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+
+	return &token, user, nil
+}
+
+// END ONE-OFF TOKEN
+
 // START AUTHENTICATE TOKEN
 func (t *Token) AuthenticateToken(r *http.Request) (*User, error) {
 	// Get authorization header
@@ -357,72 +730,152 @@ func (t *Token) AuthenticateToken(r *http.Request) (*User, error) {
 		return nil, errors.New("No valid authorization header received")
 	}
 
-	token := headerParts[1]
+	user, _, err := t.Authenticate(headerParts[1])
+
+	return user, err
+}
 
+// Authenticate returns the user of a plain text access token, along with the
+// token itself so that callers know which session the request belongs to.
+func (t *Token) Authenticate(token string) (*User, *Token, error) {
 	// Check if the token length is correct
 	if len(token) != 26 {
-		return nil, errors.New("Token wrong size")
+		return nil, nil, errors.New("Token wrong size")
 	}
 
-	// Get token from db, using plain text token
+	// Recently used tokens are served from the cache
+	key := string(hashToken(token))
+	if tkn, user, ok := tokenLookups.get(key); ok {
+		if tkn.Expiry.Before(time.Now()) {
+			return nil, nil, errors.New("Token is expired")
+		}
+		if tkn.Family != "" && time.Since(tkn.UpdatedAt) >= SessionRenewInterval {
+			policy := SessionPolicyFor(user.Level)
+			_ = t.renew(*tkn, time.Now().Add(policy.IdleTimeout))
+			tokenLookups.forget(key)
+		}
+
+		return user, tkn, nil
+	}
+
+	// Get token from db, using the hash of the plain text token
 	tkn, err := t.GetByToken(token)
 	if err != nil {
-		return nil, errors.New("No matching token found")
+		return nil, nil, errors.New("No matching token found")
+	}
+
+	// Refresh tokens can only be exchanged, never used as a bearer token
+	if tkn.Scope != ScopeAuthentication {
+		return nil, nil, errors.New("No matching token found")
 	}
 
 	// Check if token expired
 	if tkn.Expiry.Before(time.Now()) {
-		return nil, errors.New("Token is expired")
+		return nil, nil, errors.New("Token is expired")
 	}
 
 	// Get the user associated with the token
 	user, err := t.GetUserForToken(*tkn)
 	if err != nil {
-		return nil, errors.New("No matching user found")
+		return nil, nil, errors.New("No matching user found")
 	}
 
 	if user.Active == 0 {
-		return nil, errors.New("User not active")
+		return nil, nil, errors.New("User not active")
+	}
+
+	// Slide the idle timeout, writing at most once per SessionRenewInterval.
+	// A renewed token is cached on its next use, with its new expiry.
+	if tkn.Family != "" && time.Since(tkn.UpdatedAt) >= SessionRenewInterval {
+		policy := SessionPolicyFor(user.Level)
+		_ = t.renew(*tkn, time.Now().Add(policy.IdleTimeout))
+	} else {
+		tokenLookups.put(key, *tkn, *user)
+	}
+
+	return user, tkn, nil
+}
+
+// renew moves the expiry of an access token forward, never past the absolute
+// expiry of its session, and records the session as just used.
+func (t *Token) renew(token Token, expiry time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
+	defer cancel()
+
+	stmt := `update tokens set expiry = least($1, s.expires_at), updated_at = $2
+		from sessions s where tokens.id = $3 and s.id = tokens.family`
+	_, err := db.ExecContext(ctx, stmt, expiry, time.Now(), token.ID)
+	if err != nil {
+		return err
 	}
 
-	return user, nil
+	stmt = `update sessions set last_seen_at = $1 where id = $2`
+	_, err = db.ExecContext(ctx, stmt, time.Now(), token.Family)
+
+	return err
 }
 
 // END AUTHENTICATE TOKEN
 
-// Insert token
+// Insert stores a single token. Only the latest token of a one-off scope,
+// such as a password reset, stays valid for a user.
 func (t *Token) Insert(token Token, u User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
 	defer cancel()
 
-	stmt := `delete from tokens where user_id = $1`
-	_, err := db.ExecContext(ctx, stmt, token.UserID)
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	token.Email = u.Email
+	if token.Scope != ScopeAuthentication && token.Scope != ScopeRefresh {
+		stmt := `delete from tokens where user_id = $1 and scope = $2`
+		_, err = tx.ExecContext(ctx, stmt, token.UserID, token.Scope)
+		if err != nil {
+			return err
+		}
+	}
+
+	token.UserName = u.UserName
+	if token.Email == "" {
+		token.Email = u.Email
+	}
+
+	err = insertToken(ctx, tx, token)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
 
-	stmt = `insert into tokens(user_id, username, email, token, token_hash, created_at, updated_at, expiry)
-		values($1, $2, $3, $4, $5, $6, $7, $8)`
+// insertToken writes a single token inside tx. The plain text token is never
+// persisted, only its hash.
+func insertToken(ctx context.Context, tx *sql.Tx, token Token) error {
+	if token.Scope == "" {
+		token.Scope = ScopeAuthentication
+	}
+
+	stmt := `insert into tokens(user_id, username, email, token_hash, scope, family, created_at, updated_at, expiry, impersonator_id,
+		binding_hash)
+		values($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
 
-	_, err = db.ExecContext(ctx, stmt,
+	_, err := tx.ExecContext(ctx, stmt,
 		token.UserID,
 		token.UserName,
 		token.Email,
-		token.Token,
 		token.TokenHash,
+		token.Scope,
+		token.Family,
 		time.Now(),
 		time.Now(),
 		token.Expiry,
+		token.ImpersonatorID,
+		token.BindingHash,
 	)
 
-	if err != nil {
-		return err
-	}
-
-	return nil
-
+	return err
 }
 
 // Delete a token
@@ -430,16 +883,41 @@ func (t *Token) DeleteByToken(plainText string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
 	defer cancel()
 
-	stmt := `delete from tokens where token = $1`
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var family string
+	query := `select family from tokens where token_hash = $1`
+	err = tx.QueryRowContext(ctx, query, hashToken(plainText)).Scan(&family)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
 
-	_, err := db.ExecContext(ctx, stmt, plainText)
+	// logging out ends the whole session, so the refresh token issued
+	// alongside the access token is removed as well
+	if family != "" {
+		err = deleteSession(ctx, tx, family)
+	} else {
+		_, err = tx.ExecContext(ctx, `delete from tokens where token_hash = $1`, hashToken(plainText))
+		if err == nil {
+			err = invalidateTokens(ctx, tx, tokenSubject(hashToken(plainText)))
+		}
+	}
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
+// DeleteTokensForUser logs the user out everywhere: their tokens, sessions
+// and API keys are deleted and their signed access tokens revoked.
 func (t *Token) DeleteTokensForUser(user_id int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeOut)
 	defer cancel()
@@ -449,12 +927,25 @@ func (t *Token) DeleteTokensForUser(user_id int) error {
 	if err != nil {
 		return err
 	}
-	return nil
+
+	stmt = "delete from sessions where user_id = $1"
+	_, err = db.ExecContext(ctx, stmt, user_id)
+	if err != nil {
+		return err
+	}
+
+	stmt = "delete from api_keys where user_id = $1"
+	_, err = db.ExecContext(ctx, stmt, user_id)
+	if err != nil {
+		return err
+	}
+
+	return revoke(ctx, db, UserSubject(user_id))
 }
 
 func (t *Token) ValidToken(plainText string) (bool, error) {
 	token, err := t.GetByToken(plainText)
-	if err != nil {
+	if err != nil || token.Scope != ScopeAuthentication {
 		return false, errors.New("No matching token found")
 	}
 
@@ -0,0 +1,235 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestUpdateRevokesTokens(t *testing.T) {
+	tests := []struct {
+		name          string
+		active        int
+		level         int
+		previousLevel int
+		revoke        bool
+	}{
+		{"details only", 1, LevelUser, LevelUser, false},
+		{"demoted", 1, LevelUser, LevelAdmin, true},
+		{"promoted", 1, LevelAdmin, LevelUser, true},
+		{"deactivated", 0, LevelUser, LevelUser, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDB(t)
+
+			var revoked []string
+			previous := revocationHook
+			revocationHook = func(subject string, _ time.Time) { revoked = append(revoked, subject) }
+			t.Cleanup(func() { revocationHook = previous })
+
+			mock.ExpectQuery(`update users set .* returning prev.level`).
+				WillReturnRows(sqlmock.NewRows([]string{"level"}).AddRow(tt.previousLevel))
+			if tt.revoke {
+				mock.ExpectExec(`insert into revocations`).WithArgs("uid:7", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			mock.ExpectExec(`select pg_notify`).WithArgs(tokenCacheChannel, "uid:7").
+				WillReturnResult(sqlmock.NewResult(0, 0))
+
+			user := &User{ID: 7, UserName: "jane", Email: "jane@example.com", Active: tt.active, Level: tt.level}
+			err := user.Update()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := len(revoked) == 1 && revoked[0] == "uid:7"; got != tt.revoke {
+				t.Errorf("revoked %q, want revocation %v", revoked, tt.revoke)
+			}
+
+			err = mock.ExpectationsWereMet()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestDeleteTokensForUserRevokesAPIKeys(t *testing.T) {
+	mock := newMockDB(t)
+
+	for _, table := range []string{"tokens", "sessions", "api_keys"} {
+		mock.ExpectExec(`delete from ` + table + ` where user_id = \$1`).WithArgs(7).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectExec(`insert into revocations`).WithArgs("uid:7", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`select pg_notify`).WithArgs(tokenCacheChannel, "uid:7").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	var token Token
+	err := token.DeleteTokensForUser(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// expectRefreshLookup expects Rotate to look up a refresh token, with the
+// absolute expiry of its session and when the session was last used.
+func expectRefreshLookup(mock sqlmock.Sqlmock, plainText, scope string, usedAt *time.Time, expiry, sessionExpiry, lastSeen time.Time) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`from tokens t left join sessions s on s.id = t.family`).WithArgs(hashToken(plainText)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "scope", "family", "used_at", "expiry", "expires_at", "last_seen_at"}).
+			AddRow(1, 7, scope, "s1", usedAt, expiry, sessionExpiry, lastSeen))
+}
+
+func TestRotate(t *testing.T) {
+	const plainText = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	mock := newMockDB(t)
+
+	now := time.Now()
+	sessionExpiry := now.Add(time.Hour)
+	user := User{ID: 7, UserName: "jane", Email: "jane@example.com", Active: 1, Level: LevelUser}
+
+	expectRefreshLookup(mock, plainText, ScopeRefresh, nil, now.Add(24*time.Hour), sessionExpiry, now.Add(-29*time.Minute))
+	mock.ExpectQuery(`from users where id = \$1`).WithArgs(7).WillReturnRows(userRows(user))
+	mock.ExpectExec(`update tokens set used_at = \$1, updated_at = \$1 where id = \$2`).WithArgs(sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`delete from tokens where family = \$1 and scope = \$2`).WithArgs("s1", ScopeAuthentication).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`select pg_notify`).WithArgs(tokenCacheChannel, "sid:s1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`update sessions set last_seen_at = \$1 where id = \$2`).WithArgs(sqlmock.AnyArg(), "s1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	for _, scope := range []string{ScopeRefresh, ScopeAuthentication} {
+		mock.ExpectExec(`insert into tokens`).
+			WithArgs(7, "jane", "jane@example.com", sqlmock.AnyArg(), scope, "s1", sqlmock.AnyArg(), sqlmock.AnyArg(),
+				sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	var token Token
+	access, refresh, got, err := token.Rotate(plainText, 24*time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 7 || access.Family != "s1" || refresh.Family != "s1" || refresh.Scope != ScopeRefresh {
+		t.Errorf("got user %d, access %+v, refresh %+v", got.ID, access, refresh)
+	}
+	// no token outlives the session
+	if refresh.Expiry.After(sessionExpiry) || access.Expiry.After(sessionExpiry) {
+		t.Errorf("refresh expires %s, access %s, after the session at %s", refresh.Expiry, access.Expiry, sessionExpiry)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestRotateReusedToken checks that replaying a rotated refresh token ends
+// the whole session it belongs to.
+func TestRotateReusedToken(t *testing.T) {
+	const plainText = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	mock := newMockDB(t)
+
+	var revoked []string
+	previous := revocationHook
+	revocationHook = func(subject string, _ time.Time) { revoked = append(revoked, subject) }
+	t.Cleanup(func() { revocationHook = previous })
+
+	now := time.Now()
+	usedAt := now.Add(-time.Minute)
+
+	expectRefreshLookup(mock, plainText, ScopeRefresh, &usedAt, now.Add(time.Hour), now.Add(time.Hour), usedAt)
+	mock.ExpectExec(`delete from tokens where family = \$1`).WithArgs("s1").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`delete from sessions where id = \$1`).WithArgs("s1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`insert into revocations`).WithArgs("sid:s1", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`select pg_notify`).WithArgs(tokenCacheChannel, "sid:s1").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	var token Token
+	_, _, _, err := token.Rotate(plainText, time.Hour, true)
+	if err != ErrRefreshTokenReused {
+		t.Fatalf("got %v, want ErrRefreshTokenReused", err)
+	}
+	if len(revoked) != 1 || revoked[0] != "sid:s1" {
+		t.Errorf("revoked %q, want sid:s1", revoked)
+	}
+
+	err = mock.ExpectationsWereMet()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRotateRefuses(t *testing.T) {
+	const plainText = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	now := time.Now()
+	recently := now.Add(-time.Minute)
+	user := User{ID: 7, Active: 1, Level: LevelUser}
+	admin := User{ID: 7, Active: 1, Level: LevelAdmin}
+
+	previousDefault, previousLevels := defaultSessionPolicy, levelSessionPolicies
+	SetSessionPolicies(SessionPolicy{IdleTimeout: 30 * time.Minute, AbsoluteLifetime: 12 * time.Hour},
+		map[int]SessionPolicy{LevelAdmin: {IdleTimeout: 5 * time.Minute, AbsoluteLifetime: time.Hour}})
+	t.Cleanup(func() { SetSessionPolicies(previousDefault, previousLevels) })
+
+	tests := []struct {
+		name   string
+		expect func(mock sqlmock.Sqlmock)
+	}{
+		{"unknown token", func(mock sqlmock.Sqlmock) {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`from tokens t`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		}},
+		{"access token", func(mock sqlmock.Sqlmock) {
+			expectRefreshLookup(mock, plainText, ScopeAuthentication, nil, now.Add(time.Hour), now.Add(time.Hour), recently)
+		}},
+		{"expired token", func(mock sqlmock.Sqlmock) {
+			expectRefreshLookup(mock, plainText, ScopeRefresh, nil, now.Add(-time.Second), now.Add(time.Hour), recently)
+		}},
+		{"past the absolute lifetime", func(mock sqlmock.Sqlmock) {
+			expectRefreshLookup(mock, plainText, ScopeRefresh, nil, now.Add(time.Hour), now.Add(-time.Second), recently)
+		}},
+		{"idle session", func(mock sqlmock.Sqlmock) {
+			expectRefreshLookup(mock, plainText, ScopeRefresh, nil, now.Add(time.Hour), now.Add(time.Hour), now.Add(-31*time.Minute))
+			mock.ExpectQuery(`from users where id = \$1`).WithArgs(7).WillReturnRows(userRows(user))
+		}},
+		{"idle past the timeout of the level", func(mock sqlmock.Sqlmock) {
+			expectRefreshLookup(mock, plainText, ScopeRefresh, nil, now.Add(time.Hour), now.Add(time.Hour), now.Add(-6*time.Minute))
+			mock.ExpectQuery(`from users where id = \$1`).WithArgs(7).WillReturnRows(userRows(admin))
+		}},
+		{"inactive user", func(mock sqlmock.Sqlmock) {
+			expectRefreshLookup(mock, plainText, ScopeRefresh, nil, now.Add(time.Hour), now.Add(time.Hour), recently)
+			mock.ExpectQuery(`from users where id = \$1`).WithArgs(7).WillReturnRows(userRows(User{ID: 7, Active: 0}))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			tt.expect(mock)
+			mock.ExpectRollback()
+
+			var token Token
+			_, _, _, err := token.Rotate(plainText, time.Hour, true)
+			if err != ErrInvalidRefreshToken {
+				t.Errorf("got %v, want ErrInvalidRefreshToken", err)
+			}
+
+			err = mock.ExpectationsWereMet()
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
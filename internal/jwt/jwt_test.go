@@ -0,0 +1,312 @@
+package jwt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newClaims() Claims {
+	now := time.Now()
+
+	return Claims{
+		Subject:   "7",
+		ID:        "jti-1",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(5 * time.Minute).Unix(),
+		UserID:    7,
+		Level:     10,
+		SessionID: "s-1",
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	for _, alg := range []string{EdDSA, RS256} {
+		t.Run(alg, func(t *testing.T) {
+			ks, err := NewKeySet(alg, "dss-api", "", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			token, err := ks.Sign(newClaims())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			claims, err := ks.Verify(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := newClaims()
+			want.Issuer = "dss-api"
+			want.IssuedAt, want.ExpiresAt = claims.IssuedAt, claims.ExpiresAt
+			if *claims != want {
+				t.Errorf("claims = %+v, want %+v", *claims, want)
+			}
+		})
+	}
+}
+
+func TestVerifyRefuses(t *testing.T) {
+	ks, err := NewKeySet(EdDSA, "dss-api", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(ks *KeySet, claims Claims) string {
+		token, err := ks.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	valid := sign(ks, newClaims())
+	parts := strings.Split(valid, ".")
+
+	expired := newClaims()
+	expired.ExpiresAt = time.Now().Add(-leeway - time.Minute).Unix()
+
+	// a payload raising the level, under the original signature
+	raised := newClaims()
+	raised.Level = 100
+	forged := strings.Split(sign(ks, raised), ".")[1]
+
+	other, err := NewKeySet(EdDSA, "other", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"not a JWS", "abc", ErrMalformed},
+		{"bad header", "!." + parts[1] + "." + parts[2], ErrMalformed},
+		{"bad signature encoding", parts[0] + "." + parts[1] + ".!", ErrMalformed},
+		{"tampered payload", parts[0] + "." + forged + "." + parts[2], ErrSignature},
+		{"truncated signature", parts[0] + "." + parts[1] + "." + parts[2][:10], ErrSignature},
+		{"unknown key", sign(other, newClaims()), ErrSignature},
+		{"algorithm from the header", b64.EncodeToString([]byte(`{"alg":"none","kid":"x"}`)) + "." + parts[1] + ".", ErrSignature},
+		{"expired", sign(ks, expired), ErrExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ks.Verify(tt.token)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerifyIssuer(t *testing.T) {
+	dir := t.TempDir()
+
+	ks, err := NewKeySet(EdDSA, "dss-api", dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another issuer sharing the key directory
+	other, err := NewKeySet(EdDSA, "other", dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := other.Sign(newClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ks.Verify(token)
+	if !errors.Is(err, ErrIssuer) {
+		t.Errorf("err = %v, want %v", err, ErrIssuer)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	ks, err := NewKeySet(EdDSA, "dss-api", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := ks.Sign(newClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ks.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := ks.Sign(newClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both keys are published and tokens of either verify
+	jwks := ks.JWKS()
+	if len(jwks) != 2 {
+		t.Fatalf("%d keys published, want 2", len(jwks))
+	}
+
+	for _, token := range []string{before, after} {
+		h, _, _, err := parse(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = ks.Verify(token)
+		if err != nil {
+			t.Errorf("token of key %s: %v", h.Kid, err)
+		}
+	}
+
+	h, _, _, _ := parse(after)
+	if h.Kid != jwks[0].Kid {
+		t.Errorf("new tokens are signed with %s, not the newest key %s", h.Kid, jwks[0].Kid)
+	}
+
+	// the first key goes once its successor is older than retention
+	ks.keys[0].CreatedAt = time.Now().Add(-2 * time.Hour)
+	err = ks.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(ks.JWKS()); n != 2 {
+		t.Errorf("%d keys published after retention, want 2", n)
+	}
+
+	_, err = ks.Verify(before)
+	if !errors.Is(err, ErrSignature) {
+		t.Errorf("token of a dropped key: err = %v, want %v", err, ErrSignature)
+	}
+
+	_, err = ks.Verify(after)
+	if err != nil {
+		t.Errorf("token of a retired key within retention: %v", err)
+	}
+}
+
+func TestKeysSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	ks, err := NewKeySet(RS256, "dss-api", dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := ks.Sign(newClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewKeySet(RS256, "dss-api", dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = restarted.Verify(token)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if got, want := restarted.JWKS()[0].Kid, ks.JWKS()[0].Kid; got != want {
+		t.Errorf("key id %s after restart, want %s", got, want)
+	}
+}
+
+// TestRotateIfDue shares a key directory between two instances: the first to
+// find the key due rotates it, and the other one takes over its key.
+func TestRotateIfDue(t *testing.T) {
+	dir := t.TempDir()
+
+	a, err := NewKeySet(EdDSA, "dss-api", dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewKeySet(EdDSA, "dss-api", dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.JWKS()[0].Kid != b.JWKS()[0].Kid {
+		t.Fatal("the second instance made a key of its own")
+	}
+
+	rotated, err := a.RotateIfDue(time.Hour)
+	if err != nil || rotated {
+		t.Fatalf("rotated a fresh key: %v, %v", rotated, err)
+	}
+
+	old := a.JWKS()[0].Kid
+	due := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(filepath.Join(dir, old+".pem"), due, due)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err = a.RotateIfDue(time.Hour)
+	if err != nil || !rotated {
+		t.Fatalf("didn't rotate a due key: %v, %v", rotated, err)
+	}
+
+	rotated, err = b.RotateIfDue(time.Hour)
+	if err != nil || rotated {
+		t.Fatalf("rotated a key rotated by the other instance: %v, %v", rotated, err)
+	}
+
+	jwks := b.JWKS()
+	if jwks[0].Kid != a.JWKS()[0].Kid || jwks[0].Kid == old {
+		t.Errorf("signing with %s, want the new key %s", jwks[0].Kid, a.JWKS()[0].Kid)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 2 {
+		t.Errorf("key directory holds %v", files)
+	}
+}
+
+// TestVerifyReloadsUnknownKey verifies a token signed with a key another
+// instance has just added.
+func TestVerifyReloadsUnknownKey(t *testing.T) {
+	dir := t.TempDir()
+
+	a, err := NewKeySet(EdDSA, "dss-api", dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewKeySet(EdDSA, "dss-api", dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := a.Sign(newClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the directory was only just read, so it isn't read again yet
+	_, err = b.Verify(token)
+	if !errors.Is(err, ErrSignature) {
+		t.Errorf("err = %v, want %v", err, ErrSignature)
+	}
+
+	b.loadedAt = time.Now().Add(-reloadInterval)
+	_, err = b.Verify(token)
+	if err != nil {
+		t.Errorf("token of the other instance's new key: %v", err)
+	}
+}
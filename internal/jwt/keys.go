@@ -0,0 +1,399 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key is one signing key of a KeySet.
+type Key struct {
+	ID        string
+	Alg       string
+	CreatedAt time.Time
+	private   crypto.Signer
+	public    crypto.PublicKey
+}
+
+// JWK is the public part of a key as published in a JWKS document.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// reloadInterval is how often, at most, a token signed with an unknown key
+// makes Verify reread the key directory.
+const reloadInterval = 10 * time.Second
+
+// KeySet holds the key new tokens are signed with and the retired keys that
+// tokens issued earlier may still be signed with. When dir is set, keys are
+// stored there as PKCS#8 PEM files so that they survive restarts and can be
+// shared by several instances.
+type KeySet struct {
+	mu        sync.RWMutex
+	alg       string
+	issuer    string
+	dir       string
+	retention time.Duration
+	keys      []*Key // newest first
+	loadedAt  time.Time
+}
+
+// NewKeySet loads the keys found in dir, or generates a first key when there
+// are none. Retired keys stay available for verification for retention after
+// they were replaced.
+func NewKeySet(alg, issuer, dir string, retention time.Duration) (*KeySet, error) {
+	if alg != EdDSA && alg != RS256 {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+
+	ks := &KeySet{alg: alg, issuer: issuer, dir: dir, retention: retention}
+
+	err := ks.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ks.keys) == 0 || ks.keys[0].Alg != alg {
+		err := ks.Rotate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ks, nil
+}
+
+// Rotate makes a freshly generated key the signing key and drops retired keys
+// whose retention has passed.
+func (ks *KeySet) Rotate() error {
+	key, err := generateKey(ks.alg)
+	if err != nil {
+		return err
+	}
+
+	if ks.dir != "" {
+		err = writeKey(ks.dir, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.keys = append([]*Key{key}, ks.keys...)
+
+	// a key is dropped once the key that replaced it is older than retention
+	for i := 1; i < len(ks.keys); i++ {
+		if time.Since(ks.keys[i-1].CreatedAt) > ks.retention {
+			for _, old := range ks.keys[i:] {
+				if ks.dir != "" {
+					_ = os.Remove(filepath.Join(ks.dir, old.ID+".pem"))
+				}
+			}
+			ks.keys = ks.keys[:i]
+			break
+		}
+	}
+
+	return nil
+}
+
+// RotateIfDue rereads the key directory and rotates when the newest key is
+// older than every. Instances sharing the directory should call it one at a
+// time: the first to find the key due replaces it, and the others pick up its
+// key instead of making their own.
+func (ks *KeySet) RotateIfDue(every time.Duration) (bool, error) {
+	err := ks.Reload()
+	if err != nil {
+		return false, err
+	}
+
+	ks.mu.RLock()
+	due := len(ks.keys) == 0 || time.Since(ks.keys[0].CreatedAt) >= every
+	ks.mu.RUnlock()
+
+	if !due {
+		return false, nil
+	}
+
+	return true, ks.Rotate()
+}
+
+// Reload rereads the key directory, picking up the keys that other instances
+// sharing it have added or dropped. Without a directory it does nothing.
+func (ks *KeySet) Reload() error {
+	if ks.dir == "" {
+		return nil
+	}
+
+	keys, err := loadKeys(ks.dir)
+	if err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.loadedAt = time.Now()
+	// an emptied directory leaves the keys in use alone
+	if len(keys) > 0 {
+		ks.keys = keys
+	}
+
+	return nil
+}
+
+// Sign returns claims as a token signed with the current key. The issuer is
+// filled in from the key set.
+func (ks *KeySet) Sign(claims Claims) (string, error) {
+	ks.mu.RLock()
+	key := ks.keys[0]
+	ks.mu.RUnlock()
+
+	claims.Issuer = ks.issuer
+
+	return sign(key, claims)
+}
+
+// Verify checks the signature, issuer and expiry of token and returns its
+// claims.
+func (ks *KeySet) Verify(token string) (*Claims, error) {
+	h, signingInput, signature, err := parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key may have been added by another instance since the last reload
+	key := ks.key(h.Kid)
+	if key == nil && ks.reloadDue() {
+		err = ks.Reload()
+		if err != nil {
+			return nil, err
+		}
+		key = ks.key(h.Kid)
+	}
+
+	// the algorithm is taken from the key, never from the token header
+	if key == nil || h.Alg != key.Alg {
+		return nil, ErrSignature
+	}
+
+	if !verify(key, signingInput, signature) {
+		return nil, ErrSignature
+	}
+
+	claims, err := decodeClaims(signingInput)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Issuer != ks.issuer {
+		return nil, ErrIssuer
+	}
+
+	if time.Unix(claims.ExpiresAt, 0).Add(leeway).Before(time.Now()) {
+		return nil, ErrExpired
+	}
+
+	return claims, nil
+}
+
+// JWKS returns the public keys of the set, for /.well-known/jwks.json.
+func (ks *KeySet) JWKS() []JWK {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	jwks := make([]JWK, 0, len(ks.keys))
+	for _, key := range ks.keys {
+		jwk := JWK{Kid: key.ID, Alg: key.Alg, Use: "sig"}
+
+		switch public := key.public.(type) {
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = b64.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = b64.EncodeToString(public.N.Bytes())
+			jwk.E = b64.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		}
+
+		jwks = append(jwks, jwk)
+	}
+
+	return jwks
+}
+
+func (ks *KeySet) key(id string) *Key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	for _, key := range ks.keys {
+		if key.ID == id {
+			return key
+		}
+	}
+
+	return nil
+}
+
+// reloadDue reports whether the key directory may be reread for an unknown
+// key id. The interval keeps made up key ids from causing a read each.
+func (ks *KeySet) reloadDue() bool {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	return ks.dir != "" && time.Since(ks.loadedAt) >= reloadInterval
+}
+
+// loadKeys reads every key file of dir, newest first.
+func loadKeys(dir string) ([]*Key, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*Key
+	for _, file := range files {
+		key, err := readKey(file)
+		if errors.Is(err, os.ErrNotExist) {
+			// dropped by the instance rotating the keys
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+
+	return keys, nil
+}
+
+func generateKey(alg string) (*Key, error) {
+	var private crypto.Signer
+	var err error
+
+	switch alg {
+	case EdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case RS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		err = fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newKey(private, time.Now())
+}
+
+func newKey(private crypto.Signer, createdAt time.Time) (*Key, error) {
+	key := &Key{CreatedAt: createdAt, private: private, public: private.Public()}
+
+	switch private.(type) {
+	case ed25519.PrivateKey:
+		key.Alg = EdDSA
+	case *rsa.PrivateKey:
+		key.Alg = RS256
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+
+	// the key id is derived from the public key, so it is stable across
+	// instances reading the same key file
+	der, err := x509.MarshalPKIXPublicKey(key.public)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	key.ID = hex.EncodeToString(sum[:8])
+
+	return key, nil
+}
+
+func writeKey(dir string, key *Key) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.private)
+	if err != nil {
+		return err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	file := filepath.Join(dir, key.ID+".pem")
+
+	// the key is written under another name and renamed once complete, so
+	// that instances reloading the directory never read half a key
+	tmp := file + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chtimes(tmp, key.CreatedAt, key.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+func readKey(file string) (*Key, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || !strings.Contains(block.Type, "PRIVATE KEY") {
+		return nil, errors.New("no private key found")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	private, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported key type")
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return newKey(private, info.ModTime())
+}
@@ -0,0 +1,57 @@
+package mailer
+
+import (
+	"fmt"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain text email through an SMTP server, such as the MailHog
+// instance started by docker-compose.
+type Mailer struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// Message is a single plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Send delivers msg through the configured SMTP server.
+func (m *Mailer) Send(msg Message) error {
+	addr := fmt.Sprintf("%s:%d", m.Host, m.Port)
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	// header values must not be able to smuggle in extra headers
+	header := strings.NewReplacer("\r", "", "\n", "")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", header.Replace(m.From))
+	fmt.Fprintf(&b, "To: %s\r\n", header.Replace(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", header.Replace(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	// the envelope takes the bare address, without a display name
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(addr, auth, from.Address, []string{msg.To}, []byte(b.String()))
+}
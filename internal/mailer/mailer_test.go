@@ -0,0 +1,87 @@
+package mailer
+
+import (
+	"dss-api/internal/mailer/mailertest"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSend(t *testing.T) {
+	server, err := mailertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	m := Mailer{Host: server.Host, Port: server.Port, From: "DSS <no-reply@dss-api.local>"}
+
+	err = m.Send(Message{
+		To:      "jane@example.com",
+		Subject: "Hello\r\nBcc: eve@example.com",
+		Body:    "First line\n.second line starts with a dot\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received, err := server.Receive(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if received.From != "no-reply@dss-api.local" {
+		t.Errorf("envelope from = %q", received.From)
+	}
+	if len(received.To) != 1 || received.To[0] != "jane@example.com" {
+		t.Errorf("envelope to = %q", received.To)
+	}
+
+	msg, err := received.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := map[string]string{
+		"From":         "DSS <no-reply@dss-api.local>",
+		"To":           "jane@example.com",
+		"Subject":      "HelloBcc: eve@example.com",
+		"Content-Type": "text/plain; charset=UTF-8",
+		"Mime-Version": "1.0",
+	}
+	for name, want := range headers {
+		if got := msg.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if msg.Header.Get("Bcc") != "" {
+		t.Error("a header was smuggled in through the subject")
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Errorf("Date: %v", err)
+	}
+
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "First line\r\n.second line starts with a dot\r\n"; string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func TestSendUnreachable(t *testing.T) {
+	server, err := mailertest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	m := Mailer{Host: server.Host, Port: server.Port, From: "no-reply@dss-api.local"}
+
+	err = m.Send(Message{To: "jane@example.com", Subject: "Hello", Body: "Hi"})
+	if err == nil || !strings.Contains(err.Error(), "connect") && !strings.Contains(err.Error(), "refused") {
+		t.Errorf("err = %v, want a connection error", err)
+	}
+}
@@ -0,0 +1,150 @@
+// Package mailertest provides an in-process SMTP server for tests, so that
+// email can be checked end to end without MailHog.
+package mailertest
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message is an email the server accepted.
+type Message struct {
+	From string
+	To   []string
+	// Data is the message as sent, headers and body
+	Data string
+}
+
+// Parse reads the headers and body of the message.
+func (m *Message) Parse() (*mail.Message, error) {
+	return mail.ReadMessage(strings.NewReader(m.Data))
+}
+
+// Server is a minimal SMTP server listening on the loopback interface. It
+// accepts every message, without authentication or TLS.
+type Server struct {
+	Host     string
+	Port     int
+	listener net.Listener
+	messages chan *Message
+}
+
+// NewServer starts a server on a free port.
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	addr := listener.Addr().(*net.TCPAddr)
+	s := &Server{
+		Host:     addr.IP.String(),
+		Port:     addr.Port,
+		listener: listener,
+		messages: make(chan *Message, 16),
+	}
+
+	go s.serve()
+
+	return s, nil
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// Receive waits up to timeout for the next message.
+func (s *Server) Receive(timeout time.Duration) (*Message, error) {
+	select {
+	case msg := <-s.messages:
+		return msg, nil
+	case <-time.After(timeout):
+		return nil, errors.New("mailertest: no message within " + timeout.String())
+	}
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(code int, text string) {
+		_, _ = conn.Write([]byte(strconv.Itoa(code) + " " + text + "\r\n"))
+	}
+
+	reply(220, "mailertest ready")
+
+	msg := &Message{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			reply(250, "mailertest")
+		case "MAIL":
+			msg = &Message{From: address(arg)}
+			reply(250, "ok")
+		case "RCPT":
+			msg.To = append(msg.To, address(arg))
+			reply(250, "ok")
+		case "DATA":
+			reply(354, "end data with <CR><LF>.<CR><LF>")
+
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				// undo dot stuffing
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			msg.Data = data.String()
+
+			s.messages <- msg
+			reply(250, "queued")
+		case "RSET":
+			msg = &Message{}
+			reply(250, "ok")
+		case "NOOP":
+			reply(250, "ok")
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			reply(502, "command not implemented")
+		}
+	}
+}
+
+// address returns the address of a "FROM:<a@b>" or "TO:<a@b>" argument.
+func address(arg string) string {
+	_, addr, _ := strings.Cut(arg, ":")
+	addr, _, _ = strings.Cut(strings.TrimSpace(addr), " ")
+
+	return strings.Trim(addr, "<>")
+}
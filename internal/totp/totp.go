@@ -0,0 +1,110 @@
+// Package totp implements RFC 6238 time-based one-time passwords with the
+// defaults authenticator apps expect: HMAC-SHA1, 30 second steps, 6 digits.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	period = 30
+	digits = 6
+	// skew is the number of steps before and after the current one that
+	// are still accepted, to allow for clock drift.
+	skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a random 160 bit secret, base32 encoded.
+func GenerateSecret() (string, error) {
+	secret := make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(secret), nil
+}
+
+// URI returns the otpauth:// URI authenticator apps read from a QR code.
+func URI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer + ":" + account)
+
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(digits))
+	v.Set("period", fmt.Sprint(period))
+
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// Code returns the code for secret at time t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decode(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return generate(key, step(t)), nil
+}
+
+// Validate checks code against secret at time t. On success it returns the
+// time step the code belongs to, so that callers can refuse a code that has
+// already been used.
+func Validate(secret, code string, t time.Time) (int64, bool) {
+	key, err := decode(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.TrimSpace(code)
+	if len(code) != digits {
+		return 0, false
+	}
+
+	current := step(t)
+	for i := -skew; i <= skew; i++ {
+		candidate := current + int64(i)
+		if subtle.ConstantTimeCompare([]byte(generate(key, candidate)), []byte(code)) == 1 {
+			return candidate, true
+		}
+	}
+
+	return 0, false
+}
+
+func generate(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation, RFC 4226 section 5.3
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", digits, value%1000000)
+}
+
+func step(t time.Time) int64 {
+	return t.Unix() / period
+}
+
+func decode(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	return encoding.DecodeString(strings.TrimRight(secret, "="))
+}
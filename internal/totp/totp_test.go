@@ -0,0 +1,117 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of the RFC 6238 Appendix B test vectors,
+// "12345678901234567890", base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestCodeRFC6238 checks the SHA-1 test vectors of RFC 6238 Appendix B. The
+// RFC lists 8 digit codes; with 6 digits the code is their last six.
+func TestCodeRFC6238(t *testing.T) {
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, v := range vectors {
+		got, err := Code(rfcSecret, time.Unix(v.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := v.code[2:]; got != want {
+			t.Errorf("Code at %d = %s, want %s", v.unix, got, want)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / period
+
+	tests := []struct {
+		name   string
+		offset time.Duration
+		valid  bool
+	}{
+		{"current step", 0, true},
+		{"previous step", -period * time.Second, true},
+		{"next step", period * time.Second, true},
+		{"two steps behind", -2 * period * time.Second, false},
+		{"two steps ahead", 2 * period * time.Second, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codeTime := now.Add(tt.offset)
+			code, err := Code(rfcSecret, codeTime)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			step, ok := Validate(rfcSecret, code, now)
+			if ok != tt.valid {
+				t.Fatalf("Validate = %v, want %v", ok, tt.valid)
+			}
+
+			// the step returned is the one the code was made for, which is
+			// what the replay guard records
+			if ok && step != codeTime.Unix()/period {
+				t.Errorf("step = %d, want %d (current %d)", step, codeTime.Unix()/period, current)
+			}
+		})
+	}
+}
+
+func TestValidateRejectsMalformedCodes(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, err := Code(rfcSecret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []string{"", code[:5], code + "0", "abcdef"} {
+		if _, ok := Validate(rfcSecret, bad, now); ok {
+			t.Errorf("Validate accepted %q", bad)
+		}
+	}
+
+	if _, ok := Validate(rfcSecret, " "+code+" ", now); !ok {
+		t.Error("Validate rejected a code with surrounding spaces")
+	}
+
+	if _, ok := Validate("not base32!", code, now); ok {
+		t.Error("Validate accepted a code for an invalid secret")
+	}
+}
+
+func TestSecretFormatting(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	code, err := Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// authenticator apps show secrets in lower case groups
+	spaced := strings.ToLower(secret[:4] + " " + secret[4:])
+	if _, ok := Validate(spaced, code, now); !ok {
+		t.Error("Validate rejected the secret in lower case with spaces")
+	}
+}
@@ -0,0 +1,200 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrNoCredential       = errors.New("authenticator holds no matching credential")
+	ErrCredentialExcluded = errors.New("authenticator already holds a credential for this user")
+)
+
+// Authenticator is a software authenticator holding ES256 discoverable
+// credentials in memory. It answers ceremonies the way a browser and a
+// platform authenticator would together, with packed self attestation, so
+// that registration and login can be exercised from Go.
+type Authenticator struct {
+	// AAGUID identifies the authenticator model; all zeros by default
+	AAGUID [16]byte
+	// UserVerified is reported as the outcome of user verification
+	UserVerified bool
+
+	mu          sync.Mutex
+	credentials []*softCredential
+}
+
+type softCredential struct {
+	id         []byte
+	rpID       string
+	userHandle []byte
+	key        *ecdsa.PrivateKey
+	signCount  uint32
+}
+
+// NewAuthenticator returns an empty authenticator that verifies its user.
+func NewAuthenticator() *Authenticator {
+	return &Authenticator{UserVerified: true}
+}
+
+// Create registers a new credential, as navigator.credentials.create()
+// would on a page served from origin.
+func (a *Authenticator) Create(origin string, opts *CreationOptions) (*AttestationResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	supported := false
+	for _, param := range opts.PubKeyCredParams {
+		supported = supported || param.Alg == AlgES256
+	}
+	if !supported {
+		return nil, ErrUnsupported
+	}
+
+	for _, excluded := range opts.ExcludeCredentials {
+		if c := a.find(opts.RP.ID, excluded.ID); c != nil {
+			return nil, ErrCredentialExcluded
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 32)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+
+	cose, err := encodeES256Key(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &softCredential{id: id, rpID: opts.RP.ID, userHandle: opts.User.ID, key: key}
+
+	authData := a.authData(c, flagAttested)
+	authData = append(authData, a.AAGUID[:]...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(id)))
+	authData = append(authData, id...)
+	authData = append(authData, cose...)
+
+	clientDataJSON, err := clientData(typeCreate, opts.Challenge, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := sign(key, authData, clientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	attestationObject, err := encodeCBOR(map[any]any{
+		"fmt":      "packed",
+		"attStmt":  map[any]any{"alg": int64(AlgES256), "sig": sig},
+		"authData": authData,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.credentials = append(a.credentials, c)
+
+	resp := &AttestationResponse{ID: b64.EncodeToString(id), RawID: id, Type: "public-key"}
+	resp.Response.ClientDataJSON = clientDataJSON
+	resp.Response.AttestationObject = attestationObject
+	resp.Response.Transports = []string{"internal"}
+
+	return resp, nil
+}
+
+// Get signs in with a credential for the relying party, as
+// navigator.credentials.get() would on a page served from origin. Without
+// allowed credentials it uses the most recently created one.
+func (a *Authenticator) Get(origin string, opts *RequestOptions) (*AssertionResponse, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var c *softCredential
+	if len(opts.AllowCredentials) == 0 {
+		for i := len(a.credentials) - 1; i >= 0 && c == nil; i-- {
+			if a.credentials[i].rpID == opts.RPID {
+				c = a.credentials[i]
+			}
+		}
+	}
+	for _, allowed := range opts.AllowCredentials {
+		if c == nil {
+			c = a.find(opts.RPID, allowed.ID)
+		}
+	}
+	if c == nil {
+		return nil, ErrNoCredential
+	}
+
+	c.signCount++
+	authData := a.authData(c, 0)
+
+	clientDataJSON, err := clientData(typeGet, opts.Challenge, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := sign(c.key, authData, clientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &AssertionResponse{ID: b64.EncodeToString(c.id), RawID: c.id, Type: "public-key"}
+	resp.Response.ClientDataJSON = clientDataJSON
+	resp.Response.AuthenticatorData = authData
+	resp.Response.Signature = sig
+	resp.Response.UserHandle = c.userHandle
+
+	return resp, nil
+}
+
+func (a *Authenticator) find(rpID string, id []byte) *softCredential {
+	for _, c := range a.credentials {
+		if c.rpID == rpID && bytes.Equal(c.id, id) {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// authData returns the fixed part of the authenticator data for c.
+func (a *Authenticator) authData(c *softCredential, flags byte) []byte {
+	flags |= flagUserPresent
+	if a.UserVerified {
+		flags |= flagUserVerified
+	}
+
+	rpIDHash := sha256.Sum256([]byte(c.rpID))
+	data := append(rpIDHash[:], flags)
+
+	return binary.BigEndian.AppendUint32(data, c.signCount)
+}
+
+func clientData(typ string, challenge []byte, origin string) ([]byte, error) {
+	return json.Marshal(ClientData{Type: typ, Challenge: b64.EncodeToString(challenge), Origin: origin})
+}
+
+// sign signs authenticator data and the hash of the client data, as both
+// attestation and assertion signatures do.
+func sign(key *ecdsa.PrivateKey, authData, clientDataJSON []byte) ([]byte, error) {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+
+	return ecdsa.SignASN1(rand.Reader, key, digest[:])
+}
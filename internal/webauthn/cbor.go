@@ -0,0 +1,299 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// This is the subset of CBOR (RFC 8949) that WebAuthn uses: definite length
+// items only, as CTAP2 requires. Integers decode to int64, byte strings to
+// []byte, text to string, arrays to []any and maps to map[any]any.
+
+var errCBOR = errors.New("malformed cbor")
+
+// maxCBORDepth bounds nesting, so that hostile input can't exhaust the stack.
+const maxCBORDepth = 16
+
+// decodeCBOR decodes the first item of data and returns it with the bytes
+// that follow it.
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeItem(data, 0)
+}
+
+func decodeItem(data []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, fmt.Errorf("%w: nested too deeply", errCBOR)
+	}
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("%w: unexpected end", errCBOR)
+	}
+
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	// simple values and floats carry their value in the additional info
+	if major == 7 {
+		return decodeSimple(info, data)
+	}
+
+	arg, data, err := decodeArgument(info, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w: integer overflow", errCBOR)
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, fmt.Errorf("%w: integer overflow", errCBOR)
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("%w: unexpected end", errCBOR)
+		}
+		if major == 2 {
+			return append([]byte(nil), data[:arg]...), data[arg:], nil
+		}
+		return string(data[:arg]), data[arg:], nil
+	case 4:
+		// every item takes at least a byte
+		if arg > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("%w: unexpected end", errCBOR)
+		}
+		items := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item any
+			item, data, err = decodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case 5:
+		if arg > uint64(len(data)) {
+			return nil, nil, fmt.Errorf("%w: unexpected end", errCBOR)
+		}
+		m := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value any
+			key, data, err = decodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: unsupported map key", errCBOR)
+			}
+			if _, dup := m[key]; dup {
+				return nil, nil, fmt.Errorf("%w: duplicate map key", errCBOR)
+			}
+			value, data, err = decodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, data, nil
+	default:
+		// tags annotate the item that follows; WebAuthn needs none of them
+		return decodeItem(data, depth+1)
+	}
+}
+
+// decodeArgument reads the integer argument of an item's initial byte.
+func decodeArgument(info byte, data []byte) (uint64, []byte, error) {
+	var n int
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24:
+		n = 1
+	case info == 25:
+		n = 2
+	case info == 26:
+		n = 4
+	case info == 27:
+		n = 8
+	default:
+		return 0, nil, fmt.Errorf("%w: indefinite or reserved length", errCBOR)
+	}
+
+	if len(data) < n {
+		return 0, nil, fmt.Errorf("%w: unexpected end", errCBOR)
+	}
+
+	var arg uint64
+	for _, b := range data[:n] {
+		arg = arg<<8 | uint64(b)
+	}
+
+	return arg, data[n:], nil
+}
+
+func decodeSimple(info byte, data []byte) (any, []byte, error) {
+	switch info {
+	case 20:
+		return false, data, nil
+	case 21:
+		return true, data, nil
+	case 22, 23:
+		return nil, data, nil
+	case 25:
+		if len(data) < 2 {
+			return nil, nil, fmt.Errorf("%w: unexpected end", errCBOR)
+		}
+		return halfFloat(binary.BigEndian.Uint16(data)), data[2:], nil
+	case 26:
+		if len(data) < 4 {
+			return nil, nil, fmt.Errorf("%w: unexpected end", errCBOR)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), data[4:], nil
+	case 27:
+		if len(data) < 8 {
+			return nil, nil, fmt.Errorf("%w: unexpected end", errCBOR)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+	default:
+		return nil, nil, fmt.Errorf("%w: unsupported simple value", errCBOR)
+	}
+}
+
+func halfFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+
+	if h&0x8000 != 0 {
+		return -f
+	}
+
+	return f
+}
+
+// encodeCBOR encodes v in CTAP2 canonical form. It supports the types
+// decodeCBOR returns, plus int, and is what the software authenticator uses.
+func encodeCBOR(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	err := encodeItem(&buf, v)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func encodeItem(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case int:
+		return encodeItem(buf, int64(v))
+	case int64:
+		if v >= 0 {
+			writeHead(buf, 0, uint64(v))
+		} else {
+			writeHead(buf, 1, uint64(-1-v))
+		}
+	case []byte:
+		writeHead(buf, 2, uint64(len(v)))
+		buf.Write(v)
+	case string:
+		writeHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case bool:
+		if v {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case nil:
+		buf.WriteByte(0xf6)
+	case []any:
+		writeHead(buf, 4, uint64(len(v)))
+		for _, item := range v {
+			err := encodeItem(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+	case map[any]any:
+		// canonical order: shorter encoded keys first, then bytewise
+		type entry struct {
+			key   []byte
+			value any
+		}
+		entries := make([]entry, 0, len(v))
+		for key, value := range v {
+			encoded, err := encodeCBOR(key)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry{encoded, value})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			a, b := entries[i].key, entries[j].key
+			if len(a) != len(b) {
+				return len(a) < len(b)
+			}
+			return bytes.Compare(a, b) < 0
+		})
+
+		writeHead(buf, 5, uint64(len(entries)))
+		for _, e := range entries {
+			buf.Write(e.key)
+			err := encodeItem(buf, e.value)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cbor: can't encode %T", v)
+	}
+
+	return nil
+}
+
+// writeHead writes an item's initial byte and its argument in the shortest
+// form.
+func writeHead(buf *bytes.Buffer, major byte, arg uint64) {
+	major <<= 5
+
+	switch {
+	case arg < 24:
+		buf.WriteByte(major | byte(arg))
+	case arg <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(arg))
+	case arg <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(arg)))
+	case arg <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(arg)))
+	default:
+		buf.WriteByte(major | 27)
+		buf.Write(binary.BigEndian.AppendUint64(nil, arg))
+	}
+}
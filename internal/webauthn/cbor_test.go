@@ -0,0 +1,215 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// TestDecodeCBOR decodes examples from RFC 8949 appendix A.
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		in   string
+		want any
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3863", int64(-100)},
+		{"3903e7", int64(-1000)},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"f93c00", 1.0},
+		{"f9c400", -4.0},
+		{"f90001", 5.960464477539063e-8},
+		{"fa47c35000", 100000.0},
+		{"fb3ff199999999999a", 1.1},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6449455446", "IETF"},
+		{"62c3bc", "ü"},
+		{"80", []any{}},
+		{"83010203", []any{int64(1), int64(2), int64(3)}},
+		{"8301820203820405", []any{int64(1), []any{int64(2), int64(3)}, []any{int64(4), int64(5)}}},
+		{"a0", map[any]any{}},
+		{"a201020304", map[any]any{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[any]any{"a": int64(1), "b": []any{int64(2), int64(3)}}},
+		// tags are skipped
+		{"c11a514b67b0", int64(1363896240)},
+		{"d74401020304", []byte{1, 2, 3, 4}},
+	}
+
+	for _, tt := range tests {
+		got, rest, err := decodeCBOR(unhex(t, tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		if len(rest) != 0 {
+			t.Errorf("%s: %d bytes left over", tt.in, len(rest))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeCBOREmptyBytes(t *testing.T) {
+	v, _, err := decodeCBOR(unhex(t, "40"))
+	if b, ok := v.([]byte); err != nil || !ok || len(b) != 0 {
+		t.Errorf("got %#v, %v, want empty bytes", v, err)
+	}
+}
+
+func TestDecodeCBORSpecialFloats(t *testing.T) {
+	v, _, err := decodeCBOR(unhex(t, "f97c00"))
+	if err != nil || v != math.Inf(1) {
+		t.Errorf("got %v, %v, want +Inf", v, err)
+	}
+
+	v, _, err = decodeCBOR(unhex(t, "f97e00"))
+	if f, ok := v.(float64); err != nil || !ok || !math.IsNaN(f) {
+		t.Errorf("got %v, %v, want NaN", v, err)
+	}
+}
+
+func TestDecodeCBORRest(t *testing.T) {
+	v, rest, err := decodeCBOR(unhex(t, "0102ff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != int64(1) || !bytes.Equal(rest, []byte{0x02, 0xff}) {
+		t.Errorf("got %v with rest %x", v, rest)
+	}
+}
+
+func TestDecodeCBORMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"empty", ""},
+		{"truncated argument", "19"},
+		{"truncated bytes", "4401"},
+		{"truncated text", "6449"},
+		{"truncated array", "8301"},
+		{"truncated map", "a201"},
+		{"truncated float", "fa4700"},
+		{"indefinite bytes", "5f42010243030405ff"},
+		{"indefinite array", "9f0102ff"},
+		{"reserved length", "1c"},
+		{"break outside indefinite item", "ff"},
+		{"unsupported simple value", "f0"},
+		{"integer overflow", "1bffffffffffffffff"},
+		{"negative overflow", "3bffffffffffffffff"},
+		{"huge length", "5bffffffffffffffff"},
+		{"huge array", "9bffffffffffffffff"},
+		{"duplicate key", "a201020103"},
+		{"bytes key", "a1410102"},
+		{"array key", "a1800102"},
+		{"nested too deeply", strings.Repeat("81", maxCBORDepth+1) + "00"},
+		{"tags nested too deeply", strings.Repeat("c1", maxCBORDepth+1) + "00"},
+	}
+
+	for _, tt := range tests {
+		_, _, err := decodeCBOR(unhex(t, tt.in))
+		if !errors.Is(err, errCBOR) {
+			t.Errorf("%s: got %v, want errCBOR", tt.name, err)
+		}
+	}
+
+	_, _, err := decodeCBOR(unhex(t, strings.Repeat("81", maxCBORDepth)+"00"))
+	if err != nil {
+		t.Errorf("nesting at the limit: %v", err)
+	}
+}
+
+func TestEncodeCBOR(t *testing.T) {
+	tests := []struct {
+		in   any
+		want string
+	}{
+		{0, "00"},
+		{int64(23), "17"},
+		{int64(24), "1818"},
+		{int64(1000), "1903e8"},
+		{int64(1000000), "1a000f4240"},
+		{int64(1000000000000), "1b000000e8d4a51000"},
+		{int64(-1), "20"},
+		{int64(-1000), "3903e7"},
+		{int64(math.MinInt64), "3b7fffffffffffffff"},
+		{false, "f4"},
+		{true, "f5"},
+		{nil, "f6"},
+		{[]byte{1, 2, 3, 4}, "4401020304"},
+		{"IETF", "6449455446"},
+		{[]any{int64(1), []any{int64(2), int64(3)}}, "8201820203"},
+		// canonical order: shorter keys first, then bytewise
+		{map[any]any{"aa": int64(3), "b": int64(2), int64(-1): int64(1), int64(10): int64(0)}, "a40a00200161620262616103"},
+	}
+
+	for _, tt := range tests {
+		got, err := encodeCBOR(tt.in)
+		if err != nil {
+			t.Errorf("%#v: %v", tt.in, err)
+			continue
+		}
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("%#v: got %x, want %s", tt.in, got, tt.want)
+		}
+	}
+
+	_, err := encodeCBOR(1.5)
+	if err == nil {
+		t.Error("encoded a float")
+	}
+	_, err = encodeCBOR(map[any]any{"a": struct{}{}})
+	if err == nil {
+		t.Error("encoded a struct")
+	}
+}
+
+func TestCBORRoundTrip(t *testing.T) {
+	in := map[any]any{
+		"fmt":      "packed",
+		"attStmt":  map[any]any{"alg": int64(AlgES256), "sig": bytes.Repeat([]byte{0xab}, 300)},
+		"authData": bytes.Repeat([]byte{0x01}, 70000),
+		int64(-3):  []any{true, false, nil, "", []byte{0}},
+	}
+
+	raw, err := encodeCBOR(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, rest, err := decodeCBOR(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 0 {
+		t.Errorf("%d bytes left over", len(rest))
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Error("decoded value differs from the encoded one")
+	}
+}
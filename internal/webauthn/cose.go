@@ -0,0 +1,150 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithms (RFC 9053) the relying party accepts, most preferred
+// first.
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// Algorithms lists the accepted COSE algorithms, most preferred first.
+var Algorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+// COSE key parameters.
+const (
+	coseKty = 1
+	coseAlg = 3
+	coseCrv = -1
+	coseX   = -2
+	coseY   = -3
+	coseN   = -1
+	coseE   = -2
+
+	ktyOKP = 1
+	ktyEC2 = 2
+	ktyRSA = 3
+
+	crvP256    = 1
+	crvEd25519 = 6
+)
+
+// publicKey is a credential public key with the algorithm it signs with.
+type publicKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+// parseCOSEKey reads a COSE_Key, as found in authenticator data and stored
+// for each credential.
+func parseCOSEKey(raw []byte) (*publicKey, error) {
+	v, rest, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: trailing bytes after public key", ErrInvalidResponse)
+	}
+
+	m, ok := v.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: public key is not a map", ErrInvalidResponse)
+	}
+
+	kty, _ := m[int64(coseKty)].(int64)
+	alg, _ := m[int64(coseAlg)].(int64)
+
+	switch {
+	case kty == ktyEC2 && alg == AlgES256:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		y, _ := m[int64(coseY)].([]byte)
+		if crv != crvP256 || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("%w: invalid P-256 key", ErrInvalidResponse)
+		}
+
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("%w: point not on curve", ErrInvalidResponse)
+		}
+
+		return &publicKey{alg: alg, key: key}, nil
+	case kty == ktyOKP && alg == AlgEdDSA:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		if crv != crvEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: invalid Ed25519 key", ErrInvalidResponse)
+		}
+
+		return &publicKey{alg: alg, key: ed25519.PublicKey(x)}, nil
+	case kty == ktyRSA && alg == AlgRS256:
+		n, _ := m[int64(coseN)].([]byte)
+		e, _ := m[int64(coseE)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("%w: invalid RSA key", ErrInvalidResponse)
+		}
+
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+		return &publicKey{alg: alg, key: key}, nil
+	default:
+		return nil, fmt.Errorf("%w: key type %d with algorithm %d", ErrUnsupported, kty, alg)
+	}
+}
+
+// verify checks a signature over data.
+func (k *publicKey) verify(data, sig []byte) error {
+	return verifySignature(k.alg, k.key, data, sig)
+}
+
+// verifySignature checks sig over data with key, which signs with the COSE
+// algorithm alg.
+func verifySignature(alg int64, key crypto.PublicKey, data, sig []byte) error {
+	digest := sha256.Sum256(data)
+
+	valid := false
+	switch alg {
+	case AlgES256:
+		if key, ok := key.(*ecdsa.PublicKey); ok {
+			valid = ecdsa.VerifyASN1(key, digest[:], sig)
+		}
+	case AlgEdDSA:
+		if key, ok := key.(ed25519.PublicKey); ok {
+			valid = ed25519.Verify(key, data, sig)
+		}
+	case AlgRS256:
+		if key, ok := key.(*rsa.PublicKey); ok {
+			valid = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+		}
+	default:
+		return fmt.Errorf("%w: algorithm %d", ErrUnsupported, alg)
+	}
+
+	if !valid {
+		return ErrSignature
+	}
+
+	return nil
+}
+
+// encodeES256Key returns the COSE_Key of a P-256 public key.
+func encodeES256Key(key *ecdsa.PublicKey) ([]byte, error) {
+	return encodeCBOR(map[any]any{
+		int64(coseKty): int64(ktyEC2),
+		int64(coseAlg): int64(AlgES256),
+		int64(coseCrv): int64(crvP256),
+		int64(coseX):   key.X.FillBytes(make([]byte, 32)),
+		int64(coseY):   key.Y.FillBytes(make([]byte, 32)),
+	})
+}
@@ -0,0 +1,198 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func mustEncode(t *testing.T, v any) []byte {
+	t.Helper()
+
+	raw, err := encodeCBOR(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return raw
+}
+
+func ed25519Key(x []byte) map[any]any {
+	return map[any]any{
+		int64(coseKty): int64(ktyOKP),
+		int64(coseAlg): int64(AlgEdDSA),
+		int64(coseCrv): int64(crvEd25519),
+		int64(coseX):   x,
+	}
+}
+
+func rsaKey(key *rsa.PublicKey) map[any]any {
+	return map[any]any{
+		int64(coseKty): int64(ktyRSA),
+		int64(coseAlg): int64(AlgRS256),
+		int64(coseN):   key.N.Bytes(),
+		int64(coseE):   big.NewInt(int64(key.E)).Bytes(),
+	}
+}
+
+func TestParseCOSEKey(t *testing.T) {
+	data := []byte("signed data")
+	digest := sha256.Sum256(data)
+
+	t.Run("ES256", func(t *testing.T) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := encodeES256Key(&priv.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key, err := parseCOSEKey(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.alg != AlgES256 || !priv.PublicKey.Equal(key.key) {
+			t.Fatalf("got %d %v", key.alg, key.key)
+		}
+
+		sig, _ := ecdsa.SignASN1(rand.Reader, priv, digest[:])
+		if err := key.verify(data, sig); err != nil {
+			t.Errorf("valid signature: %v", err)
+		}
+		if err := key.verify([]byte("other data"), sig); !errors.Is(err, ErrSignature) {
+			t.Errorf("other data: got %v, want ErrSignature", err)
+		}
+	})
+
+	t.Run("EdDSA", func(t *testing.T) {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key, err := parseCOSEKey(mustEncode(t, ed25519Key(pub)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.alg != AlgEdDSA || !pub.Equal(key.key) {
+			t.Fatalf("got %d %v", key.alg, key.key)
+		}
+
+		sig := ed25519.Sign(priv, data)
+		if err := key.verify(data, sig); err != nil {
+			t.Errorf("valid signature: %v", err)
+		}
+		sig[0] ^= 1
+		if err := key.verify(data, sig); !errors.Is(err, ErrSignature) {
+			t.Errorf("altered signature: got %v, want ErrSignature", err)
+		}
+	})
+
+	t.Run("RS256", func(t *testing.T) {
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key, err := parseCOSEKey(mustEncode(t, rsaKey(&priv.PublicKey)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.alg != AlgRS256 || !priv.PublicKey.Equal(key.key) {
+			t.Fatalf("got %d %v", key.alg, key.key)
+		}
+
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+		if err := key.verify(data, sig); err != nil {
+			t.Errorf("valid signature: %v", err)
+		}
+		if err := key.verify([]byte("other data"), sig); !errors.Is(err, ErrSignature) {
+			t.Errorf("other data: got %v, want ErrSignature", err)
+		}
+	})
+}
+
+func TestParseCOSEKeyRefuses(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := encodeES256Key(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ec2 := func(change func(m map[any]any)) []byte {
+		v, _, _ := decodeCBOR(valid)
+		m := v.(map[any]any)
+		change(m)
+		return mustEncode(t, m)
+	}
+
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shortRSA := rsaKey(&small.PublicKey)
+
+	tests := []struct {
+		name string
+		raw  []byte
+		want error
+	}{
+		{"malformed", []byte{0xa5, 0x01}, errCBOR},
+		{"trailing bytes", append(append([]byte(nil), valid...), 0x00), ErrInvalidResponse},
+		{"not a map", mustEncode(t, []any{int64(2), int64(-7)}), ErrInvalidResponse},
+		{"off the curve", ec2(func(m map[any]any) { m[int64(coseY)] = make([]byte, 32) }), ErrInvalidResponse},
+		{"wrong curve", ec2(func(m map[any]any) { m[int64(coseCrv)] = int64(2) }), ErrInvalidResponse},
+		{"short x", ec2(func(m map[any]any) { m[int64(coseX)] = make([]byte, 31) }), ErrInvalidResponse},
+		{"missing y", ec2(func(m map[any]any) { delete(m, int64(coseY)) }), ErrInvalidResponse},
+		{"algorithm of another key type", ec2(func(m map[any]any) { m[int64(coseAlg)] = int64(AlgEdDSA) }), ErrUnsupported},
+		{"unsupported algorithm", ec2(func(m map[any]any) { m[int64(coseAlg)] = int64(-35) }), ErrUnsupported},
+		{"unsupported key type", ec2(func(m map[any]any) { m[int64(coseKty)] = int64(4) }), ErrUnsupported},
+		{"short Ed25519 key", mustEncode(t, ed25519Key(make([]byte, 31))), ErrInvalidResponse},
+		{"short RSA modulus", mustEncode(t, shortRSA), ErrInvalidResponse},
+		{"long RSA exponent", mustEncode(t, map[any]any{
+			int64(coseKty): int64(ktyRSA),
+			int64(coseAlg): int64(AlgRS256),
+			int64(coseN):   make([]byte, 256),
+			int64(coseE):   make([]byte, 5),
+		}), ErrInvalidResponse},
+	}
+
+	for _, tt := range tests {
+		_, err := parseCOSEKey(tt.raw)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestVerifySignatureKeyMismatch(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("signed data")
+	sig := ed25519.Sign(priv, data)
+
+	// a key of another type than the algorithm never verifies
+	err = verifySignature(AlgES256, pub, data, sig)
+	if !errors.Is(err, ErrSignature) {
+		t.Errorf("got %v, want ErrSignature", err)
+	}
+
+	err = verifySignature(-35, pub, data, sig)
+	if !errors.Is(err, ErrUnsupported) {
+		t.Errorf("got %v, want ErrUnsupported", err)
+	}
+}
@@ -0,0 +1,523 @@
+// Package webauthn implements the relying party side of WebAuthn Level 2
+// passkey registration and login, for the credential types authenticators
+// commonly use: ES256, EdDSA and RS256 keys with "none" or "packed"
+// attestation. Attestation certificates are not checked against a trust
+// store; a credential is trusted because a logged in user registered it.
+// The package also has a software authenticator, so that the ceremonies can
+// be run without a browser.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// User verification requirements.
+const (
+	VerificationRequired  = "required"
+	VerificationPreferred = "preferred"
+)
+
+// Client data types of the two ceremonies.
+const (
+	typeCreate = "webauthn.create"
+	typeGet    = "webauthn.get"
+)
+
+// Authenticator data flags.
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+	flagExtensions   = 0x80
+)
+
+var (
+	ErrInvalidResponse     = errors.New("invalid webauthn response")
+	ErrSignature           = errors.New("invalid webauthn signature")
+	ErrUnsupported         = errors.New("unsupported webauthn credential")
+	ErrClonedAuthenticator = errors.New("signature counter went backwards, the authenticator may be cloned")
+)
+
+var b64 = base64.RawURLEncoding
+
+// Bytes is binary data, base64url encoded in JSON as WebAuthn clients send
+// it.
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b64.EncodeToString(b))
+}
+
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+
+	// be lenient about padding and the standard alphabet
+	s = strings.NewReplacer("+", "-", "/", "_", "=", "").Replace(s)
+	*b, err = b64.DecodeString(s)
+
+	return err
+}
+
+// Config describes the relying party.
+type Config struct {
+	// RPID is the domain credentials are scoped to, e.g. "example.com"
+	RPID   string
+	RPName string
+	// Origins are the web origins ceremonies may come from, e.g.
+	// "https://app.example.com"
+	Origins []string
+	// UserVerification is VerificationRequired or VerificationPreferred
+	UserVerification string
+	Timeout          time.Duration
+}
+
+// RelyingParty creates ceremony options and verifies their results.
+type RelyingParty struct {
+	config Config
+}
+
+// New returns a relying party for config.
+func New(config Config) *RelyingParty {
+	if config.UserVerification != VerificationRequired {
+		config.UserVerification = VerificationPreferred
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Minute
+	}
+
+	return &RelyingParty{config: config}
+}
+
+// Timeout is how long a ceremony may take.
+func (rp *RelyingParty) Timeout() time.Duration {
+	return rp.config.Timeout
+}
+
+// NewChallenge returns a random challenge.
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, 32)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return challenge, nil
+}
+
+// User is the account a credential is registered for. ID is the opaque user
+// handle authenticators store with discoverable credentials.
+type User struct {
+	ID          Bytes  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type RelyingPartyEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type CredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   Bytes  `json:"id"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions are the options of navigator.credentials.create().
+type CreationOptions struct {
+	Challenge              Bytes                  `json:"challenge"`
+	RP                     RelyingPartyEntity     `json:"rp"`
+	User                   User                   `json:"user"`
+	PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the options of navigator.credentials.get().
+type RequestOptions struct {
+	Challenge        Bytes                  `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// AttestationResponse is the PublicKeyCredential a client returns from
+// navigator.credentials.create(), in its JSON form.
+type AttestationResponse struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes    `json:"clientDataJSON"`
+		AttestationObject Bytes    `json:"attestationObject"`
+		Transports        []string `json:"transports,omitempty"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the PublicKeyCredential a client returns from
+// navigator.credentials.get(), in its JSON form.
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes `json:"clientDataJSON"`
+		AuthenticatorData Bytes `json:"authenticatorData"`
+		Signature         Bytes `json:"signature"`
+		UserHandle        Bytes `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+// ClientData is what the client signs over, along with authenticator data.
+type ClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin,omitempty"`
+}
+
+// Credential is a verified new credential, to be stored for its user.
+// PublicKey is the COSE_Key the authenticator returned.
+type Credential struct {
+	ID           []byte
+	PublicKey    []byte
+	AAGUID       []byte
+	SignCount    uint32
+	UserVerified bool
+}
+
+// CreationOptions returns the options to register a credential for user.
+// exclude holds the ids of the credentials the user has already, so that an
+// authenticator isn't registered twice.
+func (rp *RelyingParty) CreationOptions(challenge []byte, user User, exclude [][]byte) *CreationOptions {
+	opts := &CreationOptions{
+		Challenge:          challenge,
+		RP:                 RelyingPartyEntity{ID: rp.config.RPID, Name: rp.config.RPName},
+		User:               user,
+		Timeout:            rp.config.Timeout.Milliseconds(),
+		ExcludeCredentials: descriptors(exclude),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: rp.config.UserVerification,
+		},
+		Attestation: "none",
+	}
+
+	for _, alg := range Algorithms {
+		opts.PubKeyCredParams = append(opts.PubKeyCredParams, CredentialParameter{Type: "public-key", Alg: alg})
+	}
+
+	return opts
+}
+
+// RequestOptions returns the options to log in. With no allowed credentials,
+// the authenticator offers the discoverable credentials it holds.
+func (rp *RelyingParty) RequestOptions(challenge []byte, allow [][]byte) *RequestOptions {
+	return &RequestOptions{
+		Challenge:        challenge,
+		Timeout:          rp.config.Timeout.Milliseconds(),
+		RPID:             rp.config.RPID,
+		AllowCredentials: descriptors(allow),
+		UserVerification: rp.config.UserVerification,
+	}
+}
+
+func descriptors(ids [][]byte) []CredentialDescriptor {
+	list := []CredentialDescriptor{}
+	for _, id := range ids {
+		list = append(list, CredentialDescriptor{Type: "public-key", ID: id})
+	}
+
+	return list
+}
+
+// Challenge returns the challenge a response's client data was signed for,
+// so that the caller can look up the ceremony it belongs to.
+func Challenge(clientDataJSON []byte) ([]byte, error) {
+	var cd ClientData
+	err := json.Unmarshal(clientDataJSON, &cd)
+	if err != nil {
+		return nil, fmt.Errorf("%w: client data: %v", ErrInvalidResponse, err)
+	}
+
+	challenge, err := b64.DecodeString(cd.Challenge)
+	if err != nil || len(challenge) == 0 {
+		return nil, fmt.Errorf("%w: challenge", ErrInvalidResponse)
+	}
+
+	return challenge, nil
+}
+
+// VerifyRegistration checks the response to CreationOptions made with
+// challenge and returns the new credential.
+func (rp *RelyingParty) VerifyRegistration(challenge []byte, resp *AttestationResponse) (*Credential, error) {
+	if resp.Type != "public-key" {
+		return nil, fmt.Errorf("%w: credential type %q", ErrInvalidResponse, resp.Type)
+	}
+
+	err := rp.verifyClientData(resp.Response.ClientDataJSON, typeCreate, challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	v, rest, err := decodeCBOR(resp.Response.AttestationObject)
+	if err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("%w: attestation object", ErrInvalidResponse)
+	}
+	obj, _ := v.(map[any]any)
+	format, _ := obj["fmt"].(string)
+	stmt, _ := obj["attStmt"].(map[any]any)
+	rawAuthData, _ := obj["authData"].([]byte)
+	if stmt == nil {
+		return nil, fmt.Errorf("%w: attestation statement", ErrInvalidResponse)
+	}
+
+	ad, err := rp.verifyAuthData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if ad.flags&flagAttested == 0 {
+		return nil, fmt.Errorf("%w: no attested credential data", ErrInvalidResponse)
+	}
+	if !bytes.Equal(ad.credentialID, resp.RawID) {
+		return nil, fmt.Errorf("%w: credential id mismatch", ErrInvalidResponse)
+	}
+
+	key, err := parseCOSEKey(ad.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataHash := sha256.Sum256(resp.Response.ClientDataJSON)
+	signed := append(append([]byte(nil), rawAuthData...), clientDataHash[:]...)
+
+	switch format {
+	case "none":
+		if len(stmt) != 0 {
+			return nil, fmt.Errorf("%w: attestation statement of format none", ErrInvalidResponse)
+		}
+	case "packed":
+		err = verifyPacked(stmt, key, signed)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: attestation format %q", ErrUnsupported, format)
+	}
+
+	return &Credential{
+		ID:           ad.credentialID,
+		PublicKey:    ad.publicKey,
+		AAGUID:       ad.aaguid,
+		SignCount:    ad.signCount,
+		UserVerified: ad.flags&flagUserVerified != 0,
+	}, nil
+}
+
+// verifyPacked checks a packed attestation statement: a signature by the
+// credential itself (self attestation), or by the attestation certificate
+// in x5c, whose chain is not verified.
+func verifyPacked(stmt map[any]any, key *publicKey, signed []byte) error {
+	alg, _ := stmt["alg"].(int64)
+	sig, _ := stmt["sig"].([]byte)
+	if len(sig) == 0 {
+		return fmt.Errorf("%w: packed attestation without signature", ErrInvalidResponse)
+	}
+
+	raw, present := stmt["x5c"]
+	if !present {
+		if alg != key.alg {
+			return fmt.Errorf("%w: self attestation algorithm mismatch", ErrInvalidResponse)
+		}
+		return key.verify(signed, sig)
+	}
+
+	x5c, ok := raw.([]any)
+	if !ok || len(x5c) == 0 {
+		return fmt.Errorf("%w: packed attestation without certificates", ErrInvalidResponse)
+	}
+
+	der, ok := x5c[0].([]byte)
+	if !ok {
+		return fmt.Errorf("%w: attestation certificate is not a byte string", ErrInvalidResponse)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return fmt.Errorf("%w: attestation certificate: %v", ErrInvalidResponse, err)
+	}
+
+	return verifySignature(alg, cert.PublicKey, signed, sig)
+}
+
+// Assertion is the outcome of a verified login.
+type Assertion struct {
+	SignCount    uint32
+	UserVerified bool
+}
+
+// VerifyAssertion checks the response to RequestOptions made with challenge
+// against the stored public key and signature counter of the credential
+// used.
+func (rp *RelyingParty) VerifyAssertion(challenge, storedKey []byte, signCount uint32, resp *AssertionResponse) (*Assertion, error) {
+	if resp.Type != "public-key" {
+		return nil, fmt.Errorf("%w: credential type %q", ErrInvalidResponse, resp.Type)
+	}
+
+	err := rp.verifyClientData(resp.Response.ClientDataJSON, typeGet, challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	ad, err := rp.verifyAuthData(resp.Response.AuthenticatorData)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parseCOSEKey(storedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataHash := sha256.Sum256(resp.Response.ClientDataJSON)
+	signed := append(append([]byte(nil), resp.Response.AuthenticatorData...), clientDataHash[:]...)
+
+	err = key.verify(signed, resp.Response.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	// authenticators without a counter always report zero
+	if (ad.signCount != 0 || signCount != 0) && ad.signCount <= signCount {
+		return nil, ErrClonedAuthenticator
+	}
+
+	return &Assertion{SignCount: ad.signCount, UserVerified: ad.flags&flagUserVerified != 0}, nil
+}
+
+func (rp *RelyingParty) verifyClientData(raw []byte, typ string, challenge []byte) error {
+	var cd ClientData
+	err := json.Unmarshal(raw, &cd)
+	if err != nil {
+		return fmt.Errorf("%w: client data: %v", ErrInvalidResponse, err)
+	}
+
+	if cd.Type != typ {
+		return fmt.Errorf("%w: client data type %q", ErrInvalidResponse, cd.Type)
+	}
+
+	got, err := b64.DecodeString(cd.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return fmt.Errorf("%w: challenge mismatch", ErrInvalidResponse)
+	}
+
+	if cd.CrossOrigin {
+		return fmt.Errorf("%w: cross-origin ceremony", ErrInvalidResponse)
+	}
+
+	for _, origin := range rp.config.Origins {
+		if cd.Origin == origin {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: origin %q not allowed", ErrInvalidResponse, cd.Origin)
+}
+
+// authData is parsed authenticator data.
+type authData struct {
+	flags        byte
+	signCount    uint32
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte
+}
+
+// verifyAuthData parses authenticator data and checks that it is scoped to
+// the relying party and that the user was present, and verified if required.
+func (rp *RelyingParty) verifyAuthData(raw []byte) (*authData, error) {
+	if len(raw) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrInvalidResponse)
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rp.config.RPID))
+	if subtle.ConstantTimeCompare(raw[:32], rpIDHash[:]) != 1 {
+		return nil, fmt.Errorf("%w: relying party id mismatch", ErrInvalidResponse)
+	}
+
+	ad := &authData{
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+
+	if ad.flags&flagUserPresent == 0 {
+		return nil, fmt.Errorf("%w: user not present", ErrInvalidResponse)
+	}
+	if rp.config.UserVerification == VerificationRequired && ad.flags&flagUserVerified == 0 {
+		return nil, fmt.Errorf("%w: user not verified", ErrInvalidResponse)
+	}
+
+	rest := raw[37:]
+
+	if ad.flags&flagAttested != 0 {
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("%w: attested credential data too short", ErrInvalidResponse)
+		}
+		ad.aaguid = rest[:16]
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLen {
+			return nil, fmt.Errorf("%w: credential id too short", ErrInvalidResponse)
+		}
+		ad.credentialID = rest[:idLen]
+		rest = rest[idLen:]
+
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: credential public key: %v", ErrInvalidResponse, err)
+		}
+		ad.publicKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+
+	if ad.flags&flagExtensions != 0 {
+		var err error
+		_, rest, err = decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: extensions: %v", ErrInvalidResponse, err)
+		}
+	}
+
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: trailing bytes in authenticator data", ErrInvalidResponse)
+	}
+
+	return ad, nil
+}
@@ -0,0 +1,582 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+const testOrigin = "https://app.example.com"
+
+func newTestRP(rpID string) *RelyingParty {
+	return New(Config{RPID: rpID, RPName: "Example", Origins: []string{testOrigin}})
+}
+
+var testUser = User{ID: []byte{0, 0, 0, 0, 0, 0, 0, 7}, Name: "jdoe", DisplayName: "Jane Doe"}
+
+// attest runs navigator.credentials.create() for rp on a page from origin.
+func attest(t *testing.T, rp *RelyingParty, a *Authenticator, origin string) ([]byte, *AttestationResponse) {
+	t.Helper()
+
+	challenge, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := a.Create(origin, rp.CreationOptions(challenge, testUser, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return challenge, resp
+}
+
+// register registers a credential with rp and returns it.
+func register(t *testing.T, rp *RelyingParty, a *Authenticator) *Credential {
+	t.Helper()
+
+	challenge, resp := attest(t, rp, a, testOrigin)
+	credential, err := rp.VerifyRegistration(challenge, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return credential
+}
+
+// assert runs navigator.credentials.get() for rp on a page from origin.
+func assert(t *testing.T, rp *RelyingParty, a *Authenticator, origin string, allow [][]byte) ([]byte, *AssertionResponse) {
+	t.Helper()
+
+	challenge, err := NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := a.Get(origin, rp.RequestOptions(challenge, allow))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return challenge, resp
+}
+
+// editAttestation decodes the attestation object of resp, lets edit change
+// it and encodes it again.
+func editAttestation(t *testing.T, resp *AttestationResponse, edit func(obj, stmt map[any]any)) {
+	t.Helper()
+
+	v, _, err := decodeCBOR(resp.Response.AttestationObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := v.(map[any]any)
+	edit(obj, obj["attStmt"].(map[any]any))
+
+	resp.Response.AttestationObject, err = encodeCBOR(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	rp := newTestRP("example.com")
+	a := NewAuthenticator()
+	a.AAGUID = [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+	credential := register(t, rp, a)
+	if len(credential.ID) != 32 || !bytes.Equal(credential.AAGUID, a.AAGUID[:]) {
+		t.Errorf("got credential id %x, aaguid %x", credential.ID, credential.AAGUID)
+	}
+	if credential.SignCount != 0 || !credential.UserVerified {
+		t.Errorf("got sign count %d, user verified %t", credential.SignCount, credential.UserVerified)
+	}
+
+	signCount := credential.SignCount
+	for _, allow := range [][][]byte{{credential.ID}, nil} {
+		challenge, resp := assert(t, rp, a, testOrigin, allow)
+		if !bytes.Equal(resp.RawID, credential.ID) || !bytes.Equal(resp.Response.UserHandle, testUser.ID) {
+			t.Fatalf("got credential %x for user %x", resp.RawID, resp.Response.UserHandle)
+		}
+
+		assertion, err := rp.VerifyAssertion(challenge, credential.PublicKey, signCount, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assertion.SignCount <= signCount || !assertion.UserVerified {
+			t.Errorf("got sign count %d after %d, user verified %t", assertion.SignCount, signCount, assertion.UserVerified)
+		}
+		signCount = assertion.SignCount
+	}
+}
+
+func TestRegisterThroughJSON(t *testing.T) {
+	rp := newTestRP("example.com")
+	a := NewAuthenticator()
+
+	// options and responses cross the wire as JSON
+	challenge, _ := NewChallenge()
+	raw, err := json.Marshal(rp.CreationOptions(challenge, testUser, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opts CreationOptions
+	err = json.Unmarshal(raw, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := a.Create(testOrigin, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err = json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received AttestationResponse
+	err = json.Unmarshal(raw, &received)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Challenge(received.Response.ClientDataJSON)
+	if err != nil || !bytes.Equal(got, challenge) {
+		t.Fatalf("got challenge %x, %v", got, err)
+	}
+
+	_, err = rp.VerifyRegistration(challenge, &received)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExcludeCredentials(t *testing.T) {
+	rp := newTestRP("example.com")
+	a := NewAuthenticator()
+	credential := register(t, rp, a)
+
+	challenge, _ := NewChallenge()
+	_, err := a.Create(testOrigin, rp.CreationOptions(challenge, testUser, [][]byte{credential.ID}))
+	if !errors.Is(err, ErrCredentialExcluded) {
+		t.Errorf("got %v, want ErrCredentialExcluded", err)
+	}
+}
+
+// selfSignedCertificate returns an attestation certificate and its key.
+func selfSignedCertificate(t *testing.T) ([]byte, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Test Authenticator Attestation"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return der, key
+}
+
+func TestRegisterWithAttestationCertificate(t *testing.T) {
+	rp := newTestRP("example.com")
+	der, certKey := selfSignedCertificate(t)
+
+	challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+	editAttestation(t, resp, func(obj, stmt map[any]any) {
+		sig, err := sign(certKey, obj["authData"].([]byte), resp.Response.ClientDataJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stmt["sig"] = sig
+		stmt["x5c"] = []any{der}
+	})
+
+	_, err := rp.VerifyRegistration(challenge, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// with a certificate, the credential's own signature isn't enough
+	challenge, resp = attest(t, rp, NewAuthenticator(), testOrigin)
+	editAttestation(t, resp, func(obj, stmt map[any]any) {
+		stmt["x5c"] = []any{der}
+	})
+
+	_, err = rp.VerifyRegistration(challenge, resp)
+	if !errors.Is(err, ErrSignature) {
+		t.Errorf("got %v, want ErrSignature", err)
+	}
+}
+
+func TestVerifyRegistrationRefuses(t *testing.T) {
+	tests := []struct {
+		name string
+		// run returns the relying party, the challenge it issued and the
+		// response to verify
+		run  func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse)
+		want error
+	}{
+		{"wrong origin", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), "https://evil.example")
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"wrong relying party id", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			challenge, resp := attest(t, newTestRP("evil.example"), NewAuthenticator(), testOrigin)
+			return newTestRP("example.com"), challenge, resp
+		}, ErrInvalidResponse},
+		{"other challenge", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			_, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			challenge, _ := NewChallenge()
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"client data of a login", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			resp.Response.ClientDataJSON, _ = clientData(typeGet, challenge, testOrigin)
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"cross origin", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			resp.Response.ClientDataJSON, _ = json.Marshal(ClientData{
+				Type:        typeCreate,
+				Challenge:   b64.EncodeToString(challenge),
+				Origin:      testOrigin,
+				CrossOrigin: true,
+			})
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"malformed client data", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			resp.Response.ClientDataJSON = []byte(`{"type":`)
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"credential type", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			resp.Type = "password"
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"credential id mismatch", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			resp.RawID = bytes.Repeat([]byte{1}, 32)
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"user verification required", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := New(Config{RPID: "example.com", Origins: []string{testOrigin}, UserVerification: VerificationRequired})
+			a := NewAuthenticator()
+			a.UserVerified = false
+			challenge, resp := attest(t, rp, a, testOrigin)
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"truncated attestation object", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			resp.Response.AttestationObject = resp.Response.AttestationObject[:len(resp.Response.AttestationObject)-1]
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"trailing bytes after attestation object", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			resp.Response.AttestationObject = append(resp.Response.AttestationObject, 0x00)
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"attestation object not a map", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			resp.Response.AttestationObject, _ = encodeCBOR([]any{"packed"})
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"short authenticator data", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			editAttestation(t, resp, func(obj, stmt map[any]any) {
+				obj["authData"] = obj["authData"].([]byte)[:36]
+			})
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"truncated credential public key", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			editAttestation(t, resp, func(obj, stmt map[any]any) {
+				authData := obj["authData"].([]byte)
+				obj["authData"] = authData[:len(authData)-1]
+			})
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"user not present", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			editAttestation(t, resp, func(obj, stmt map[any]any) {
+				obj["authData"].([]byte)[32] &^= flagUserPresent
+			})
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"altered signature", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			editAttestation(t, resp, func(obj, stmt map[any]any) {
+				stmt["sig"].([]byte)[8] ^= 1
+			})
+			return rp, challenge, resp
+		}, ErrSignature},
+		{"no signature", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			editAttestation(t, resp, func(obj, stmt map[any]any) {
+				delete(stmt, "sig")
+			})
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"self attestation algorithm mismatch", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			editAttestation(t, resp, func(obj, stmt map[any]any) {
+				stmt["alg"] = int64(AlgRS256)
+			})
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"empty x5c", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			editAttestation(t, resp, func(obj, stmt map[any]any) {
+				stmt["x5c"] = []any{}
+			})
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"x5c not an array", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			der, _ := selfSignedCertificate(t)
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			editAttestation(t, resp, func(obj, stmt map[any]any) {
+				stmt["x5c"] = der
+			})
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"certificate not a byte string", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			editAttestation(t, resp, func(obj, stmt map[any]any) {
+				stmt["x5c"] = []any{"certificate"}
+			})
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"malformed certificate", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			editAttestation(t, resp, func(obj, stmt map[any]any) {
+				stmt["x5c"] = []any{[]byte{0x30, 0x03, 0x02, 0x01}}
+			})
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"statement with format none", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			editAttestation(t, resp, func(obj, stmt map[any]any) {
+				obj["fmt"] = "none"
+			})
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"no statement", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			editAttestation(t, resp, func(obj, stmt map[any]any) {
+				delete(obj, "attStmt")
+			})
+			return rp, challenge, resp
+		}, ErrInvalidResponse},
+		{"unsupported format", func(t *testing.T) (*RelyingParty, []byte, *AttestationResponse) {
+			rp := newTestRP("example.com")
+			challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+			editAttestation(t, resp, func(obj, stmt map[any]any) {
+				obj["fmt"] = "tpm"
+			})
+			return rp, challenge, resp
+		}, ErrUnsupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp, challenge, resp := tt.run(t)
+
+			credential, err := rp.VerifyRegistration(challenge, resp)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, %v, want %v", credential, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatNone(t *testing.T) {
+	rp := newTestRP("example.com")
+	challenge, resp := attest(t, rp, NewAuthenticator(), testOrigin)
+	editAttestation(t, resp, func(obj, stmt map[any]any) {
+		obj["fmt"] = "none"
+		obj["attStmt"] = map[any]any{}
+	})
+
+	_, err := rp.VerifyRegistration(challenge, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyAssertionRefuses(t *testing.T) {
+	rp := newTestRP("example.com")
+	a := NewAuthenticator()
+	credential := register(t, rp, a)
+
+	other := NewAuthenticator()
+	otherCredential := register(t, rp, other)
+
+	tests := []struct {
+		name string
+		// run returns the challenge issued, the stored key and counter and
+		// the response to verify
+		run  func(t *testing.T) ([]byte, []byte, uint32, *AssertionResponse)
+		want error
+	}{
+		{"wrong origin", func(t *testing.T) ([]byte, []byte, uint32, *AssertionResponse) {
+			challenge, resp := assert(t, rp, a, "https://evil.example", nil)
+			return challenge, credential.PublicKey, 0, resp
+		}, ErrInvalidResponse},
+		{"wrong relying party id", func(t *testing.T) ([]byte, []byte, uint32, *AssertionResponse) {
+			evil := newTestRP("evil.example")
+			evilCredential := register(t, evil, a)
+			challenge, resp := assert(t, evil, a, testOrigin, nil)
+			return challenge, evilCredential.PublicKey, 0, resp
+		}, ErrInvalidResponse},
+		{"replayed challenge", func(t *testing.T) ([]byte, []byte, uint32, *AssertionResponse) {
+			_, resp := assert(t, rp, a, testOrigin, nil)
+			challenge, _ := NewChallenge()
+			return challenge, credential.PublicKey, 0, resp
+		}, ErrInvalidResponse},
+		{"client data of a registration", func(t *testing.T) ([]byte, []byte, uint32, *AssertionResponse) {
+			challenge, resp := assert(t, rp, a, testOrigin, nil)
+			resp.Response.ClientDataJSON, _ = clientData(typeCreate, challenge, testOrigin)
+			return challenge, credential.PublicKey, 0, resp
+		}, ErrInvalidResponse},
+		{"credential type", func(t *testing.T) ([]byte, []byte, uint32, *AssertionResponse) {
+			challenge, resp := assert(t, rp, a, testOrigin, nil)
+			resp.Type = "password"
+			return challenge, credential.PublicKey, 0, resp
+		}, ErrInvalidResponse},
+		{"short authenticator data", func(t *testing.T) ([]byte, []byte, uint32, *AssertionResponse) {
+			challenge, resp := assert(t, rp, a, testOrigin, nil)
+			resp.Response.AuthenticatorData = resp.Response.AuthenticatorData[:36]
+			return challenge, credential.PublicKey, 0, resp
+		}, ErrInvalidResponse},
+		{"trailing bytes in authenticator data", func(t *testing.T) ([]byte, []byte, uint32, *AssertionResponse) {
+			challenge, resp := assert(t, rp, a, testOrigin, nil)
+			resp.Response.AuthenticatorData = append(resp.Response.AuthenticatorData, 0x00)
+			return challenge, credential.PublicKey, 0, resp
+		}, ErrInvalidResponse},
+		{"altered authenticator data", func(t *testing.T) ([]byte, []byte, uint32, *AssertionResponse) {
+			challenge, resp := assert(t, rp, a, testOrigin, nil)
+			resp.Response.AuthenticatorData[36]++
+			return challenge, credential.PublicKey, 0, resp
+		}, ErrSignature},
+		{"signed by another credential", func(t *testing.T) ([]byte, []byte, uint32, *AssertionResponse) {
+			challenge, resp := assert(t, rp, other, testOrigin, nil)
+			return challenge, credential.PublicKey, 0, resp
+		}, ErrSignature},
+		{"malformed stored key", func(t *testing.T) ([]byte, []byte, uint32, *AssertionResponse) {
+			challenge, resp := assert(t, rp, other, testOrigin, nil)
+			return challenge, otherCredential.PublicKey[:10], 0, resp
+		}, errCBOR},
+		{"sign count regression", func(t *testing.T) ([]byte, []byte, uint32, *AssertionResponse) {
+			challenge, resp := assert(t, rp, a, testOrigin, nil)
+			return challenge, credential.PublicKey, 1000, resp
+		}, ErrClonedAuthenticator},
+		{"replayed assertion", func(t *testing.T) ([]byte, []byte, uint32, *AssertionResponse) {
+			challenge, resp := assert(t, rp, a, testOrigin, nil)
+			assertion, err := rp.VerifyAssertion(challenge, credential.PublicKey, 0, resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return challenge, credential.PublicKey, assertion.SignCount, resp
+		}, ErrClonedAuthenticator},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			challenge, storedKey, signCount, resp := tt.run(t)
+
+			assertion, err := rp.VerifyAssertion(challenge, storedKey, signCount, resp)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, %v, want %v", assertion, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssertionWithoutCounter(t *testing.T) {
+	rp := newTestRP("example.com")
+	a := NewAuthenticator()
+	credential := register(t, rp, a)
+
+	// authenticators without a counter report zero every time
+	challenge, resp := assert(t, rp, a, testOrigin, nil)
+	authData := resp.Response.AuthenticatorData
+	copy(authData[33:37], []byte{0, 0, 0, 0})
+	resp.Response.Signature, _ = sign(a.credentials[0].key, authData, resp.Response.ClientDataJSON)
+
+	_, err := rp.VerifyAssertion(challenge, credential.PublicKey, 0, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	challenge := sha256.Sum256([]byte("challenge"))
+	raw, _ := clientData(typeGet, challenge[:], testOrigin)
+
+	got, err := Challenge(raw)
+	if err != nil || !bytes.Equal(got, challenge[:]) {
+		t.Errorf("got %x, %v", got, err)
+	}
+
+	for _, raw := range []string{`{`, `{"challenge":""}`, `{"challenge":"not base64!"}`} {
+		_, err := Challenge([]byte(raw))
+		if !errors.Is(err, ErrInvalidResponse) {
+			t.Errorf("%s: got %v, want ErrInvalidResponse", raw, err)
+		}
+	}
+}
+
+func TestBytesJSON(t *testing.T) {
+	var b Bytes
+	for _, s := range []string{`"-_8"`, `"+/8="`} {
+		err := json.Unmarshal([]byte(s), &b)
+		if err != nil || !bytes.Equal(b, []byte{0xfb, 0xff}) {
+			t.Errorf("%s: got %x, %v", s, b, err)
+		}
+	}
+
+	raw, _ := json.Marshal(Bytes{0xfb, 0xff})
+	if string(raw) != `"-_8"` {
+		t.Errorf("got %s", raw)
+	}
+}
@@ -0,0 +1,8 @@
+-- The plain text of a hashed token cannot be recovered, so existing sessions
+-- are removed and users will have to log in again.
+drop index if exists tokens_token_hash_idx;
+
+delete from tokens;
+
+alter table tokens add column token varchar(255) not null default '';
+alter table tokens alter column token drop default;
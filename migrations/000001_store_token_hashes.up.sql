@@ -0,0 +1,8 @@
+-- Tokens are only ever looked up by the sha256 hash of the plain text value,
+-- so the plain text column is backfilled into token_hash and then dropped.
+update tokens set token_hash = sha256(convert_to(token, 'UTF8')) where token_hash is null;
+
+alter table tokens drop column token;
+alter table tokens alter column token_hash set not null;
+
+create unique index if not exists tokens_token_hash_idx on tokens (token_hash);
@@ -0,0 +1,7 @@
+delete from tokens where scope <> 'authentication';
+
+drop index if exists tokens_family_idx;
+
+alter table tokens drop column used_at;
+alter table tokens drop column family;
+alter table tokens drop column scope;
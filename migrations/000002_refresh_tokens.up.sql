@@ -0,0 +1,8 @@
+-- Refresh tokens share the tokens table with access tokens. Every token of a
+-- login belongs to the same family, which is revoked as a whole when a used
+-- refresh token is presented again.
+alter table tokens add column scope varchar(20) not null default 'authentication';
+alter table tokens add column family varchar(26) not null default '';
+alter table tokens add column used_at timestamp;
+
+create index if not exists tokens_family_idx on tokens (family);
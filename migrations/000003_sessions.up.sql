@@ -0,0 +1,12 @@
+-- A session is one login of a user on one device. Its id is the family of the
+-- access and refresh tokens issued for it.
+create table if not exists sessions (
+	id varchar(26) primary key,
+	user_id integer not null references users (id) on delete cascade,
+	user_agent text not null default '',
+	ip varchar(64) not null default '',
+	created_at timestamp not null default now(),
+	last_seen_at timestamp not null default now()
+);
+
+create index if not exists sessions_user_id_idx on sessions (user_id, last_seen_at);
@@ -0,0 +1,4 @@
+-- Sessions end at an absolute point in time, whatever their activity.
+alter table sessions add column expires_at timestamp;
+update sessions set expires_at = created_at + interval '12 hours';
+alter table sessions alter column expires_at set not null;
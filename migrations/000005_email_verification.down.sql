@@ -0,0 +1,4 @@
+delete from tokens where scope = 'email-verification';
+
+alter table users drop column pending_email;
+alter table users drop column verified_at;
@@ -0,0 +1,6 @@
+-- Users confirm their email address. Accounts that exist already are treated
+-- as verified so that nobody is locked out by the migration.
+alter table users add column verified_at timestamp;
+alter table users add column pending_email varchar(255) not null default '';
+
+update users set verified_at = created_at;
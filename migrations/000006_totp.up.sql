@@ -0,0 +1,15 @@
+-- TOTP two-factor authentication. totp_last_step is the last time step a code
+-- was accepted for, so that a code can't be used twice.
+alter table users add column totp_secret varchar(64) not null default '';
+alter table users add column totp_enabled_at timestamp;
+alter table users add column totp_last_step bigint not null default 0;
+
+create table if not exists recovery_codes (
+	id serial primary key,
+	user_id integer not null references users (id) on delete cascade,
+	code_hash bytea not null,
+	used_at timestamp,
+	created_at timestamp not null default now()
+);
+
+create index if not exists recovery_codes_user_id_idx on recovery_codes (user_id);
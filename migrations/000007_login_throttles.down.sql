@@ -0,0 +1,2 @@
+drop table if exists lockout_events;
+drop table if exists login_throttles;
@@ -0,0 +1,23 @@
+-- Failed logins are counted per account identifier and per client IP. The
+-- key is the identifier as typed, so unknown accounts lock like real ones.
+create table if not exists login_throttles (
+	kind varchar(20) not null,
+	key varchar(255) not null,
+	failures integer not null default 0,
+	lockouts integer not null default 0,
+	locked_until timestamp,
+	updated_at timestamp not null default now(),
+	primary key (kind, key)
+);
+
+create table if not exists lockout_events (
+	id serial primary key,
+	kind varchar(20) not null,
+	key varchar(255) not null,
+	event varchar(20) not null,
+	actor_id integer references users (id) on delete set null,
+	until timestamp not null,
+	created_at timestamp not null default now()
+);
+
+create index if not exists lockout_events_created_at_idx on lockout_events (created_at);
@@ -0,0 +1,5 @@
+drop trigger if exists users_unique_login on users;
+drop function if exists users_unique_login();
+
+drop index if exists users_username_lower_idx;
+drop index if exists users_email_lower_idx;
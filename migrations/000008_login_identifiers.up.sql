@@ -0,0 +1,27 @@
+-- Users log in with either their username or their email address, ignoring
+-- case. Emails are stored lower case, and no identifier may belong to two
+-- users, whichever of the two columns it is in. Fix any duplicates reported
+-- by this migration before running it again.
+update users set email = lower(trim(email)), username = trim(username);
+
+create unique index if not exists users_email_lower_idx on users (lower(email));
+create unique index if not exists users_username_lower_idx on users (lower(username));
+
+create or replace function users_unique_login() returns trigger as $$
+begin
+	if exists (
+		select 1 from users
+		where id <> new.id
+		and (lower(username) = lower(new.email) or lower(email) = lower(new.username))
+	) then
+		raise exception 'login identifier of user % is already in use', new.id
+			using errcode = 'unique_violation';
+	end if;
+
+	return new;
+end;
+$$ language plpgsql;
+
+create trigger users_unique_login
+	before insert or update of username, email on users
+	for each row execute function users_unique_login();
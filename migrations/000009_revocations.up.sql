@@ -0,0 +1,8 @@
+-- Denylist for signed access tokens. A subject is either a session
+-- ("sid:<id>") or a user ("uid:<id>"); tokens of the subject issued up to
+-- revoked_at are refused until the entry expires.
+create table if not exists revocations (
+	subject varchar(64) primary key,
+	revoked_at timestamp not null,
+	expires_at timestamp not null
+);
@@ -0,0 +1,15 @@
+-- Personal access tokens for scripts and integrations. Only the sha256 hash
+-- of a key is stored; prefix keeps enough of it to recognise it in a list.
+create table if not exists api_keys (
+	id serial primary key,
+	user_id integer not null references users (id) on delete cascade,
+	name varchar(255) not null,
+	prefix varchar(20) not null,
+	key_hash bytea not null unique,
+	scopes text not null default '',
+	last_used_at timestamp,
+	expires_at timestamp,
+	created_at timestamp not null default now()
+);
+
+create index if not exists api_keys_user_id_idx on api_keys (user_id);
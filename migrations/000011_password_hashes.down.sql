@@ -0,0 +1,5 @@
+-- Exact inverse of the up migration: the column goes back to varchar(255).
+-- Hashes are kept as they are; bcrypt and argon2id hashes with the default
+-- parameters are well under 255 characters. A longer hash makes the
+-- migration fail instead of being truncated.
+alter table users alter column password type varchar(255);
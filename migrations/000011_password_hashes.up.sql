@@ -0,0 +1,4 @@
+-- Passwords are stored as PHC strings, whose length depends on the algorithm
+-- and its parameters, so the column is no longer length limited. Existing
+-- bcrypt hashes stay valid and are replaced at the next login.
+alter table users alter column password type text;
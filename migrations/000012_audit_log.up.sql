@@ -0,0 +1,34 @@
+-- Security relevant actions are appended to audit_log. Every row carries the
+-- sha256 hash of its own contents and of the previous row's hash, so editing,
+-- removing or reordering rows breaks the chain. Rows can't be updated or
+-- deleted through SQL either. Users are referenced by id only, so entries
+-- outlive the users they are about.
+create table if not exists audit_log (
+	id bigserial primary key,
+	actor_id integer,
+	action varchar(64) not null,
+	target_id integer,
+	target varchar(255) not null default '',
+	changes text not null default '',
+	ip varchar(64) not null default '',
+	user_agent varchar(255) not null default '',
+	request_id varchar(255) not null default '',
+	created_at timestamptz not null,
+	prev_hash bytea not null,
+	hash bytea not null
+);
+
+create index if not exists audit_log_actor_idx on audit_log (actor_id, created_at);
+create index if not exists audit_log_target_idx on audit_log (target_id, created_at);
+create index if not exists audit_log_created_at_idx on audit_log (created_at);
+
+create or replace function audit_log_append_only() returns trigger as $$
+begin
+	raise exception 'audit_log is append-only';
+end;
+$$ language plpgsql;
+
+drop trigger if exists audit_log_append_only on audit_log;
+create trigger audit_log_append_only
+	before update or delete on audit_log
+	for each row execute function audit_log_append_only();
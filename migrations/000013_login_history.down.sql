@@ -0,0 +1,5 @@
+drop table if exists login_events;
+
+alter table users drop column if exists failed_logins;
+alter table users drop column if exists last_login_ip;
+alter table users drop column if exists last_login_at;
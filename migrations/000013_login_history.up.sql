@@ -0,0 +1,17 @@
+-- Users remember their last successful login and count failed logins since
+-- then. Every login attempt for an existing account is kept in login_events.
+alter table users add column if not exists last_login_at timestamp;
+alter table users add column if not exists last_login_ip varchar(64) not null default '';
+alter table users add column if not exists failed_logins integer not null default 0;
+
+create table if not exists login_events (
+	id bigserial primary key,
+	user_id integer not null references users (id) on delete cascade,
+	success boolean not null,
+	reason varchar(64) not null default '',
+	ip varchar(64) not null default '',
+	user_agent varchar(255) not null default '',
+	created_at timestamp not null default now()
+);
+
+create index if not exists login_events_user_id_idx on login_events (user_id, created_at);
@@ -0,0 +1,5 @@
+-- The audit column stays: audit_log is append-only, and dropping the column
+-- would break the hash chain of entries written under impersonation.
+delete from tokens where impersonator_id is not null;
+
+alter table tokens drop column if exists impersonator_id;
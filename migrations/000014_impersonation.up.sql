@@ -0,0 +1,7 @@
+-- Impersonation tokens are access tokens of the impersonated user that also
+-- name the admin who asked for them. Audit entries written under one record
+-- both. Existing entries keep their hashes, since a missing impersonator is
+-- left out of the hashed fields.
+alter table tokens add column if not exists impersonator_id integer references users (id) on delete cascade;
+
+alter table audit_log add column if not exists impersonator_id integer;
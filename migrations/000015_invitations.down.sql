@@ -0,0 +1,7 @@
+drop index if exists users_pending_invitations_idx;
+
+delete from tokens where scope = 'invitation';
+
+alter table users drop column if exists invitation_accepted_at;
+alter table users drop column if exists invited_at;
+alter table users drop column if exists invited_by;
@@ -0,0 +1,9 @@
+-- New users are invited rather than given a password by an admin. An invited
+-- user has no password and stays inactive until they accept the invitation,
+-- whose link is a token of scope 'invitation'.
+alter table users add column if not exists invited_by integer references users (id) on delete set null;
+alter table users add column if not exists invited_at timestamp;
+alter table users add column if not exists invitation_accepted_at timestamp;
+
+create index if not exists users_pending_invitations_idx on users (invited_at)
+	where invited_at is not null and invitation_accepted_at is null;
@@ -0,0 +1,5 @@
+drop index if exists users_pending_registrations_idx;
+
+alter table users drop column if exists registration_approved_by;
+alter table users drop column if exists registration_approved_at;
+alter table users drop column if exists registered_at;
@@ -0,0 +1,8 @@
+-- People can ask for an account themselves. A registered user stays inactive
+-- until an admin approves them; rejected registrations are deleted.
+alter table users add column if not exists registered_at timestamp;
+alter table users add column if not exists registration_approved_at timestamp;
+alter table users add column if not exists registration_approved_by integer references users (id) on delete set null;
+
+create index if not exists users_pending_registrations_idx on users (registered_at)
+	where registered_at is not null and registration_approved_at is null;
@@ -0,0 +1,3 @@
+delete from tokens where scope = 'magic-link';
+
+alter table tokens drop column if exists binding_hash;
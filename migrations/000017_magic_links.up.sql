@@ -0,0 +1,3 @@
+-- Magic login links are tokens of scope 'magic-link'. Each is bound to the
+-- browser that asked for it by the hash of a nonce only that browser holds.
+alter table tokens add column if not exists binding_hash bytea;
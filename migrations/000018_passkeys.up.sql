@@ -0,0 +1,25 @@
+-- WebAuthn passkeys. public_key is the credential's COSE key as the
+-- authenticator returned it; sign_count is the last signature counter seen,
+-- to spot cloned authenticators.
+create table if not exists passkeys (
+	id serial primary key,
+	user_id integer not null references users (id) on delete cascade,
+	name varchar(255) not null,
+	credential_id bytea not null unique,
+	public_key bytea not null,
+	aaguid bytea not null,
+	sign_count bigint not null default 0,
+	last_used_at timestamp,
+	created_at timestamp not null default now()
+);
+
+create index if not exists passkeys_user_id_idx on passkeys (user_id);
+
+-- Outstanding registration and login challenges, by sha256 hash. A login
+-- challenge may have no user, when the authenticator picks the credential.
+create table if not exists webauthn_challenges (
+	challenge_hash bytea primary key,
+	user_id integer references users (id) on delete cascade,
+	purpose varchar(16) not null,
+	expires_at timestamp not null
+);